@@ -0,0 +1,568 @@
+package buildworker
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/checker"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+// Analyzers are the analyzers that plugins are checked with,
+// beyond go vet, when they are deployed. Each one is a rule
+// with a severity in AnalysisSeverity.
+var Analyzers = []*analysis.Analyzer{
+	ForbiddenImportsAnalyzer,
+	InitSideEffectsAnalyzer,
+	SetupPanicAnalyzer,
+	DefaultClientAnalyzer,
+}
+
+// AnalysisSeverity is the severity of the findings of each of
+// the Analyzers, by name: "error" fails the check, "warning"
+// only reports them, and "off" does not run the analyzer.
+// Analyzers not listed have the severity "error".
+var AnalysisSeverity = map[string]string{
+	"forbiddenimports": "error",
+	"initsideeffects":  "error",
+	"setuppanic":       "warning",
+	"defaultclient":    "warning",
+}
+
+// ForbiddenImports are the packages that ForbiddenImportsAnalyzer
+// reports imports of.
+var ForbiddenImports = []string{"os/exec", "unsafe", "plugin"}
+
+// Finding is a problem found by one of the Analyzers.
+type Finding struct {
+	Rule     string `json:"rule"`     // name of the analyzer
+	Severity string `json:"severity"` // error or warning
+	Package  string `json:"package"`
+	Position string `json:"position"` // file:line:column, relative to the checked package
+	Message  string `json:"message"`
+}
+
+// analysisSeverity returns the severity of the rule.
+func analysisSeverity(rule string) string {
+	if severity, ok := AnalysisSeverity[rule]; ok {
+		return severity
+	}
+	return "error"
+}
+
+// analyze runs the Analyzers that are not off on the package
+// pkg and the packages in it, and records their findings in
+// the report. It returns an error if any of the findings have
+// the severity "error".
+func (be BuildEnv) analyze(pkg string) error {
+	var analyzers []*analysis.Analyzer
+	var names []string
+	for _, a := range Analyzers {
+		if analysisSeverity(a.Name) != "off" {
+			analyzers = append(analyzers, a)
+			names = append(names, a.Name)
+		}
+	}
+	if len(analyzers) == 0 {
+		return nil
+	}
+
+	be.log.Info("analyzing", "phase", "check", "package", pkg, "analyzers", names)
+	dir := be.TemporaryPath(pkg)
+	pkgs, err := be.loadPackages(dir, "./...")
+	if err != nil {
+		return err
+	}
+
+	graph, err := checker.Analyze(analyzers, pkgs, nil)
+	if err != nil {
+		return err
+	}
+	type finding struct {
+		Finding
+		pos token.Position
+	}
+	var found []finding
+	for _, act := range graph.Roots {
+		if act.Err != nil {
+			return fmt.Errorf("%s: %v", act.Analyzer.Name, act.Err)
+		}
+		for _, d := range act.Diagnostics {
+			pos := act.Package.Fset.Position(d.Pos)
+			if rel, err := filepath.Rel(dir, pos.Filename); err == nil {
+				pos.Filename = filepath.ToSlash(rel)
+			}
+			found = append(found, finding{Finding{
+				Rule:     act.Analyzer.Name,
+				Severity: analysisSeverity(act.Analyzer.Name),
+				Package:  act.Package.PkgPath,
+				Position: pos.String(),
+				Message:  d.Message,
+			}, pos})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i].pos, found[j].pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+
+	findings := make([]Finding, 0, len(found))
+	var problems []string
+	for _, f := range found {
+		findings = append(findings, f.Finding)
+		if f.Severity == "error" {
+			problems = append(problems, fmt.Sprintf("%s: %s (%s)", f.Position, f.Message, f.Rule))
+		} else {
+			be.log.Warn("analysis finding", "phase", "check", "package", f.Package,
+				"rule", f.Rule, "position", f.Position, "message", f.Message)
+		}
+	}
+	be.Report.addFindings(findings)
+	if len(problems) > 0 {
+		return fmt.Errorf("analysis findings: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// loadPackages loads the packages matching pattern in the
+// folder dir, and the packages they import, with their syntax
+// and types, for analysis.
+func (be BuildEnv) loadPackages(dir, pattern string) ([]*packages.Package, error) {
+	ctx := context.Background()
+	if CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CommandTimeout)
+		defer cancel()
+	}
+	cfg := &packages.Config{
+		Context: ctx,
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps |
+			packages.NeedTypes | packages.NeedTypesSizes | packages.NeedSyntax | packages.NeedTypesInfo,
+		Dir: dir,
+		Env: be.newCommand("go").Env,
+	}
+	pkgs, err := packages.Load(cfg, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("loading packages: %v", err)
+	}
+	var loadErrs []string
+	packages.Visit(pkgs, nil, func(p *packages.Package) {
+		for _, e := range p.Errors {
+			loadErrs = append(loadErrs, e.Error())
+		}
+	})
+	if len(loadErrs) > 0 {
+		return nil, fmt.Errorf("loading packages: %s", strings.Join(loadErrs, "; "))
+	}
+	return pkgs, nil
+}
+
+// ForbiddenImportsAnalyzer reports imports of ForbiddenImports.
+var ForbiddenImportsAnalyzer = &analysis.Analyzer{
+	Name: "forbiddenimports",
+	Doc:  "report imports of forbidden packages, such as os/exec, unsafe, and plugin",
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		for _, file := range pass.Files {
+			for _, imp := range file.Imports {
+				path, err := strconv.Unquote(imp.Path.Value)
+				if err != nil {
+					continue
+				}
+				for _, forbidden := range ForbiddenImports {
+					if path == forbidden {
+						pass.Reportf(imp.Pos(), "import of forbidden package %s", path)
+						break
+					}
+				}
+			}
+		}
+		return nil, nil
+	},
+}
+
+// InitSideEffectsAnalyzer reports init functions and
+// initializers of package variables that make network calls,
+// directly or through functions that they call, in their
+// package or in the packages it imports.
+var InitSideEffectsAnalyzer = &analysis.Analyzer{
+	Name:      "initsideeffects",
+	Doc:       "report network calls made by init functions and package variable initializers",
+	Run:       runInitSideEffects,
+	FactTypes: []analysis.Fact{new(makesNetworkCall)},
+}
+
+// makesNetworkCall is the fact of a function that makes
+// a network call, directly or through functions that it
+// calls, so that calls from other packages are followed.
+type makesNetworkCall struct {
+	Call string // the network function that is called
+}
+
+func (*makesNetworkCall) AFact() {}
+
+func (f *makesNetworkCall) String() string {
+	return "makesNetworkCall(" + f.Call + ")"
+}
+
+func runInitSideEffects(pass *analysis.Pass) (interface{}, error) {
+	// the standard library is covered by networkFuncs
+	if isStandardPackage(pass.Pkg.Path()) {
+		return nil, nil
+	}
+
+	decls := make(map[*types.Func]*ast.FuncDecl)
+	for _, file := range pass.Files {
+		for _, decl := range file.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && fd.Body != nil {
+				if fn, ok := pass.TypesInfo.Defs[fd.Name].(*types.Func); ok {
+					decls[fn] = fd
+				}
+			}
+		}
+	}
+
+	// networkCall returns the network call that fn makes,
+	// directly or through other functions, or "" if it
+	// makes none; calleeNetworkCall does the same for any
+	// function that is called, using the facts of the
+	// packages that are imported
+	memo := make(map[*types.Func]string)
+	var networkCall, calleeNetworkCall func(fn *types.Func) string
+	networkCall = func(fn *types.Func) string {
+		if call, ok := memo[fn]; ok {
+			return call
+		}
+		memo[fn] = "" // in case of recursion
+		var found string
+		ast.Inspect(decls[fn].Body, func(n ast.Node) bool {
+			if found != "" {
+				return false
+			}
+			if call, ok := n.(*ast.CallExpr); ok {
+				if callee, ok := typeutil.Callee(pass.TypesInfo, call).(*types.Func); ok {
+					found = calleeNetworkCall(callee)
+				}
+			}
+			return true
+		})
+		memo[fn] = found
+		return found
+	}
+	calleeNetworkCall = func(fn *types.Func) string {
+		fn = fn.Origin()
+		if networkFuncs[funcKey(fn)] {
+			return fn.FullName()
+		}
+		if _, local := decls[fn]; local {
+			return networkCall(fn)
+		}
+		var fact makesNetworkCall
+		if fn.Pkg() != nil && fn.Pkg() != pass.Pkg && pass.ImportObjectFact(fn, &fact) {
+			return fact.Call
+		}
+		return ""
+	}
+
+	// check reports the network call that call,
+	// which is part of what, makes, if any
+	check := func(call *ast.CallExpr, what string) {
+		callee, ok := typeutil.Callee(pass.TypesInfo, call).(*types.Func)
+		if !ok {
+			return
+		}
+		if networkFuncs[funcKey(callee.Origin())] {
+			pass.Reportf(call.Pos(), "%s makes a network call: %s", what, callee.FullName())
+		} else if via := calleeNetworkCall(callee); via != "" {
+			name := callee.Name()
+			if callee.Pkg() != pass.Pkg {
+				name = callee.FullName()
+			}
+			pass.Reportf(call.Pos(), "%s calls %s, which makes a network call: %s", what, name, via)
+		}
+	}
+	checkCalls := func(body *ast.BlockStmt, what string) {
+		ast.Inspect(body, func(n ast.Node) bool {
+			if call, ok := n.(*ast.CallExpr); ok {
+				check(call, what)
+			}
+			return true
+		})
+	}
+
+	for _, fd := range decls {
+		if fd.Name.Name == "init" && fd.Recv == nil {
+			checkCalls(fd.Body, "init")
+		}
+	}
+
+	// package variables are initialized when the package
+	// is, like init functions are run; function literals
+	// in their initializers only run if they are called
+	for _, init := range pass.TypesInfo.InitOrder {
+		what := "initializer of " + init.Lhs[0].Name()
+		ast.Inspect(init.Rhs, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				if lit, ok := ast.Unparen(n.Fun).(*ast.FuncLit); ok {
+					checkCalls(lit.Body, what)
+				} else {
+					check(n, what)
+				}
+			}
+			return true
+		})
+	}
+
+	// let packages that import this one follow
+	// calls of its functions
+	for fn := range decls {
+		if call := networkCall(fn); call != "" {
+			pass.ExportObjectFact(fn, &makesNetworkCall{Call: call})
+		}
+	}
+	return nil, nil
+}
+
+// isStandardPackage returns whether the package with the
+// import path pkgPath is part of the standard library,
+// whose import paths have no dot in their first element.
+func isStandardPackage(pkgPath string) bool {
+	return !strings.Contains(strings.SplitN(pkgPath, "/", 2)[0], ".")
+}
+
+// networkFuncs are the functions and methods (see funcKey)
+// of the standard library that make network connections or
+// requests, or listen on the network.
+var networkFuncs = map[string]bool{
+	"net.Dial":                      true,
+	"net.DialTimeout":               true,
+	"net.DialIP":                    true,
+	"net.DialTCP":                   true,
+	"net.DialUDP":                   true,
+	"net.DialUnix":                  true,
+	"net.Listen":                    true,
+	"net.ListenPacket":              true,
+	"net.ListenIP":                  true,
+	"net.ListenTCP":                 true,
+	"net.ListenUDP":                 true,
+	"net.ListenUnix":                true,
+	"net.ListenUnixgram":            true,
+	"net.ListenMulticastUDP":        true,
+	"net.LookupAddr":                true,
+	"net.LookupCNAME":               true,
+	"net.LookupHost":                true,
+	"net.LookupIP":                  true,
+	"net.LookupMX":                  true,
+	"net.LookupNS":                  true,
+	"net.LookupPort":                true,
+	"net.LookupSRV":                 true,
+	"net.LookupTXT":                 true,
+	"net.Dialer.Dial":               true,
+	"net.Dialer.DialContext":        true,
+	"net.ListenConfig.Listen":       true,
+	"net.ListenConfig.ListenPacket": true,
+	"net.Resolver.LookupAddr":       true,
+	"net.Resolver.LookupCNAME":      true,
+	"net.Resolver.LookupHost":       true,
+	"net.Resolver.LookupIP":         true,
+	"net.Resolver.LookupIPAddr":     true,
+	"net.Resolver.LookupMX":         true,
+	"net.Resolver.LookupNS":         true,
+	"net.Resolver.LookupNetIP":      true,
+	"net.Resolver.LookupPort":       true,
+	"net.Resolver.LookupSRV":        true,
+	"net.Resolver.LookupTXT":        true,
+
+	"net/http.Get":                      true,
+	"net/http.Head":                     true,
+	"net/http.Post":                     true,
+	"net/http.PostForm":                 true,
+	"net/http.ListenAndServe":           true,
+	"net/http.ListenAndServeTLS":        true,
+	"net/http.Serve":                    true,
+	"net/http.ServeTLS":                 true,
+	"net/http.Client.Do":                true,
+	"net/http.Client.Get":               true,
+	"net/http.Client.Head":              true,
+	"net/http.Client.Post":              true,
+	"net/http.Client.PostForm":          true,
+	"net/http.Server.ListenAndServe":    true,
+	"net/http.Server.ListenAndServeTLS": true,
+	"net/http.Server.Serve":             true,
+	"net/http.Server.ServeTLS":          true,
+	"net/http.Transport.RoundTrip":      true,
+
+	"crypto/tls.Dial":               true,
+	"crypto/tls.DialWithDialer":     true,
+	"crypto/tls.Listen":             true,
+	"crypto/tls.Dialer.Dial":        true,
+	"crypto/tls.Dialer.DialContext": true,
+	"net/smtp.Dial":                 true,
+	"net/smtp.SendMail":             true,
+	"net/rpc.Dial":                  true,
+	"net/rpc.DialHTTP":              true,
+	"net/rpc.DialHTTPPath":          true,
+}
+
+// funcKey returns the key of fn in networkFuncs: the import path
+// of its package, a dot, and its name, which for methods is the
+// name of the receiver's type, a dot, and the method's name.
+func funcKey(fn *types.Func) string {
+	if fn.Pkg() == nil {
+		return ""
+	}
+	name := fn.Name()
+	if recv := fn.Type().(*types.Signature).Recv(); recv != nil {
+		t := recv.Type()
+		if ptr, ok := t.(*types.Pointer); ok {
+			t = ptr.Elem()
+		}
+		named, ok := t.(*types.Named)
+		if !ok {
+			return "" // an interface method
+		}
+		name = named.Obj().Name() + "." + name
+	}
+	return fn.Pkg().Path() + "." + name
+}
+
+// SetupPanicAnalyzer reports panics in the setup functions of
+// plugins: the Actions of caddy.Plugin values, and functions
+// whose names begin with "setup". Calls of log.Fatal and
+// log.Panic and their variants count as panics.
+var SetupPanicAnalyzer = &analysis.Analyzer{
+	Name:     "setuppanic",
+	Doc:      "report panics in the setup functions of plugins",
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run:      runSetupPanic,
+}
+
+func runSetupPanic(pass *analysis.Pass) (interface{}, error) {
+	ins := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+
+	// find the setup functions: those named like
+	// it, and the actions of plugins, which may be
+	// function literals
+	setupFuncs := make(map[types.Object]bool)
+	var setupLits []*ast.FuncLit
+	for _, file := range pass.Files {
+		for _, decl := range file.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && strings.HasPrefix(strings.ToLower(fd.Name.Name), "setup") {
+				setupFuncs[pass.TypesInfo.Defs[fd.Name]] = true
+			}
+		}
+	}
+	ins.Preorder([]ast.Node{(*ast.CompositeLit)(nil)}, func(n ast.Node) {
+		lit := n.(*ast.CompositeLit)
+		if !isCaddyPlugin(pass.TypesInfo.TypeOf(lit)) {
+			return
+		}
+		for _, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			if key, ok := kv.Key.(*ast.Ident); !ok || key.Name != "Action" {
+				continue
+			}
+			switch action := ast.Unparen(kv.Value).(type) {
+			case *ast.FuncLit:
+				setupLits = append(setupLits, action)
+			case *ast.Ident:
+				setupFuncs[pass.TypesInfo.Uses[action]] = true
+			case *ast.SelectorExpr:
+				setupFuncs[pass.TypesInfo.Uses[action.Sel]] = true
+			}
+		}
+	})
+
+	check := func(name string, body *ast.BlockStmt) {
+		ast.Inspect(body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false // not necessarily run during setup
+			case *ast.CallExpr:
+				switch callee := typeutil.Callee(pass.TypesInfo, n).(type) {
+				case *types.Builtin:
+					if callee.Name() == "panic" {
+						pass.Reportf(n.Pos(), "setup function %s panics", name)
+					}
+				case *types.Func:
+					if callee.Pkg() != nil && callee.Pkg().Path() == "log" &&
+						(strings.HasPrefix(callee.Name(), "Fatal") || strings.HasPrefix(callee.Name(), "Panic")) {
+						pass.Reportf(n.Pos(), "setup function %s calls log.%s", name, callee.Name())
+					}
+				}
+			}
+			return true
+		})
+	}
+	for _, file := range pass.Files {
+		for _, decl := range file.Decls {
+			if fd, ok := decl.(*ast.FuncDecl); ok && fd.Body != nil && setupFuncs[pass.TypesInfo.Defs[fd.Name]] {
+				check(fd.Name.Name, fd.Body)
+			}
+		}
+	}
+	for _, lit := range setupLits {
+		check("(plugin action)", lit.Body)
+	}
+	return nil, nil
+}
+
+// isCaddyPlugin returns whether t is the
+// Plugin type of the caddy package.
+func isCaddyPlugin(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil || named.Obj().Name() != "Plugin" {
+		return false
+	}
+	return named.Obj().Pkg().Path() == CaddyPackage
+}
+
+// DefaultClientAnalyzer reports uses of http.DefaultClient,
+// which has no timeout, including through the functions of
+// the net/http package that use it.
+var DefaultClientAnalyzer = &analysis.Analyzer{
+	Name:     "defaultclient",
+	Doc:      "report uses of http.DefaultClient",
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		ins := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+		ins.Preorder([]ast.Node{(*ast.Ident)(nil)}, func(n ast.Node) {
+			id := n.(*ast.Ident)
+			obj := pass.TypesInfo.Uses[id]
+			if obj == nil || obj.Pkg() == nil || obj.Pkg().Path() != "net/http" || obj.Parent() != obj.Pkg().Scope() {
+				return
+			}
+			switch obj.Name() {
+			case "DefaultClient":
+				pass.Reportf(id.Pos(), "use of http.DefaultClient, which has no timeout")
+			case "Get", "Head", "Post", "PostForm":
+				if _, ok := obj.(*types.Func); ok {
+					pass.Reportf(id.Pos(), "http.%s uses http.DefaultClient, which has no timeout", obj.Name())
+				}
+			}
+		})
+		return nil, nil
+	},
+}
@@ -0,0 +1,98 @@
+package buildworker
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mholt/archiver"
+)
+
+// makeArchive makes an archive of files at dest in the
+// given format. Folders are added with their contents.
+func makeArchive(format, dest string, files []string) error {
+	switch format {
+	case "zip":
+		return archiver.Zip.Make(dest, files)
+	case "tar":
+		return archiver.Tar.Make(dest, files)
+	case "tar.gz":
+		return archiver.TarGz.Make(dest, files)
+	case "tar.xz":
+		return archiver.TarXZ.Make(dest, files)
+	case "tar.zst":
+		return makeTarZst(dest, files)
+	}
+	return fmt.Errorf("unknown archive format: %s", format)
+}
+
+// makeTarZst makes a zstd-compressed tarball
+// of files at dest, like the archiver package
+// does for other compression formats.
+func makeTarZst(dest string, files []string) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw, err := zstd.NewWriter(out)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	for _, file := range files {
+		err := addToTar(tw, file)
+		if err != nil {
+			return fmt.Errorf("adding %s: %v", file, err)
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// addToTar adds the file or folder at src to tw, under
+// its base name; folders are added with their contents.
+func addToTar(tw *tar.Writer, src string) error {
+	base := filepath.Dir(src)
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil // no symlinks or devices in archives
+		}
+		name, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
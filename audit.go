@@ -0,0 +1,221 @@
+package buildworker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Audit, if set, is where changes to master GOPATHs
+// (deploys, updates, backups, restores, and rollbacks)
+// are recorded.
+var Audit *AuditLog
+
+// AuditEntry is a record of one change to a master GOPATH.
+type AuditEntry struct {
+	Time            time.Time         `json:"time"`
+	Action          string            `json:"action"` // deploy, update, backup, restore, or rollback
+	Gopath          string            `json:"gopath"`
+	JobID           string            `json:"job_id,omitempty"`
+	ClientID        string            `json:"client_id,omitempty"`
+	Package         string            `json:"package,omitempty"`   // package being deployed or updated
+	Requested       map[string]string `json:"requested,omitempty"` // package to requested version
+	Resolved        map[string]string `json:"resolved,omitempty"`  // package to commit SHA
+	Outcome         string            `json:"outcome"`
+	Error           string            `json:"error,omitempty"`
+	Detail          string            `json:"detail,omitempty"`
+	DurationSeconds float64           `json:"duration_seconds"`
+}
+
+// AuditQuery filters audit entries. Zero
+// values match all entries.
+type AuditQuery struct {
+	Package string // matches the deployed package or any requested package
+	Since   time.Time
+	Until   time.Time
+}
+
+func (q AuditQuery) matches(e AuditEntry) bool {
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	if q.Package != "" && e.Package != q.Package {
+		if _, ok := e.Requested[q.Package]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// AuditLog is an append-only log of audit entries, stored as
+// JSON lines. When the file grows past its maximum size, it is rotated:
+// renamed with a timestamp suffix and never modified again.
+type AuditLog struct {
+	path    string
+	maxSize int64
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+}
+
+// OpenAuditLog opens (or creates) the audit log at path, to
+// be rotated once it grows larger than maxSize bytes. If
+// maxSize is 0, it is never rotated.
+func OpenAuditLog(path string, maxSize int64) (*AuditLog, error) {
+	al := &AuditLog{path: path, maxSize: maxSize}
+	err := al.openFile()
+	if err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AuditLog) openFile() error {
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	al.file = f
+	al.size = info.Size()
+	return nil
+}
+
+// Record appends e to the log. If e.Time is
+// not set, the current time is used.
+func (al *AuditLog) Record(e AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.maxSize > 0 && al.size > 0 && al.size+int64(len(line)) > al.maxSize {
+		err := al.rotate()
+		if err != nil {
+			return fmt.Errorf("rotating audit log: %v", err)
+		}
+	}
+
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return al.file.Sync()
+}
+
+// rotate renames the current file and starts a new one.
+// al.mu must be locked.
+func (al *AuditLog) rotate() error {
+	err := al.file.Close()
+	if err != nil {
+		return err
+	}
+	rotated := al.path + "." + time.Now().UTC().Format(auditTimeFormat)
+	err = os.Rename(al.path, rotated)
+	if err != nil {
+		return err
+	}
+	return al.openFile()
+}
+
+// Query returns the entries in the log, including rotated
+// files, that match q, oldest first.
+func (al *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	// the timestamp suffixes sort chronologically
+	files, err := filepath.Glob(al.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	files = append(files, al.path)
+
+	var entries []AuditEntry
+	for _, file := range files {
+		err := readAuditFile(file, func(e AuditEntry) {
+			if q.matches(e) {
+				entries = append(entries, e)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// readAuditFile calls fn for each entry in file.
+func readAuditFile(file string, fn func(AuditEntry)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		fn(e)
+	}
+	return scanner.Err()
+}
+
+// Close closes the audit log.
+func (al *AuditLog) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.file.Close()
+}
+
+// audit records an entry about be in the audit log, if
+// there is one; start is when the action began. Errors
+// are written to the build log since an audit failure
+// should not fail the action itself.
+func (be BuildEnv) audit(e AuditEntry, start time.Time, err error) {
+	if Audit == nil {
+		return
+	}
+	e.Gopath = be.masterGopath
+	e.JobID = be.jobID
+	e.ClientID = be.clientID
+	e.DurationSeconds = time.Since(start).Seconds()
+	if err != nil {
+		e.Error = err.Error()
+		if e.Outcome == "" {
+			e.Outcome = "failure"
+		}
+	} else if e.Outcome == "" {
+		e.Outcome = "success"
+	}
+	if auditErr := Audit.Record(e); auditErr != nil {
+		be.log.Error("writing audit log", "error", auditErr)
+	}
+}
+
+const auditTimeFormat = "20060102T150405.000000000"
@@ -8,17 +8,16 @@ import (
 	"go/printer"
 	"go/token"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/mholt/archiver"
-
 	"golang.org/x/tools/go/ast/astutil"
 )
 
@@ -33,27 +32,96 @@ type BuildEnv struct {
 	masterGopath string
 	tmpGopath    string
 	pkgs         map[string]string // map of package to version
-	log          *log.Logger
-	Log          *bytes.Buffer
+	target       Target
+	goroot       string // of the selected toolchain; empty for the one on the PATH
+	format       string // of archives; empty for the one in the platform matrix
+	image        bool   // whether linux builds also make a container image
+	jobID        string
+	clientID     string
+	log          *slog.Logger
+	cmdOutput    *lineLogger
+	Log          *bytes.Buffer // JSON lines
+	Report       *CheckReport
+}
+
+// Options configures a build environment.
+type Options struct {
+	// JobID identifies the job the build environment
+	// is for; it is included in every log entry.
+	JobID string
+
+	// ClientID identifies who requested the job;
+	// it is included in every log entry.
+	ClientID string
+
+	// Target is the program to build or deploy. If
+	// its Package is empty, DefaultTarget is used.
+	Target Target
+
+	// GoVersion selects the Go toolchain to use from
+	// Toolchains. If empty, the go command on the PATH
+	// is used.
+	GoVersion string
+
+	// Format, if set, is the format (one of ArchiveFormats)
+	// that builds are made in, instead of the one that the
+	// platform matrix gives each platform.
+	Format string
+
+	// Image, if true, makes builds for linux also make an
+	// OCI container image of the binary, next to the archive
+	// (see ImagePath).
+	Image bool
 }
 
-// Open creates a new, provisioned build environment with caddy
-// and the specified plugins at their associated versions. It
-// uses the master GOPATH (from environment) to provision itself
+// Open creates a new, provisioned build environment with the
+// default target (Caddy, unless changed) and the specified
+// plugins at their associated versions. It uses the master
+// GOPATH (from environment) to provision itself
 // efficiently. If this function returns without error, you must
 // close the build environment when you are done.
 func Open(caddyVersion string, plugins []CaddyPlugin) (BuildEnv, error) {
+	return OpenWithOptions(caddyVersion, plugins, Options{})
+}
+
+// OpenWithOptions is like Open, but configures the
+// build environment according to opts.
+func OpenWithOptions(caddyVersion string, plugins []CaddyPlugin, opts Options) (BuildEnv, error) {
+	target := opts.Target
+	if target.Package == "" {
+		target = DefaultTarget
+	}
+	err := target.Validate()
+	if err != nil {
+		return BuildEnv{}, err
+	}
+	goroot, err := LookupToolchain(opts.GoVersion)
+	if err != nil {
+		return BuildEnv{}, err
+	}
+	if opts.Format != "" && !containsString(ArchiveFormats, opts.Format) {
+		return BuildEnv{}, fmt.Errorf("unknown archive format: %s", opts.Format)
+	}
 	tmpGopath, err := newTemporaryGopath()
 	if err != nil {
 		return BuildEnv{}, err
 	}
 	logBuf := new(bytes.Buffer)
+	logger := newLogger(logBuf, opts.JobID, opts.ClientID)
 	be := BuildEnv{
-		masterGopath: os.Getenv("GOPATH"),
+		masterGopath: MasterGopathDir(),
 		tmpGopath:    tmpGopath,
 		pkgs:         make(map[string]string),
+		target:       target,
+		goroot:       goroot,
+		format:       opts.Format,
+		image:        opts.Image,
+		jobID:        opts.JobID,
+		clientID:     opts.ClientID,
 		Log:          logBuf,
-		log:          log.New(logBuf, "", log.Ldate|log.Ltime),
+		log:          logger,
+		cmdOutput:    &lineLogger{logger: logger.With("stream", "output")},
+		Report:       new(CheckReport),
 	}
 	for _, plugin := range plugins {
 		be.pkgs[plugin.Package] = plugin.Version
@@ -61,12 +129,17 @@ func Open(caddyVersion string, plugins []CaddyPlugin) (BuildEnv, error) {
 	if caddyVersion == "" {
 		caddyVersion = "master"
 	}
-	be.pkgs[CaddyPackage] = caddyVersion
+	be.pkgs[target.Package] = caddyVersion
+	start := time.Now()
 	err = be.provision()
 	if err != nil {
 		os.RemoveAll(tmpGopath)
+		be.log.Error("provisioning failed", "phase", "provision", "error", err)
 		return be, fmt.Errorf("provisioning build environment: %v", err)
 	}
+	be.phaseDone("provision", start)
+	trackTempGopath(tmpGopath)
+	jobsActive.Inc()
 	return be, nil
 }
 
@@ -202,8 +275,8 @@ func (be BuildEnv) fillMasterGopath() error {
 	lock(be.masterGopath)
 	defer unlock(be.masterGopath)
 	for pkg := range be.pkgs {
-		if pkg == CaddyPackage {
-			// the caddy package is a special case because of its
+		if pkg == be.target.Package {
+			// the core package is a special case because of its
 			// plugin architecture and the fact that it's the package
 			// we're building into a command; so we also want to
 			// go get its main package and all its dependencies.
@@ -221,9 +294,37 @@ func (be BuildEnv) fillMasterGopath() error {
 
 // Close deletes the temporary GOPATH from disk.
 func (be BuildEnv) Close() error {
+	untrackTempGopath(be.tmpGopath)
+	jobsActive.Dec()
 	return os.RemoveAll(be.tmpGopath)
 }
 
+// ResolvedVersions returns the commit SHA that each
+// package in the build environment is checked out at.
+func (be BuildEnv) ResolvedVersions() (map[string]string, error) {
+	resolved := make(map[string]string)
+	for pkg := range be.pkgs {
+		sha, err := gitHead(be.TemporaryPath(pkg))
+		if err != nil {
+			return resolved, fmt.Errorf("resolving version of %s: %v", pkg, err)
+		}
+		resolved[pkg] = sha
+	}
+	return resolved, nil
+}
+
+// gitHead returns the commit SHA of HEAD in the
+// repository at dir.
+func gitHead(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 // TemporaryPath returns the path to pkg's source
 // folder in the temporary GOPATH.
 func (be BuildEnv) TemporaryPath(pkg string) string {
@@ -265,7 +366,7 @@ func (be BuildEnv) RepoPath(pkg string) string {
 // responsibility to remove the gopath when finished.
 func newTemporaryGopath() (string, error) {
 	ts := time.Now().Format(MonthDayHourMin)
-	return ioutil.TempDir("", fmt.Sprintf("gopath_%s.", ts))
+	return ioutil.TempDir(TempDir, fmt.Sprintf("gopath_%s.", ts))
 }
 
 // setEnvGopath sets the GOPATH variable in env
@@ -283,29 +384,74 @@ func setEnvGopath(env []string, to string) {
 // build environment. It sets a custom environment, including
 // a GOPATH variable that uses *both* the master and temporary
 // GOPATHs. If this command should only use one GOPATH, be sure
-// to call setEnvGopath() to change it.
+// to call setEnvGopath() to change it. The go command is the
+// one of the build environment's toolchain.
 func (be BuildEnv) newCommand(command string, args ...string) *exec.Cmd {
-	cmd := exec.Command(command, args...)
-	cmd.Env = []string{
-		"GOPATH=" + be.tmpGopath + ":" + be.masterGopath,
-		"PATH=" + os.Getenv("PATH"),
-		"TMPDIR=" + os.Getenv("TMPDIR"),
+	if command == "go" && be.goroot != "" {
+		command = goBinary(be.goroot)
 	}
-	cmd.Stdout = be.Log
-	cmd.Stderr = be.Log
+	cmd := exec.Command(command, args...)
+	cmd.Env = append([]string{"GOPATH=" + be.tmpGopath + ":" + be.masterGopath},
+		toolchainEnv(be.goroot)...)
+	cmd.Env = append(cmd.Env, "TMPDIR="+os.Getenv("TMPDIR"))
+	cmd.Stdout = be.cmdOutput
+	cmd.Stderr = be.cmdOutput
 	return cmd
 }
 
+// commandWaitDelay is how long runCommand waits, after a
+// command exits, for its output pipes to be closed.
+const commandWaitDelay = 5 * time.Second
+
 // runCommand runs cmd while logging the command being run.
 func (be BuildEnv) runCommand(cmd *exec.Cmd) error {
-	be.log.Printf("exec [%s] %s %s\n", cmd.Dir, cmd.Path, strings.Join(cmd.Args[1:], " "))
-	return cmd.Run()
+	command := cmd.Path + " " + strings.Join(cmd.Args[1:], " ")
+	be.log.Info("exec", "dir", cmd.Dir, "command", command)
+	start := time.Now()
+	if CommandTimeout > 0 {
+		// processes that the command starts, like the compiler,
+		// are killed with it; and if any escape the process
+		// group with the output pipes open, Wait gives up on
+		// copying their output rather than blocking forever
+		newProcessGroup(cmd)
+		cmd.WaitDelay = commandWaitDelay
+	}
+	err := cmd.Start()
+	if err == nil {
+		var timedOut int32
+		if CommandTimeout > 0 {
+			timer := time.AfterFunc(CommandTimeout, func() {
+				atomic.StoreInt32(&timedOut, 1)
+				killProcessGroup(cmd)
+			})
+			defer timer.Stop()
+		}
+		err = cmd.Wait()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			err = fmt.Errorf("timed out after %v", CommandTimeout)
+		}
+	}
+	be.cmdOutput.flush()
+	if err != nil {
+		be.log.Error("exec failed", "command", command, "duration", time.Since(start), "error", err)
+		return err
+	}
+	be.log.Debug("exec done", "command", command, "duration", time.Since(start))
+	return nil
+}
+
+// phaseDone logs and records the duration of
+// phase, which began at start.
+func (be BuildEnv) phaseDone(phase string, start time.Time) {
+	observePhase(phase, start)
+	be.log.Info("phase done", "phase", phase, "duration", time.Since(start))
 }
 
 // Deploy deploys the package that the BuildEnv was
 // initialized with. The BuildEnv must have been created
-// with either zero plugins or one plugin. If zero, caddy
-// will be deployed. If one, the plugin will be deployed.
+// with either zero plugins or one plugin. If zero, the
+// target (caddy) will be deployed. If one, the plugin
+// will be deployed.
 //
 // To "deploy" means that the master GOPATH is updated
 // with `go get -u` on the package being deployed.
@@ -313,15 +459,36 @@ func (be BuildEnv) runCommand(cmd *exec.Cmd) error {
 // including cross-platform builds for requiredPlatforms.
 // An error is returned if anything failed, in which case
 // you should consider the deployment/release a failure.
-func (be BuildEnv) Deploy(requiredPlatforms []Platform) error {
+func (be BuildEnv) Deploy(requiredPlatforms []Platform) (err error) {
+	kind := "plugin"
+	if be.packageToDeploy() == be.target.Package {
+		kind = be.target.Name
+	}
+	outcome := "failure"
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			outcome = "success"
+		}
+		deploysTotal.WithLabelValues(kind, outcome).Inc()
+		resolved, _ := be.ResolvedVersions()
+		be.audit(AuditEntry{
+			Action:    "deploy",
+			Package:   be.packageToDeploy(),
+			Requested: be.pkgs,
+			Resolved:  resolved,
+			Outcome:   outcome,
+		}, start, err)
+	}()
+
 	// we only allow deploying caddy itself or
 	// a single plugin at a time.
 	switch len(be.pkgs) {
 	case 0:
 		return fmt.Errorf("nothing to deploy")
 	case 1, 2:
-		if _, ok := be.pkgs[CaddyPackage]; !ok {
-			return fmt.Errorf("no caddy package")
+		if _, ok := be.pkgs[be.target.Package]; !ok {
+			return fmt.Errorf("no %s package", be.target.Name)
 		}
 	default:
 		return fmt.Errorf("too many packages to deploy")
@@ -354,12 +521,22 @@ func (be BuildEnv) Deploy(requiredPlatforms []Platform) error {
 		// tends to catch most of its bugs. the test failures
 		// might be caused because of `go get -u`, so our only
 		// hope is to restore the GOPATH to before the update.
+		rollbackStart := time.Now()
 		err2 := be.restoreMasterGopath(backupGopath)
+		rollback := AuditEntry{
+			Action:  "rollback",
+			Package: be.packageToDeploy(),
+			Detail:  "checks failed after update: " + err.Error(),
+		}
+		be.audit(rollback, rollbackStart, err2)
 		if err2 != nil {
 			// well, this is terrible. we now have multiple
 			// GOPATHs that don't work. just gonna cry.
+			outcome = "revert_failed"
 			return fmt.Errorf("%v; additionally, error restoring GOPATH: %v", err, err2)
 		}
+		outcome = "reverted"
+		be.Report.Reverted = true
 	}
 
 	return err
@@ -369,10 +546,12 @@ func (be BuildEnv) Deploy(requiredPlatforms []Platform) error {
 // environment to a temporary location and returns that location.
 // It is the caller's responsibility to delete it when no
 // longer needed. If an error is returned, no need to clean up.
-func (be BuildEnv) backupMasterGopath() (string, error) {
+func (be BuildEnv) backupMasterGopath() (tmpdir string, err error) {
 	rlock(be.masterGopath)
 	defer runlock(be.masterGopath)
-	tmpdir, err := ioutil.TempDir("", "gopath_backup_")
+	start := time.Now()
+	defer func() { be.audit(AuditEntry{Action: "backup", Detail: tmpdir}, start, err) }()
+	tmpdir, err = ioutil.TempDir(TempDir, "gopath_backup_")
 	if err != nil {
 		return tmpdir, err
 	}
@@ -389,16 +568,21 @@ func (be BuildEnv) backupMasterGopath() (string, error) {
 // of the backup but does not change the path of the master
 // GOPATH. An error returned from this function is awful, sorry.
 // This function does NOT clean up the tmpdir that is passed in.
-func (be BuildEnv) restoreMasterGopath(tmpdir string) error {
+func (be BuildEnv) restoreMasterGopath(tmpdir string) (err error) {
 	lock(be.masterGopath)
 	defer unlock(be.masterGopath)
+	start := time.Now()
+	defer func() {
+		setRestoreError(be.masterGopath, err)
+		be.audit(AuditEntry{Action: "restore", Detail: tmpdir}, start, err)
+	}()
 
 	// rename the master GOPATH so we have a clean
 	// destination to copy into; safer than deleting
 	// our master copy before the restore is successful
 	suffix := fmt.Sprintf("%d", rand.Intn(9000)+1000)
 	tmpPath := be.masterGopath + "_tmp_" + suffix
-	err := os.Rename(be.masterGopath, tmpPath)
+	err = os.Rename(be.masterGopath, tmpPath)
 	if err != nil {
 		return err
 	}
@@ -426,10 +610,10 @@ func (be BuildEnv) restoreMasterGopath(tmpdir string) error {
 func (be BuildEnv) packageToDeploy() string {
 	var pkg string
 	if len(be.pkgs) == 1 {
-		pkg = CaddyPackage
+		pkg = be.target.Package
 	} else if len(be.pkgs) == 2 {
 		for key := range be.pkgs {
-			if key != CaddyPackage {
+			if key != be.target.Package {
 				pkg = key
 				break
 			}
@@ -461,16 +645,27 @@ func (be BuildEnv) packageToDeploy() string {
 // to the temporary GOPATH in provisioning this
 // build environment and checked out to a certain
 // version will not be affected.
-func (be BuildEnv) UpdateMasterGopath() error {
-	pkg := be.packageToDeploy()
-	if pkg == CaddyPackage {
+func (be BuildEnv) UpdateMasterGopath() (err error) {
+	deployPkg := be.packageToDeploy()
+	pkg := deployPkg
+	if pkg == be.target.Package {
 		pkg += "/..." // see fillMasterGopath() for why we do this
 	}
 	cmd := be.newCommand("go", "get", "-u", "-d", "-t", "-x", pkg)
 	setEnvGopath(cmd.Env, be.masterGopath) // operate on master GOPATH only
 	lock(be.masterGopath)
 	defer unlock(be.masterGopath)
-	be.log.Printf("Updating master GOPATH: %s", be.masterGopath)
+
+	start := time.Now()
+	defer func() {
+		entry := AuditEntry{Action: "update", Package: deployPkg}
+		if sha, shaErr := gitHead(be.RepoPath(deployPkg)); shaErr == nil {
+			entry.Resolved = map[string]string{deployPkg: sha}
+		}
+		be.audit(entry, start, err)
+	}()
+
+	be.log.Info("updating master GOPATH", "phase", "deploy", "package", pkg, "gopath", be.masterGopath)
 	return be.runCommand(cmd)
 }
 
@@ -488,36 +683,66 @@ func (be BuildEnv) RunPluginChecks(requiredPlatforms []Platform) (bool, error) {
 	defer runlock(be.masterGopath)
 
 	for pkg := range be.pkgs {
-		if pkg == CaddyPackage {
+		if pkg == be.target.Package {
 			continue
 		}
 
 		// go vet the plugin
-		err := be.goVet(pkg)
+		err := be.check("vet", pkg, "", func() error { return be.goVet(pkg) })
 		if err != nil {
 			return false, fmt.Errorf("go vet plugin %s: %v", pkg, err)
 		}
 
+		// analyze the plugin beyond what go vet does
+		err = be.check("analysis", pkg, "", func() error { return be.analyze(pkg) })
+		if err != nil {
+			return false, fmt.Errorf("analysis of plugin %s: %v", pkg, err)
+		}
+
 		// go test the plugin
-		err = be.goTest(pkg)
+		err = be.check("test", pkg, "", func() error { return be.goTest(pkg) })
 		if err != nil {
 			return false, fmt.Errorf("go test plugin %s: %v", pkg, err)
 		}
 
+		// check the licenses of the plugin and its dependencies
+		err = be.check("license", pkg, "", func() error { return be.checkLicenses(pkg) })
+		if err != nil {
+			return false, fmt.Errorf("licenses of plugin %s: %v", pkg, err)
+		}
+
+		// check the plugin and its dependencies for known
+		// vulnerabilities, on the platforms it must build for
+		if AdvisoryDB != "" {
+			err = be.check("vuln", pkg, "", func() error { return be.checkVulnerabilities(pkg, requiredPlatforms) })
+			if err != nil {
+				return false, fmt.Errorf("vulnerabilities of plugin %s: %v", pkg, err)
+			}
+		}
+
 		// plug in the plugin
 		// TODO: This does not unplug any previously-plugged-in
 		// plugins, but that's okay since we only deploy one
 		// plugin at a time, right?
-		be.log.Printf("plugging in %s", pkg)
-		err = be.plugInThePlugin(pkg)
+		be.log.Info("plugging in", "phase", "check", "package", pkg)
+		err = be.check("plugin", pkg, "", func() error { return be.plugInThePlugin(pkg) })
 		if err != nil {
 			return false, fmt.Errorf("plugging in %s: %v", pkg, err)
 		}
 
-		// go test Caddy with the plugin installed
-		err = be.goTest(CaddyPackage)
+		// make sure the plugin registers itself, so that
+		// plugging it in actually does something
+		if be.target.Package == CaddyPackage {
+			err = be.check("registration", pkg, "", func() error { return be.checkRegistration(pkg) })
+			if err != nil {
+				return false, fmt.Errorf("registration of plugin %s: %v", pkg, err)
+			}
+		}
+
+		// go test the core package with the plugin installed
+		err = be.check("test", be.target.Package, "", func() error { return be.goTest(be.target.Package) })
 		if err != nil {
-			return true, fmt.Errorf("go test caddy with plugin: %v", err)
+			return true, fmt.Errorf("go test %s with plugin: %v", be.target.Name, err)
 		}
 
 		// go build on various platforms
@@ -530,26 +755,36 @@ func (be BuildEnv) RunPluginChecks(requiredPlatforms []Platform) (bool, error) {
 	return false, nil
 }
 
-// RunCaddyChecks performs tests and checks on
-// the caddy package in the build environment.
+// RunCaddyChecks performs tests and checks on the
+// core package of the target (caddy) in the build
+// environment.
 func (be BuildEnv) RunCaddyChecks() error {
-	err := be.goVet(CaddyPackage)
+	err := be.check("vet", be.target.Package, "", func() error { return be.goVet(be.target.Package) })
 	if err != nil {
 		return fmt.Errorf("go vet: %v", err)
 	}
 
 	// go test
-	err = be.goTest(CaddyPackage)
+	err = be.check("test", be.target.Package, "", func() error { return be.goTest(be.target.Package) })
 	if err != nil {
 		return fmt.Errorf("go test: %v", err)
 	}
 
-	// go build on all supported platforms
-	platforms, err := SupportedPlatforms(UnsupportedPlatforms)
+	platforms, err := supportedPlatforms(UnsupportedPlatforms, be.goroot)
 	if err != nil {
 		return err
 	}
-	err = be.goBuildChecks(CaddyPackage, platforms)
+
+	// check for known vulnerabilities on all supported platforms
+	if AdvisoryDB != "" {
+		err = be.check("vuln", be.target.Package, "", func() error { return be.checkVulnerabilities(be.target.Package, platforms) })
+		if err != nil {
+			return fmt.Errorf("vulnerabilities: %v", err)
+		}
+	}
+
+	// go build on all supported platforms
+	err = be.goBuildChecks(be.target.Package, platforms)
 	if err != nil {
 		return fmt.Errorf("go build: %v", err)
 	}
@@ -563,83 +798,185 @@ func (be BuildEnv) RunCaddyChecks() error {
 // to clean up the file when finished with it. Builds are
 // performed by plugging in all the plugins configured for
 // this build environment and bundling all distribution
-// assets into an archive with the binary.
+// assets, a software bill of materials (see SBOM), and the
+// notices of the licenses of third-party code into an archive
+// with the binary. The SBOM is also put next to the
+// archive, at SBOMPath.
 func (be BuildEnv) Build(plat Platform, outputFolder string) (*os.File, error) {
 	if plat.OS == "" || plat.Arch == "" {
 		return nil, fmt.Errorf("missing required information: OS or arch")
 	}
+	err := be.plugIn()
+	if err != nil {
+		return nil, err
+	}
+	archivePath, err := be.buildArchive(plat, outputFolder)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(archivePath)
+}
 
-	// plug in the plugins
+// plugIn plugs all the plugins of the build
+// environment into the core package.
+func (be BuildEnv) plugIn() error {
+	start := time.Now()
 	for pkg := range be.pkgs {
-		if pkg == CaddyPackage {
-			continue // caddy core is not a plugin
+		if pkg == be.target.Package {
+			continue // the core package is not a plugin
 		}
+		be.log.Info("plugging in", "phase", "plugin", "package", pkg)
 		err := be.plugInThePlugin(pkg)
 		if err != nil {
-			return nil, fmt.Errorf("plugging in %s: %v", pkg, err)
+			return fmt.Errorf("plugging in %s: %v", pkg, err)
 		}
 	}
+	be.phaseDone("plugin", start)
+	return nil
+}
 
-	caddyVer, ok := be.pkgs[CaddyPackage]
+// buildArchive compiles the target, which must already have
+// its plugins plugged in, for plat and archives it with its
+// distribution assets and its SBOM in outputFolder, where it
+// also puts the SBOM at SBOMPath. If SmokeTest is enabled, the
+// binary is smoke tested before it is archived. It returns the
+// path to the archive. It is safe to call concurrently for
+// different platforms.
+func (be BuildEnv) buildArchive(plat Platform, outputFolder string) (archivePath string, err error) {
+	start := time.Now()
+	defer func() {
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+		}
+		arch := plat.Arch + plat.ARM
+		buildsTotal.WithLabelValues(plat.OS, arch, outcome).Inc()
+		buildDuration.WithLabelValues(plat.OS, arch, outcome).Observe(time.Since(start).Seconds())
+		be.log.Info("build finished", "platform", plat.String(), "outcome", outcome, "duration", time.Since(start))
+	}()
+
+	version, ok := be.pkgs[be.target.Package]
 	if !ok { // shouldn't happen, but whatever
-		caddyVer = "master"
-	}
-	if !strings.HasPrefix(caddyVer, "v") && len(caddyVer) > 8 {
-		caddyVer = caddyVer[:8]
+		version = "master"
 	}
-	outputName := "caddy_" + caddyVer + "_" + plat.OS + "_" + plat.Arch
-	if plat.Arch == "arm" {
-		outputName += plat.ARM
+	if !strings.HasPrefix(version, "v") && len(version) > 8 {
+		version = version[:8]
 	}
-	if len(be.pkgs) > 1 { // one will be caddy itself
-		outputName += "_custom"
+	outputName, err := be.target.archiveName(ArchiveNameData{
+		Name:    be.target.Name,
+		Version: version,
+		OS:      plat.OS,
+		Arch:    plat.Arch,
+		ARM:     plat.ARM,
+		Custom:  len(be.pkgs) > 1, // one will be the core package itself
+	})
+	if err != nil {
+		return "", err
 	}
 
-	binaryOutputName := "caddy"
-	if plat.OS == "windows" {
-		binaryOutputName += ".exe"
+	// each platform gets its own folder for the binary,
+	// since binaries of several platforms may have the
+	// same name and be built at the same time
+	binDir, err := ioutil.TempDir(outputFolder, "bin_")
+	if err != nil {
+		return "", err
 	}
-	binaryOutputPath := filepath.Join(outputFolder, binaryOutputName)
+	defer os.RemoveAll(binDir)
 
-	err := be.buildCaddy(plat, binaryOutputPath)
+	settings := Matrix.Settings(plat)
+	binaryOutputPath := filepath.Join(binDir, be.target.Name+settings.BinarySuffix)
+
+	compileStart := time.Now()
+	err = be.buildBinary(plat, binaryOutputPath)
 	if err != nil {
-		return nil, fmt.Errorf("building caddy: %v", err)
+		return "", fmt.Errorf("building %s: %v", be.target.Name, err)
+	}
+	be.phaseDone("compile", compileStart)
+
+	// make sure the binary runs and has what was asked for
+	// before it is archived (and signed)
+	if SmokeTest {
+		err = be.check("smoke", be.target.Package, plat.String(), func() error {
+			return be.smokeTest(plat, binaryOutputPath)
+		})
+		if err != nil {
+			return "", fmt.Errorf("smoke testing %s: %v", be.target.Name, err)
+		}
 	}
-	defer os.Remove(binaryOutputPath)
 
-	// choose .tar.gz or .zip format depending on OS
-	compressZip := plat.OS == "windows" || plat.OS == "darwin"
+	// the SBOM and the notices of the licenses of third-party
+	// code are shipped in the archive, with the dist files;
+	// the SBOM is also put next to the archive
+	deps, err := be.Dependencies(plat)
+	if err != nil {
+		return "", err
+	}
+	sbomPath := filepath.Join(binDir, be.target.Name+SBOMExt)
+	err = be.writeSBOM(outputName, deps, sbomPath)
+	if err != nil {
+		return "", fmt.Errorf("making SBOM: %v", err)
+	}
+	noticesPath := filepath.Join(binDir, NoticesFile)
+	err = ioutil.WriteFile(noticesPath, be.thirdPartyNotices(deps), 0644)
+	if err != nil {
+		return "", fmt.Errorf("writing notices: %v", err)
+	}
 
-	fileList := []string{
-		filepath.Join(be.TemporaryPath(CaddyPackage), "dist", "README.txt"),
-		filepath.Join(be.TemporaryPath(CaddyPackage), "dist", "LICENSES.txt"),
-		filepath.Join(be.TemporaryPath(CaddyPackage), "dist", "CHANGES.txt"),
-		filepath.Join(be.TemporaryPath(CaddyPackage), "dist", "init"),
-		binaryOutputPath,
+	var distFiles []string
+	for _, distFile := range be.target.DistFiles {
+		distFiles = append(distFiles, filepath.Join(be.TemporaryPath(be.target.Package), filepath.FromSlash(distFile)))
 	}
+	distFiles = append(distFiles, sbomPath, noticesPath)
 
-	finalOutputPath := filepath.Join(outputFolder, outputName)
+	format := settings.Archive
+	if be.format != "" {
+		format = be.format
+	}
 
-	if compressZip {
-		finalOutputPath += ".zip"
-		err = archiver.Zip.Make(finalOutputPath, fileList)
-	} else {
-		finalOutputPath += ".tar.gz"
-		err = archiver.TarGz.Make(finalOutputPath, fileList)
+	archiveStart := time.Now()
+	switch format {
+	case "binary":
+		archivePath = filepath.Join(outputFolder, outputName+settings.BinarySuffix)
+		err = os.Rename(binaryOutputPath, archivePath)
+	case "deb", "rpm":
+		archivePath = filepath.Join(outputFolder, outputName+"."+format)
+		var files []packageFile
+		files, err = be.packageFiles(distFiles, binaryOutputPath)
+		if err == nil {
+			err = be.makePackage(format, plat, version, archivePath, files)
+		}
+	default:
+		archivePath = filepath.Join(outputFolder, outputName+"."+format)
+		err = makeArchive(format, archivePath, append(distFiles, binaryOutputPath))
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error compressing: %v", err)
+		return "", fmt.Errorf("making %s: %v", format, err)
 	}
+	if be.image && plat.OS == "linux" {
+		binaryPath := binaryOutputPath
+		if format == "binary" {
+			binaryPath = archivePath // it was moved there
+		}
+		err = be.makeImage(plat, version, ImagePath(archivePath), distFiles, binaryPath)
+		if err != nil {
+			return "", fmt.Errorf("making container image: %v", err)
+		}
+	}
+	err = os.Rename(sbomPath, SBOMPath(archivePath))
+	if err != nil {
+		return "", err
+	}
+	be.phaseDone("archive", archiveStart)
 
-	return os.Open(finalOutputPath)
+	return archivePath, nil
 }
 
 // plugInThePlugin plugs in the plugin with import
-// path of pkg into the copy of caddy in the temporary
-// GOPATH.
+// path of pkg into the copy of the core package in
+// the temporary GOPATH.
 func (be BuildEnv) plugInThePlugin(pkg string) error {
 	fset := token.NewFileSet()
-	file := filepath.Join(be.TemporaryPath(CaddyPackage), "caddy/caddymain/run.go")
+	file := filepath.Join(be.TemporaryPath(be.target.Package), filepath.FromSlash(be.target.PluginFile))
 	f, err := parser.ParseFile(fset, file, nil, 0)
 	if err != nil {
 		return fmt.Errorf("parsing file: %v", err)
@@ -661,27 +998,9 @@ func (be BuildEnv) plugInThePlugin(pkg string) error {
 // goBuildChecks cross-compiles pkg for all requiredPlatforms.
 func (be BuildEnv) goBuildChecks(pkg string, requiredPlatforms []Platform) error {
 	for _, platform := range requiredPlatforms {
-		cgo := "CGO_ENABLED=0"
-		if platform.OS == "darwin" {
-			// TODO.
-			// As of Go 1.6, darwin might have some trouble if cgo is disabled.
-			// https://www.reddit.com/r/golang/comments/46bd5h/ama_we_are_the_go_contributors_ask_us_anything/d03rmc9
-			// As of Go 1.8beta3, this may not be necessary:
-			// https://twitter.com/bradfitz/status/811630858742341632
-			// https://github.com/golang/go/commit/3357daa96e2b04f83be70d29b70858ddc7c803f4
-			cgo = "CGO_ENABLED=1"
-		}
-		be.log.Printf("GOOS=%s GOARCH=%s GOARM=%s go build", platform.OS, platform.Arch, platform.ARM)
-		cmd := be.newCommand("go", "build", "-p", strconv.Itoa(ParallelBuildOps), pkg+"/...")
-		for _, env := range []string{
-			cgo,
-			"GOOS=" + platform.OS,
-			"GOARCH=" + platform.Arch,
-			"GOARM=" + platform.ARM,
-		} {
-			cmd.Env = append(cmd.Env, env)
-		}
-		err := be.runCommand(cmd)
+		be.log.Info("go build", "phase", "check", "package", pkg, "platform", platform.String())
+		cmd := be.newBuildCommand(platform, "-p", strconv.Itoa(ParallelBuildOps), pkg+"/...")
+		err := be.check("build", pkg, platform.String(), func() error { return be.runCommand(cmd) })
 		if err != nil {
 			return fmt.Errorf("build failed: GOOS=%s GOARCH=%s GOARM=%s: %v",
 				platform.OS, platform.Arch, platform.ARM, err)
@@ -691,38 +1010,48 @@ func (be BuildEnv) goBuildChecks(pkg string, requiredPlatforms []Platform) error
 	return nil
 }
 
-// buildCaddy builds caddy for the given platform and puts the
-// binary at outputFile. The outputFile path will be relative
-// to the folder where Caddy's main() function is defined (or it
-// can be an absolute path).
-func (be BuildEnv) buildCaddy(plat Platform, outputFile string) error {
-	ldflags, err := makeLdFlags(be.TemporaryPath(CaddyPackage))
-	if err != nil {
-		return err
-	}
-	cgo := "CGO_ENABLED=0"
-	if plat.OS == "darwin" {
-		// TODO.
-		// As of Go 1.6, darwin might have some trouble if cgo is disabled.
-		// https://www.reddit.com/r/golang/comments/46bd5h/ama_we_are_the_go_contributors_ask_us_anything/d03rmc9
-		// As of Go 1.8beta3, this may not be necessary:
-		// https://twitter.com/bradfitz/status/811630858742341632
-		// https://github.com/golang/go/commit/3357daa96e2b04f83be70d29b70858ddc7c803f4
-		cgo = "CGO_ENABLED=1"
-	}
-	cmd := be.newCommand("go", "build", "-ldflags", ldflags, "-o", outputFile)
-	cmd.Dir = filepath.Join(be.TemporaryPath(CaddyPackage), "caddy")
-	for _, env := range []string{
-		cgo,
-		"GOOS=" + plat.OS,
-		"GOARCH=" + plat.Arch,
-		"GOARM=" + plat.ARM,
-	} {
-		cmd.Env = append(cmd.Env, env)
+// buildBinary builds the target for the given platform and puts
+// the binary at outputFile. The outputFile path will be relative
+// to the folder where the target's main() function is defined (or
+// it can be an absolute path).
+func (be BuildEnv) buildBinary(plat Platform, outputFile string) error {
+	var args []string
+	if be.target.LdFlagsPackage != "" {
+		ldflags, err := makeLdFlags(be.TemporaryPath(be.target.Package), be.target.LdFlagsPackage)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-ldflags", ldflags)
 	}
+	cmd := be.newBuildCommand(plat, append(args, "-o", outputFile)...)
+	cmd.Dir = filepath.Join(be.TemporaryPath(be.target.Package), filepath.FromSlash(be.target.MainDir))
 	return be.runCommand(cmd)
 }
 
+// newBuildCommand prepares `go build` with args for plat,
+// with the environment and build tags of plat in Matrix.
+func (be BuildEnv) newBuildCommand(plat Platform, args ...string) *exec.Cmd {
+	return be.newGoCommand(plat, "build", args...)
+}
+
+// newGoCommand prepares the go command's subcommand (such
+// as build or list) with args for plat, with the environment
+// and build tags of plat in Matrix.
+func (be BuildEnv) newGoCommand(plat Platform, subcommand string, args ...string) *exec.Cmd {
+	settings := Matrix.Settings(plat)
+	if len(settings.Tags) > 0 {
+		args = append([]string{"-tags", strings.Join(settings.Tags, ",")}, args...)
+	}
+	cmd := be.newCommand("go", append([]string{subcommand}, args...)...)
+	cmd.Env = append(cmd.Env,
+		"GOOS="+plat.OS,
+		"GOARCH="+plat.Arch,
+		"GOARM="+plat.ARM,
+	)
+	cmd.Env = append(cmd.Env, settings.Env...)
+	return cmd
+}
+
 // Platform contains information about platforms. The values of
 // OS, Arch, and ARM should be the same values to set GOOS,
 // GOARCH, and GOARM to, respectively. The values of the json
@@ -740,7 +1069,8 @@ func (p Platform) String() string {
 
 // UnsupportedPlatforms is a list of platforms that we do not
 // build for at this time. NOTE: this initial list was only
-// attempted from 64-bit darwin (macOS).
+// attempted from 64-bit darwin (macOS). Prefer probing the
+// platforms with the installed toolchain; see ProbePlatforms.
 var UnsupportedPlatforms = []Platform{
 	{OS: "android"},               // linker errors (Go 1.7.3, 11/2016)
 	{OS: "darwin", Arch: "arm"},   // runtime.read_tls_fallback: not defined (Go 1.7.3, 11/2016), and for ARM7: clang: error: argument unused during compilation: '-mno-thumb'
@@ -750,70 +1080,115 @@ var UnsupportedPlatforms = []Platform{
 	{OS: "plan9"},                 // syscall-related compile errors in Caddy (Go 1.7.3, 11/2016)
 }
 
-// SupportedPlatforms runs `go tool dist list` to get
-// a list of platforms we can build for, sans the ones
-// matching any in the skip slice. In order to be skipped,
-// the platform must match all specified fields.
-func SupportedPlatforms(skip []Platform) ([]Platform, error) {
-	out, err := exec.Command("go", "tool", "dist", "list", "-json").Output()
+// SupportedPlatforms runs `go tool dist list` of the toolchain
+// of the given Go version (see LookupToolchain) to get a list
+// of platforms we can build for, expanded and filtered according
+// to Matrix, sans the ones that failed the last platform probe
+// of that toolchain (see SetPlatformProbes) and the ones matching
+// any in the skip slice. In order to be skipped, the platform
+// must match all specified fields.
+func SupportedPlatforms(skip []Platform, goVersion string) ([]Platform, error) {
+	goroot, err := LookupToolchain(goVersion)
 	if err != nil {
 		return nil, err
 	}
+	return supportedPlatforms(skip, goroot)
+}
 
-	var platforms []Platform
-	err = json.Unmarshal(out, &platforms)
+// supportedPlatforms is like SupportedPlatforms, but with
+// the toolchain given by its GOROOT (empty for the go
+// command on the PATH).
+func supportedPlatforms(skip []Platform, goroot string) ([]Platform, error) {
+	platforms, err := allPlatforms(toolchainCommand(goroot, "tool", "dist", "list", "-json"))
 	if err != nil {
 		return nil, err
 	}
-
-	// manually expand all the ARM platforms to enumerate
-	// the versions of ARM we can build for (assume 5, 6, 7).
-	for i := len(platforms) - 1; i >= 0; i-- {
-		p := platforms[i]
-		if p.Arch == "arm" && p.ARM == "" {
-			platforms[i].ARM = "5"
-			platforms = append(platforms[:i+1], append([]Platform{
-				Platform{OS: p.OS, Arch: p.Arch, ARM: "6", Cgo: p.Cgo},
-				Platform{OS: p.OS, Arch: p.Arch, ARM: "7", Cgo: p.Cgo},
-			}, platforms[i+1:]...)...)
-		}
+	version, err := goVersion(toolchainCommand(goroot, "version"))
+	if err != nil {
+		return nil, fmt.Errorf("getting Go version: %v", err)
 	}
 
-	// remove platforms that we don't build for
+	// remove platforms that we don't build for, either
+	// because the matrix or the probe says so or because
+	// they are in skip
+	probe := CurrentPlatformProbe(version)
 	for i := 0; i < len(platforms); i++ {
 		p := platforms[i]
+		skipped := Matrix.Settings(p).Skip || (probe != nil && probe.failed(p))
 		for _, unsup := range skip {
-			osMatch := unsup.OS == "" || unsup.OS == p.OS
-			archMatch := unsup.Arch == "" || unsup.Arch == p.Arch
-			armMatch := unsup.ARM == "" || unsup.ARM == p.ARM
-
-			// along with checking the hard-coded exclusions, we also
-			// skip building ARMv5 for OSes other than linux. see:
-			// https://github.com/golang/go/issues/18418
-			if (osMatch && archMatch && armMatch) ||
-				(p.ARM == "5" && p.OS != "linux") {
-				platforms = append(platforms[:i], platforms[i+1:]...)
-				i--
+			if unsup.matches(p) {
+				skipped = true
 				break
 			}
 		}
+		if skipped {
+			platforms = append(platforms[:i], platforms[i+1:]...)
+			i--
+		}
 	}
 
 	return platforms, nil
 }
 
+// allPlatforms returns the platforms reported by cmd,
+// which must be `go tool dist list -json`, with the
+// variants of Matrix expanded.
+func allPlatforms(cmd *exec.Cmd) ([]Platform, error) {
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var platforms []Platform
+	err = json.Unmarshal(out, &platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	// expand variants (e.g. versions of ARM)
+	return Matrix.expand(platforms), nil
+}
+
 const (
 	// MonthDayHourMin is the date format used in
 	// some temporary file paths.
 	MonthDayHourMin = "01-02-1504"
 
+	// CaddyPackage is the import (package) path to Caddy.
+	CaddyPackage = "github.com/mholt/caddy"
+)
+
+// Settings of all build environments. Change them
+// before opening any build environment.
+var (
 	// ParallelBuildOps is how many build operations
 	// to perform in parallel (`go build -p` value).
 	ParallelBuildOps = 4
 
-	// CaddyPackage is the import (package) path to Caddy.
-	CaddyPackage = "github.com/mholt/caddy"
+	// ParallelPlatformBuilds is how many platforms
+	// BuildAll compiles at the same time.
+	ParallelPlatformBuilds = 2
+
+	// MasterGopath is the master GOPATH. If empty,
+	// the GOPATH environment variable is used.
+	MasterGopath string
 
-	// plugInto is the file in which plugins get plugged in
-	plugInto = "caddy/caddymain/run.go"
+	// TempDir is the folder in which temporary GOPATHs
+	// and backups are made. If empty, the system's
+	// default temporary folder is used.
+	TempDir string
+
+	// CommandTimeout, if not zero, is how long any one
+	// command (go get, go build, git, etc.) may run
+	// before it is killed.
+	CommandTimeout time.Duration
 )
+
+// MasterGopathDir returns the master GOPATH that
+// build environments use.
+func MasterGopathDir() string {
+	if MasterGopath != "" {
+		return MasterGopath
+	}
+	return os.Getenv("GOPATH")
+}
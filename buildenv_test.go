@@ -0,0 +1,39 @@
+package buildworker
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommandTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	oldTimeout := CommandTimeout
+	t.Cleanup(func() { CommandTimeout = oldTimeout })
+	CommandTimeout = 100 * time.Millisecond
+
+	// the child holds the output pipes open after its
+	// parent is killed, unless it is killed too
+	be := testBuildEnv(t, t.TempDir(), t.TempDir())
+	cmd := be.newCommand("sh", "-c", "sleep 30 & sleep 30")
+	start := time.Now()
+	err := be.runCommand(cmd)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected a timeout error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the command to be stopped soon after the timeout, took %v", elapsed)
+	}
+
+	// commands that finish in time are not affected
+	cmd = be.newCommand("sh", "-c", "echo hello")
+	if err := be.runCommand(cmd); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+	if !strings.Contains(be.Log.String(), "hello") {
+		t.Errorf("expected the output in the log, got: %s", be.Log)
+	}
+}
@@ -21,28 +21,47 @@ var Signer *openpgp.Entity
 // TODO: Maintain master gopath (when? master gopaths are
 // scoped to individual BuildEnvs) by pruning unused packages...
 
-var gopathLocks = make(map[string]*sync.RWMutex)
+var (
+	gopathLocks   = make(map[string]*sync.RWMutex)
+	gopathLocksMu sync.Mutex
+)
 
-func lock(gopath string) {
+// gopathLock returns the lock of gopath.
+func gopathLock(gopath string) *sync.RWMutex {
+	gopathLocksMu.Lock()
+	defer gopathLocksMu.Unlock()
 	if _, ok := gopathLocks[gopath]; !ok {
 		gopathLocks[gopath] = new(sync.RWMutex)
 	}
-	gopathLocks[gopath].Lock()
+	return gopathLocks[gopath]
+}
+
+func lock(gopath string) {
+	l := gopathLock(gopath)
+	lockWaiters.Inc()
+	start := time.Now()
+	l.Lock()
+	lockWait.WithLabelValues("write").Observe(time.Since(start).Seconds())
+	lockWaiters.Dec()
+	setGopathWriteLocked(gopath, true)
 }
 
 func unlock(gopath string) {
-	gopathLocks[gopath].Unlock()
+	setGopathWriteLocked(gopath, false)
+	gopathLock(gopath).Unlock()
 }
 
 func rlock(gopath string) {
-	if _, ok := gopathLocks[gopath]; !ok {
-		gopathLocks[gopath] = new(sync.RWMutex)
-	}
-	gopathLocks[gopath].RLock()
+	l := gopathLock(gopath)
+	lockWaiters.Inc()
+	start := time.Now()
+	l.RLock()
+	lockWait.WithLabelValues("read").Observe(time.Since(start).Seconds())
+	lockWaiters.Dec()
 }
 
 func runlock(gopath string) {
-	gopathLocks[gopath].RUnlock()
+	gopathLock(gopath).RUnlock()
 }
 
 // CaddyPlugin holds information about a Caddy plugin to build.
@@ -59,14 +78,44 @@ type CaddyPlugin struct {
 type BuildConfig struct {
 	CaddyVersion string        `json:"caddy_version"`
 	Plugins      []CaddyPlugin `json:"plugins"`
+
+	// The version of the Go toolchain to build with (see
+	// Toolchains); if empty, the default toolchain is used.
+	GoVersion string `json:"go_version,omitempty"`
+
+	// The format to make builds in (see ArchiveFormats); if
+	// empty, the platform matrix decides for each platform.
+	Format string `json:"format,omitempty"`
+
+	// Whether builds for linux also make a container
+	// image (an OCI image layout tarball).
+	Image bool `json:"image,omitempty"`
 }
 
-const ldFlagVarPkg = "github.com/mholt/caddy/caddy/caddymain"
+// makeLdFlags makes a string to pass in as ldflags when building
+// the program in repoPath, setting variables in the package
+// ldFlagVarPkg. This automates proper versioning, so it uses git
+// to get information about the current version of the program.
+func makeLdFlags(repoPath, ldFlagVarPkg string) (string, error) {
+	vars, err := ldFlagVars(repoPath)
+	if err != nil {
+		return "", err
+	}
+	var ldflags []string
+	for _, v := range vars {
+		ldflags = append(ldflags, fmt.Sprintf(`-X "%s.%s=%s"`, ldFlagVarPkg, v.name, v.value))
+	}
+	return strings.Join(ldflags, " "), nil
+}
 
-// makeLdFlags makes a string to pass in as ldflags when building Caddy.
-// This automates proper versioning, so it uses git to get information
-// about the current version of Caddy.
-func makeLdFlags(repoPath string) (string, error) {
+// ldFlagVar is a variable set at link time.
+type ldFlagVar struct {
+	name, value string
+}
+
+// ldFlagVars returns the variables that makeLdFlags
+// sets for the program in repoPath, with their values.
+func ldFlagVars(repoPath string) ([]ldFlagVar, error) {
 	run := func(cmd *exec.Cmd, ignoreError bool) (string, error) {
 		cmd.Dir = repoPath
 		out, err := cmd.Output()
@@ -76,8 +125,7 @@ func makeLdFlags(repoPath string) (string, error) {
 		return strings.TrimSpace(string(out)), nil
 	}
 
-	var ldflags []string
-
+	var vars []ldFlagVar
 	for _, ldvar := range []struct {
 		name  string
 		value func() (string, error)
@@ -133,12 +181,11 @@ func makeLdFlags(repoPath string) (string, error) {
 	} {
 		value, err := ldvar.value()
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		ldflags = append(ldflags, fmt.Sprintf(`-X "%s.%s=%s"`, ldFlagVarPkg, ldvar.name, value))
+		vars = append(vars, ldFlagVar{ldvar.name, value})
 	}
-
-	return strings.Join(ldflags, " "), nil
+	return vars, nil
 }
 
 // dirExists returns true if dir exists and is a
@@ -256,22 +303,121 @@ type DeployRequest struct {
 	// The list of platforms on which the plugin(s) must
 	// build successfully.
 	RequiredPlatforms []Platform `json:"required_platforms"`
+
+	// The version of the Go toolchain to run checks with (see
+	// Toolchains); if empty, the default toolchain is used.
+	GoVersion string `json:"go_version,omitempty"`
+
+	// If set, the deploy is performed in the background
+	// and its outcome is POSTed to this URL when done.
+	CallbackURL string `json:"callback_url,omitempty"`
 }
 
 // BuildRequest is a request for a build of Caddy.
 type BuildRequest struct {
 	Platform
 	BuildConfig
+
+	// If set, the build is performed in the background
+	// and its outcome is POSTed to this URL when done.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// BundleRequest is a request for builds of Caddy
+// for several platforms at once.
+type BundleRequest struct {
+	// The platforms to build for. If empty,
+	// AllPlatforms must be set.
+	Platforms []Platform `json:"platforms"`
+
+	// If set, all supported platforms (see
+	// SupportedPlatforms) are built for.
+	AllPlatforms bool `json:"all_platforms"`
+
+	BuildConfig
+
+	// If set, the builds are performed in the background
+	// and their outcome is POSTed to this URL when done.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// MetadataRequest is a request for the metadata of a plugin.
+type MetadataRequest struct {
+	// The import (package) path of the plugin, and its version.
+	PluginPackage string `json:"plugin_package"`
+	PluginVersion string `json:"plugin_version"`
+
+	// The version of Caddy to load the plugin with;
+	// if empty, master is used.
+	CaddyVersion string `json:"caddy_version,omitempty"`
+
+	// The version of the Go toolchain to load the plugin
+	// with; if empty, the default toolchain is used.
+	GoVersion string `json:"go_version,omitempty"`
+}
+
+// ReleaseRequest is a request to make a release of Caddy.
+type ReleaseRequest struct {
+	// The version to release; it must be a tag.
+	Version string `json:"version"`
+
+	// The version of the Go toolchain to build with (see
+	// Toolchains); if empty, the default toolchain is used.
+	GoVersion string `json:"go_version,omitempty"`
+
+	// If set, the release is made in the background
+	// and its outcome is POSTed to this URL when done.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// VulnCheckRequest is a request to check the dependencies
+// of a build of Caddy for known vulnerabilities.
+type VulnCheckRequest struct {
+	CaddyVersion string        `json:"caddy_version"`
+	Plugins      []CaddyPlugin `json:"plugins"`
+
+	// The version of the Go toolchain to list dependencies
+	// with; if empty, the default toolchain is used.
+	GoVersion string `json:"go_version,omitempty"`
+
+	// If set, the check is performed in the background
+	// and its outcome is POSTed to this URL when done.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// CallbackPayload is POSTed to the callback URL of a
+// request when its job is finished. The request is signed
+// like requests to the build worker (see SignRequest).
+type CallbackPayload struct {
+	JobID        string            `json:"job_id"`
+	Kind         string            `json:"kind"`   // build, build-bundle, release, vuln-check, deploy-caddy, or deploy-plugin
+	Status       string            `json:"status"` // success or failure
+	Error        string            `json:"error,omitempty"`
+	Resolved     map[string]string `json:"resolved,omitempty"` // package to commit SHA
+	CheckReport  *CheckReport      `json:"check_report,omitempty"`
+	Manifest     *BuildManifest    `json:"manifest,omitempty"`
+	ArtifactURL  string            `json:"artifact_url,omitempty"`
+	SignatureURL string            `json:"signature_url,omitempty"`
+	Bundle       *BuildBundle      `json:"bundle,omitempty"`
+	Artifacts    map[string]string `json:"artifacts,omitempty"` // file name to URL
+	Release      *ReleaseManifest  `json:"release,omitempty"`
+	VulnReport   *VulnReport       `json:"vuln_report,omitempty"`
 }
 
 // Sign signs the file using the configured PGP private key
 // and returns the ASCII-armored bytes, or an error.
 func Sign(file *os.File) (*bytes.Buffer, error) {
+	return sign(file)
+}
+
+// sign signs what r reads like Sign.
+func sign(r io.Reader) (*bytes.Buffer, error) {
 	if Signer == nil {
 		return nil, fmt.Errorf("no signing key loaded")
 	}
+	defer observePhase("sign", time.Now())
 	buf := new(bytes.Buffer)
-	err := openpgp.ArmoredDetachSign(buf, Signer, file, nil)
+	err := openpgp.ArmoredDetachSign(buf, Signer, r, nil)
 	if err != nil {
 		return nil, fmt.Errorf("signing error: %v", err)
 	}
@@ -0,0 +1,193 @@
+package buildworker
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BuildBundle describes the builds of one build
+// environment for several platforms; see BuildAll.
+type BuildBundle struct {
+	Time      time.Time         `json:"time"`
+	Package   string            `json:"package"` // of the target
+	Requested map[string]string `json:"requested"`
+	Resolved  map[string]string `json:"resolved"` // package to commit SHA
+	GoVersion string            `json:"go_version"`
+	Builds    []PlatformBuild   `json:"builds"` // in the order requested
+}
+
+// PlatformBuild is the outcome of building for one platform.
+type PlatformBuild struct {
+	Platform Platform `json:"platform"`
+	Archive  string   `json:"archive,omitempty"` // file name
+	SHA256   string   `json:"sha256,omitempty"`  // of the archive, hex-encoded
+	Error    string   `json:"error,omitempty"`
+
+	// Image is the file name of the container image of
+	// a linux build, if any, ImageSHA256 its checksum,
+	// and ImageDigest the digest of the image in it.
+	Image       string `json:"image,omitempty"`
+	ImageSHA256 string `json:"image_sha256,omitempty"`
+	ImageDigest string `json:"image_digest,omitempty"`
+
+	// SBOM is the file name of the build's software bill
+	// of materials, and SBOMSHA256 its checksum.
+	SBOM       string `json:"sbom,omitempty"`
+	SBOMSHA256 string `json:"sbom_sha256,omitempty"`
+}
+
+// Succeeded returns the builds that produced an archive.
+func (bb *BuildBundle) Succeeded() []PlatformBuild {
+	var builds []PlatformBuild
+	for _, b := range bb.Builds {
+		if b.Error == "" {
+			builds = append(builds, b)
+		}
+	}
+	return builds
+}
+
+// Checksums returns the checksums of the archives, SBOMs,
+// and images in the format of sha256sum, so that they can
+// be verified with `sha256sum -c`.
+func (bb *BuildBundle) Checksums() []byte {
+	return checksums(bb.Succeeded())
+}
+
+// checksums returns the checksums of the archives, SBOMs,
+// and images of builds in the format of sha256sum.
+func checksums(builds []PlatformBuild) []byte {
+	var buf bytes.Buffer
+	for _, b := range builds {
+		fmt.Fprintf(&buf, "%s  %s\n", b.SHA256, b.Archive)
+		if b.SBOM != "" {
+			fmt.Fprintf(&buf, "%s  %s\n", b.SBOMSHA256, b.SBOM)
+		}
+		if b.Image != "" {
+			fmt.Fprintf(&buf, "%s  %s\n", b.ImageSHA256, b.Image)
+		}
+	}
+	return buf.Bytes()
+}
+
+// BuildAll is like Build, but builds for each of platforms
+// (once, even if one is listed more than once), placing the
+// archives in outputFolder. The plugins are plugged
+// in once, and up to ParallelPlatformBuilds platforms are
+// compiled at the same time. A platform failing to build does
+// not stop the others; its error is recorded in the bundle. An
+// error is returned if no platform could be built.
+func (be BuildEnv) BuildAll(platforms []Platform, outputFolder string) (*BuildBundle, error) {
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("no platforms to build for")
+	}
+	for _, plat := range platforms {
+		if plat.OS == "" || plat.Arch == "" {
+			return nil, fmt.Errorf("missing required information: OS or arch")
+		}
+	}
+
+	bundle := &BuildBundle{
+		Time:      time.Now().UTC(),
+		Package:   be.target.Package,
+		Requested: be.pkgs,
+	}
+	var err error
+	bundle.Resolved, err = be.ResolvedVersions()
+	if err != nil {
+		return nil, err
+	}
+	bundle.GoVersion, err = be.GoVersion()
+	if err != nil {
+		return nil, fmt.Errorf("getting Go version: %v", err)
+	}
+
+	err = be.plugIn()
+	if err != nil {
+		return nil, err
+	}
+
+	bundle.Builds = be.buildPlatforms(platforms, outputFolder, nil)
+
+	if len(bundle.Succeeded()) == 0 {
+		return bundle, fmt.Errorf("no platform could be built; first error: %s", bundle.Builds[0].Error)
+	}
+	return bundle, nil
+}
+
+// buildPlatforms builds the archives of platforms in
+// outputFolder, up to ParallelPlatformBuilds at a time,
+// and returns the outcomes in the same order, with each
+// platform built (and listed) only once, in the place it
+// first appears. The plugins must already be plugged in.
+// The log of each platform's build is kept apart and added
+// to the environment's log when the build is done. If done
+// is not nil, it is called with each outcome as soon as it
+// is known; calls to done are not concurrent.
+func (be BuildEnv) buildPlatforms(platforms []Platform, outputFolder string, done func(PlatformBuild)) []PlatformBuild {
+	platforms = uniquePlatforms(platforms)
+	builds := make([]PlatformBuild, len(platforms))
+	parallel := ParallelPlatformBuilds
+	if parallel < 1 {
+		parallel = 1
+	}
+	throttle := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	var doneMu sync.Mutex
+	for i, plat := range platforms {
+		wg.Add(1)
+		go func(i int, plat Platform) {
+			defer wg.Done()
+			throttle <- struct{}{}
+			defer func() { <-throttle }()
+
+			var log bytes.Buffer
+			pbe := be.withLogBuffer(&log, "platform", plat.String())
+			build := PlatformBuild{Platform: plat}
+			archivePath, err := pbe.buildArchive(plat, outputFolder)
+			if err == nil {
+				build.SHA256, err = fileSHA256(archivePath)
+			}
+			if err == nil {
+				build.Image, build.ImageSHA256, build.ImageDigest, err = imageOf(archivePath)
+			}
+			if err == nil {
+				build.SBOM, build.SBOMSHA256, err = sbomOf(archivePath)
+			}
+			if err != nil {
+				build.Error = err.Error()
+			} else {
+				build.Archive = filepath.Base(archivePath)
+			}
+			builds[i] = build
+
+			doneMu.Lock()
+			defer doneMu.Unlock()
+			be.Log.Write(log.Bytes())
+			if done != nil {
+				done(build)
+			}
+		}(i, plat)
+	}
+	wg.Wait()
+	return builds
+}
+
+// uniquePlatforms returns platforms without the
+// platforms that appear in it more than once,
+// except for their first appearance.
+func uniquePlatforms(platforms []Platform) []Platform {
+	seen := make(map[string]bool)
+	var unique []Platform
+	for _, plat := range platforms {
+		if seen[plat.String()] {
+			continue
+		}
+		seen[plat.String()] = true
+		unique = append(unique, plat)
+	}
+	return unique
+}
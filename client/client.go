@@ -0,0 +1,612 @@
+// Package client is a Go client for the build worker's HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// Client makes requests to a build worker.
+type Client struct {
+	// BaseURL is the address of the build worker,
+	// for example "http://127.0.0.1:2017".
+	BaseURL string
+
+	// Token is the client's API token, of the
+	// form "<name>.<secret>".
+	Token string
+
+	// SigningKey, if set, is used to sign requests
+	// to the endpoints that accept signatures.
+	SigningKey []byte
+
+	// Keyring holds the public key(s) that build signatures
+	// are verified against. Builds fail without it, unless
+	// InsecureSkipVerify is set.
+	Keyring openpgp.EntityList
+
+	// InsecureSkipVerify makes builds skip verifying
+	// signatures; checksums are verified regardless.
+	InsecureSkipVerify bool
+
+	// HTTPClient is the HTTP client to use; if nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// MaxRetries is how many times a request is retried
+	// after a network error or a server error (5xx). Only
+	// requests that are safe to repeat are retried: not
+	// deploys, releases, or requests with a callback URL.
+	MaxRetries int
+
+	// Backoff is how long to wait before the first retry;
+	// the wait doubles after each retry.
+	Backoff time.Duration
+}
+
+// New returns a new client for the build worker at
+// baseURL which authenticates with token.
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		MaxRetries: 3,
+		Backoff:    time.Second,
+	}
+}
+
+// Error is an error returned by the build worker.
+type Error struct {
+	StatusCode int
+	Message    string
+	Log        string // log of the build environment (JSON lines), if any
+	JobID      string // correlates the error with the worker's logs
+}
+
+func (e *Error) Error() string {
+	if e.JobID != "" {
+		return fmt.Sprintf("HTTP %d: %s (job %s)", e.StatusCode, e.Message, e.JobID)
+	}
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+// BuildResult is the result of a build.
+type BuildResult struct {
+	// JobID is the ID of the job if the request had a callback
+	// URL; the build is then done in the background, its outcome
+	// is POSTed to the callback URL, and the other fields are
+	// not set.
+	JobID string
+
+	ArchiveName string
+	Archive     io.Reader
+	Signature   io.Reader // ASCII-armored detached signature of Archive
+	Manifest    *buildworker.BuildManifest
+	SBOM        io.Reader // SPDX JSON document; nil if the build has none
+	Image       io.Reader // OCI image layout tarball; nil if the build has none
+}
+
+// Build requests a build. The signatures of the archive and of
+// the manifest are verified against the client's Keyring (see
+// InsecureSkipVerify), and the checksums of the archive, SBOM,
+// and image against the manifest, before returning.
+func (c *Client) Build(ctx context.Context, req buildworker.BuildRequest) (*BuildResult, error) {
+	background := req.CallbackURL != ""
+	if !background {
+		err := c.checkKeyring()
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := c.do(ctx, "POST", "/build", req, false, !background)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if jobID, err := acceptedJob(resp); jobID != "" || err != nil {
+		return &BuildResult{JobID: jobID}, err
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing content type: %v", err)
+	}
+
+	var result BuildResult
+	var archive, signature, manifest, manifestSignature, sbom, image []byte
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading response: %v", err)
+		}
+		contents, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", part.FormName(), err)
+		}
+		switch part.FormName() {
+		case "archive":
+			archive = contents
+			result.ArchiveName = part.FileName()
+		case "signature":
+			signature = contents
+		case "manifest":
+			manifest = contents
+			result.Manifest = new(buildworker.BuildManifest)
+			err = json.Unmarshal(contents, result.Manifest)
+			if err != nil {
+				return nil, fmt.Errorf("decoding manifest: %v", err)
+			}
+		case "manifest_signature":
+			manifestSignature = contents
+		case "sbom":
+			sbom = contents
+		case "image":
+			image = contents
+		}
+	}
+	if archive == nil || signature == nil {
+		return nil, fmt.Errorf("response is missing archive or signature")
+	}
+
+	err = c.verify(result.ArchiveName, archive, signature)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		if manifestSignature == nil {
+			return nil, fmt.Errorf("response is missing signature of manifest")
+		}
+		err = c.verify("manifest", manifest, manifestSignature)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if result.Manifest != nil {
+		if sum := fmt.Sprintf("%x", sha256.Sum256(archive)); sum != result.Manifest.SHA256 {
+			return nil, fmt.Errorf("checksum of %s is %s, but manifest says %s", result.ArchiveName, sum, result.Manifest.SHA256)
+		}
+		if result.Manifest.SBOM != "" {
+			if sbom == nil {
+				return nil, fmt.Errorf("response is missing SBOM")
+			}
+			if sum := fmt.Sprintf("%x", sha256.Sum256(sbom)); sum != result.Manifest.SBOMSHA256 {
+				return nil, fmt.Errorf("checksum of %s is %s, but manifest says %s", result.Manifest.SBOM, sum, result.Manifest.SBOMSHA256)
+			}
+			result.SBOM = bytes.NewReader(sbom)
+		}
+		if result.Manifest.Image != "" {
+			if image == nil {
+				return nil, fmt.Errorf("response is missing image")
+			}
+			if sum := fmt.Sprintf("%x", sha256.Sum256(image)); sum != result.Manifest.ImageSHA256 {
+				return nil, fmt.Errorf("checksum of %s is %s, but manifest says %s", result.Manifest.Image, sum, result.Manifest.ImageSHA256)
+			}
+			result.Image = bytes.NewReader(image)
+		}
+	}
+
+	result.Archive = bytes.NewReader(archive)
+	result.Signature = bytes.NewReader(signature)
+	return &result, nil
+}
+
+// BundleResult is the result of a bundle build.
+type BundleResult struct {
+	// JobID is the ID of the job if the request had a
+	// callback URL; as with BuildResult, the other
+	// fields are then not set.
+	JobID string
+
+	Bundle    *buildworker.BuildBundle
+	Checksums []byte         // in the format of sha256sum
+	Archives  []*BuildResult // of the platforms that were built
+}
+
+// BuildBundle requests builds for several platforms at once.
+// The signatures of the checksums and of every archive are
+// verified against the client's Keyring (see InsecureSkipVerify),
+// and the checksums of each archive, SBOM, and image against
+// the bundle, before returning.
+func (c *Client) BuildBundle(ctx context.Context, req buildworker.BundleRequest) (*BundleResult, error) {
+	background := req.CallbackURL != ""
+	if !background {
+		err := c.checkKeyring()
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := c.do(ctx, "POST", "/build-bundle", req, false, !background)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if jobID, err := acceptedJob(resp); jobID != "" || err != nil {
+		return &BundleResult{JobID: jobID}, err
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing content type: %v", err)
+	}
+
+	var result BundleResult
+	var checksumsSignature []byte
+	archives := make(map[string][]byte)
+	signatures := make(map[string][]byte) // keyed by archive name
+	sboms := make(map[string][]byte)
+	images := make(map[string][]byte)
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading response: %v", err)
+		}
+		contents, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", part.FormName(), err)
+		}
+		switch part.FormName() {
+		case "manifest":
+			result.Bundle = new(buildworker.BuildBundle)
+			err = json.Unmarshal(contents, result.Bundle)
+			if err != nil {
+				return nil, fmt.Errorf("decoding manifest: %v", err)
+			}
+		case "checksums":
+			result.Checksums = contents
+		case "checksums_signature":
+			checksumsSignature = contents
+		case "archive":
+			archives[part.FileName()] = contents
+		case "signature":
+			signatures[strings.TrimSuffix(part.FileName(), ".asc")] = contents
+		case "sbom":
+			sboms[part.FileName()] = contents
+		case "image":
+			images[part.FileName()] = contents
+		}
+	}
+	if result.Bundle == nil || result.Checksums == nil || checksumsSignature == nil {
+		return nil, fmt.Errorf("response is missing manifest, checksums, or their signature")
+	}
+
+	err = c.verify("checksums", result.Checksums, checksumsSignature)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(result.Checksums, result.Bundle.Checksums()) {
+		return nil, fmt.Errorf("checksums do not match the manifest")
+	}
+
+	for _, build := range result.Bundle.Succeeded() {
+		archive, signature := archives[build.Archive], signatures[build.Archive]
+		if archive == nil || signature == nil {
+			return nil, fmt.Errorf("response is missing archive or signature of %s", build.Archive)
+		}
+		err := c.verify(build.Archive, archive, signature)
+		if err != nil {
+			return nil, err
+		}
+		if sum := fmt.Sprintf("%x", sha256.Sum256(archive)); sum != build.SHA256 {
+			return nil, fmt.Errorf("checksum of %s is %s, but manifest says %s", build.Archive, sum, build.SHA256)
+		}
+		archiveResult := &BuildResult{
+			ArchiveName: build.Archive,
+			Archive:     bytes.NewReader(archive),
+			Signature:   bytes.NewReader(signature),
+		}
+		if build.SBOM != "" {
+			sbom := sboms[build.SBOM]
+			if sbom == nil {
+				return nil, fmt.Errorf("response is missing SBOM of %s", build.Archive)
+			}
+			if sum := fmt.Sprintf("%x", sha256.Sum256(sbom)); sum != build.SBOMSHA256 {
+				return nil, fmt.Errorf("checksum of %s is %s, but manifest says %s", build.SBOM, sum, build.SBOMSHA256)
+			}
+			archiveResult.SBOM = bytes.NewReader(sbom)
+		}
+		if build.Image != "" {
+			image := images[build.Image]
+			if image == nil {
+				return nil, fmt.Errorf("response is missing image of %s", build.Archive)
+			}
+			if sum := fmt.Sprintf("%x", sha256.Sum256(image)); sum != build.ImageSHA256 {
+				return nil, fmt.Errorf("checksum of %s is %s, but manifest says %s", build.Image, sum, build.ImageSHA256)
+			}
+			archiveResult.Image = bytes.NewReader(image)
+		}
+		result.Archives = append(result.Archives, archiveResult)
+	}
+
+	return &result, nil
+}
+
+// DeployCaddy deploys the given version of Caddy.
+func (c *Client) DeployCaddy(ctx context.Context, caddyVersion string) error {
+	resp, err := c.do(ctx, "POST", "/deploy-caddy", buildworker.DeployRequest{CaddyVersion: caddyVersion}, true, false)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// DeployPlugin deploys the plugin described by req. If req
+// has a callback URL, the deploy is done in the background,
+// its outcome is POSTed to the callback URL, and the error
+// is an *Accepted.
+func (c *Client) DeployPlugin(ctx context.Context, req buildworker.DeployRequest) error {
+	resp, err := c.do(ctx, "POST", "/deploy-plugin", req, true, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if jobID, err := acceptedJob(resp); jobID != "" || err != nil {
+		return acceptedError(jobID, err)
+	}
+	return nil
+}
+
+// Release makes (or resumes) the release described by
+// req and returns its manifest. The release is kept on
+// the build worker. If req has a callback URL, the error
+// is an *Accepted instead.
+func (c *Client) Release(ctx context.Context, req buildworker.ReleaseRequest) (*buildworker.ReleaseManifest, error) {
+	resp, err := c.do(ctx, "POST", "/release", req, true, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if jobID, err := acceptedJob(resp); jobID != "" || err != nil {
+		return nil, acceptedError(jobID, err)
+	}
+	manifest := new(buildworker.ReleaseManifest)
+	err = json.NewDecoder(resp.Body).Decode(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("decoding release manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// CheckVulnerabilities checks the dependencies of the build
+// described by req for known vulnerabilities. If req has a
+// callback URL, the error is an *Accepted instead.
+func (c *Client) CheckVulnerabilities(ctx context.Context, req buildworker.VulnCheckRequest) (*buildworker.VulnReport, error) {
+	resp, err := c.do(ctx, "POST", "/vuln-check", req, false, req.CallbackURL == "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if jobID, err := acceptedJob(resp); jobID != "" || err != nil {
+		return nil, acceptedError(jobID, err)
+	}
+	report := new(buildworker.VulnReport)
+	err = json.NewDecoder(resp.Body).Decode(report)
+	if err != nil {
+		return nil, fmt.Errorf("decoding vulnerability report: %v", err)
+	}
+	return report, nil
+}
+
+// PluginMetadata returns the metadata of the plugin
+// described by req, such as the names it registers.
+func (c *Client) PluginMetadata(ctx context.Context, req buildworker.MetadataRequest) (*buildworker.PluginMetadata, error) {
+	resp, err := c.do(ctx, "POST", "/plugin-metadata", req, false, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	md := new(buildworker.PluginMetadata)
+	err = json.NewDecoder(resp.Body).Decode(md)
+	if err != nil {
+		return nil, fmt.Errorf("decoding plugin metadata: %v", err)
+	}
+	return md, nil
+}
+
+// SupportedPlatforms returns the platforms the build worker can build
+// for with the Go toolchain of goVersion (the default one if empty).
+func (c *Client) SupportedPlatforms(ctx context.Context, goVersion string) ([]buildworker.Platform, error) {
+	path := "/supported-platforms"
+	if goVersion != "" {
+		path += "?go_version=" + url.QueryEscape(goVersion)
+	}
+	resp, err := c.do(ctx, "GET", path, nil, false, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var platforms []buildworker.Platform
+	err = json.NewDecoder(resp.Body).Decode(&platforms)
+	if err != nil {
+		return nil, fmt.Errorf("decoding platforms: %v", err)
+	}
+	return platforms, nil
+}
+
+// Toolchains returns the versions of the Go toolchains
+// that builds and deploys can select.
+func (c *Client) Toolchains(ctx context.Context) ([]string, error) {
+	resp, err := c.do(ctx, "GET", "/toolchains", nil, false, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var versions []string
+	err = json.NewDecoder(resp.Body).Decode(&versions)
+	if err != nil {
+		return nil, fmt.Errorf("decoding toolchains: %v", err)
+	}
+	return versions, nil
+}
+
+// Accepted is the error of requests that have a callback URL
+// and whose result cannot hold the ID of their job: the worker
+// accepted the job to do it in the background, and POSTs its
+// outcome to the callback URL. It is not a failure.
+type Accepted struct {
+	JobID string
+}
+
+func (a *Accepted) Error() string {
+	return fmt.Sprintf("job %s accepted; its outcome is sent to the callback URL", a.JobID)
+}
+
+// acceptedError returns the error of a request whose response
+// accepted the job with the given ID, if err is nil.
+func acceptedError(jobID string, err error) error {
+	if err != nil {
+		return err
+	}
+	return &Accepted{JobID: jobID}
+}
+
+// acceptedJob returns the ID of the job that resp accepted
+// to do in the background, or "" if resp does not accept
+// a job.
+func acceptedJob(resp *http.Response) (string, error) {
+	if resp.StatusCode != http.StatusAccepted {
+		return "", nil
+	}
+	var accepted struct{ JobID string }
+	err := json.NewDecoder(resp.Body).Decode(&accepted)
+	if err != nil {
+		return "", fmt.Errorf("decoding accepted job: %v", err)
+	}
+	if accepted.JobID == "" {
+		return "", fmt.Errorf("accepted job has no ID")
+	}
+	return accepted.JobID, nil
+}
+
+// checkKeyring returns an error if the client could
+// not verify signatures and is not told to skip them.
+func (c *Client) checkKeyring() error {
+	if c.Keyring == nil && !c.InsecureSkipVerify {
+		return fmt.Errorf("client has no Keyring to verify signatures with; set InsecureSkipVerify to skip verification")
+	}
+	return nil
+}
+
+// verify checks signature, the ASCII-armored detached signature
+// of contents, which name describes, against the client's Keyring.
+func (c *Client) verify(name string, contents, signature []byte) error {
+	if c.InsecureSkipVerify {
+		return nil
+	}
+	err := c.checkKeyring()
+	if err != nil {
+		return err
+	}
+	_, err = openpgp.CheckArmoredDetachedSignature(c.Keyring, bytes.NewReader(contents), bytes.NewReader(signature))
+	if err != nil {
+		return fmt.Errorf("verifying signature of %s: %v", name, err)
+	}
+	return nil
+}
+
+// do performs a request to path with body encoded as JSON (if
+// not nil). If retry is true, the request is retried as
+// configured; only requests that are safe to repeat may be. If
+// sign is true and the client has a signing key, each attempt
+// is signed. A response is returned only if its status is 2xx,
+// otherwise an error is returned; it is the caller's
+// responsibility to close the body.
+func (c *Client) do(ctx context.Context, method, path string, body interface{}, sign, retry bool) (*http.Response, error) {
+	var bodyBytes []byte
+	if body != nil {
+		var err error
+		bodyBytes, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, c.BaseURL+path, bytes.NewReader(bodyBytes))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		if sign && c.SigningKey != nil {
+			err = buildworker.SignRequest(req, c.SigningKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := httpClient.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		if err == nil {
+			err = responseError(resp)
+			resp.Body.Close()
+		}
+
+		again := retry && attempt < c.MaxRetries && ctx.Err() == nil
+		if apiErr, ok := err.(*Error); ok && apiErr.StatusCode < 500 {
+			again = false
+		}
+		if !again {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// responseError reads the error in resp's body.
+func responseError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode, JobID: resp.Header.Get("X-Job-ID")}
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		apiErr.Message = resp.Status
+		return apiErr
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") &&
+		json.Unmarshal(contents, apiErr) == nil {
+		return apiErr
+	}
+	apiErr.Message = strings.TrimSpace(string(contents))
+	return apiErr
+}
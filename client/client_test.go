@@ -0,0 +1,253 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// statusServer returns a server that responds to every request
+// with the given statuses in turn (repeating the last), and a
+// count of the requests it received.
+func statusServer(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		status := statuses[n-1]
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		switch {
+		case status == http.StatusAccepted:
+			json.NewEncoder(w).Encode(struct{ JobID string }{"job1"})
+		case status >= 300:
+			json.NewEncoder(w).Encode(map[string]string{"message": http.StatusText(status)})
+		case r.URL.Path == "/toolchains":
+			json.NewEncoder(w).Encode([]string{"1.22.0"})
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	newClient := func(baseURL string) *Client {
+		c := New(baseURL, "alice.secret")
+		c.Backoff = time.Millisecond
+		return c
+	}
+
+	// requests that are safe to repeat are retried after server errors
+	srv, requests := statusServer(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK)
+	versions, err := newClient(srv.URL).Toolchains(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(versions) != 1 || *requests != 3 {
+		t.Errorf("expected a result after 3 requests, got %v after %d", versions, *requests)
+	}
+
+	// but only as many times as configured
+	srv, requests = statusServer(t, http.StatusInternalServerError)
+	_, err = newClient(srv.URL).Toolchains(ctx)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected an HTTP 500 error, got: %v", err)
+	}
+	if *requests != 4 {
+		t.Errorf("expected 4 requests (3 retries), got %d", *requests)
+	}
+
+	// and not after client errors
+	srv, requests = statusServer(t, http.StatusBadRequest, http.StatusOK)
+	_, err = newClient(srv.URL).Toolchains(ctx)
+	if err == nil || *requests != 1 {
+		t.Errorf("expected an error after 1 request, got %v after %d", err, *requests)
+	}
+
+	// requests that are not safe to repeat are never retried
+	for i, do := range []func(c *Client) error{
+		func(c *Client) error {
+			return c.DeployPlugin(ctx, buildworker.DeployRequest{PluginPackage: "example.com/plugin"})
+		},
+		func(c *Client) error {
+			return c.DeployCaddy(ctx, "v1.0.0")
+		},
+		func(c *Client) error {
+			_, err := c.Release(ctx, buildworker.ReleaseRequest{})
+			return err
+		},
+		func(c *Client) error {
+			_, err := c.Build(ctx, buildworker.BuildRequest{CallbackURL: "https://example.com/callback"})
+			return err
+		},
+		func(c *Client) error {
+			_, err := c.CheckVulnerabilities(ctx, buildworker.VulnCheckRequest{CallbackURL: "https://example.com/callback"})
+			return err
+		},
+	} {
+		srv, requests := statusServer(t, http.StatusServiceUnavailable, http.StatusOK)
+		err := do(newClient(srv.URL))
+		if err == nil || *requests != 1 {
+			t.Errorf("Test %d: expected an error after 1 request, got %v after %d", i, err, *requests)
+		}
+	}
+}
+
+func TestAccepted(t *testing.T) {
+	ctx := context.Background()
+	srv, _ := statusServer(t, http.StatusAccepted)
+	c := New(srv.URL, "alice.secret")
+	c.InsecureSkipVerify = true
+	callback := "https://example.com/callback"
+
+	for i, do := range []func() error{
+		func() error {
+			return c.DeployPlugin(ctx, buildworker.DeployRequest{PluginPackage: "example.com/plugin", CallbackURL: callback})
+		},
+		func() error {
+			_, err := c.Release(ctx, buildworker.ReleaseRequest{CallbackURL: callback})
+			return err
+		},
+		func() error {
+			_, err := c.CheckVulnerabilities(ctx, buildworker.VulnCheckRequest{CallbackURL: callback})
+			return err
+		},
+	} {
+		var accepted *Accepted
+		err := do()
+		if !errors.As(err, &accepted) || accepted.JobID != "job1" {
+			t.Errorf("Test %d: expected job1 to be accepted, got: %v", i, err)
+		}
+	}
+
+	result, err := c.Build(ctx, buildworker.BuildRequest{CallbackURL: callback})
+	if err != nil || result.JobID != "job1" {
+		t.Errorf("expected build job1 to be accepted, got %+v, %v", result, err)
+	}
+	bundle, err := c.BuildBundle(ctx, buildworker.BundleRequest{CallbackURL: callback})
+	if err != nil || bundle.JobID != "job1" {
+		t.Errorf("expected bundle job1 to be accepted, got %+v, %v", bundle, err)
+	}
+
+	// a 202 without a job ID is an error, not an acceptance
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	c.BaseURL = srv.URL
+	var accepted *Accepted
+	err = c.DeployPlugin(ctx, buildworker.DeployRequest{PluginPackage: "example.com/plugin", CallbackURL: callback})
+	if err == nil || errors.As(err, &accepted) {
+		t.Errorf("expected an error for an accepted job without an ID, got: %v", err)
+	}
+}
+
+// buildServer returns a server that responds to builds with
+// archive, signed by signer, and its manifest, whose checksum
+// of the archive is that of manifestArchive.
+func buildServer(t *testing.T, signer *openpgp.Entity, archive, manifestArchive []byte) *httptest.Server {
+	sign := func(contents []byte) []byte {
+		var buf bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&buf, signer, bytes.NewReader(contents), nil); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	manifest, err := json.Marshal(buildworker.BuildManifest{
+		Archive: "caddy.tar.gz",
+		SHA256:  fmt.Sprintf("%x", sha256.Sum256(manifestArchive)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writer := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", writer.FormDataContentType())
+		for _, part := range []struct {
+			field, name string
+			contents    []byte
+		}{
+			{"signature", "caddy.tar.gz.asc", sign(archive)},
+			{"manifest", "caddy.tar.gz.manifest.json", manifest},
+			{"manifest_signature", "caddy.tar.gz.manifest.json.asc", sign(manifest)},
+			{"archive", "caddy.tar.gz", archive},
+		} {
+			pw, err := writer.CreateFormFile(part.field, part.name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			pw.Write(part.contents)
+		}
+		writer.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBuildVerify(t *testing.T) {
+	worker, err := openpgp.NewEntity("worker", "", "worker@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor, err := openpgp.NewEntity("impostor", "", "impostor@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := []byte("archive contents")
+
+	for i, test := range []struct {
+		signer             *openpgp.Entity
+		manifestArchive    []byte
+		keyring            openpgp.EntityList
+		insecureSkipVerify bool
+		expectErr          bool
+	}{
+		{worker, archive, openpgp.EntityList{worker}, false, false},
+		{impostor, archive, openpgp.EntityList{worker}, false, true},
+		{worker, []byte("other contents"), openpgp.EntityList{worker}, false, true},
+		{worker, archive, nil, false, true},
+		{impostor, archive, nil, true, false},
+		{impostor, []byte("other contents"), nil, true, true}, // checksums are always verified
+	} {
+		srv := buildServer(t, test.signer, archive, test.manifestArchive)
+		c := New(srv.URL, "alice.secret")
+		c.Keyring = test.keyring
+		c.InsecureSkipVerify = test.insecureSkipVerify
+
+		result, err := c.Build(context.Background(), buildworker.BuildRequest{})
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: expected an error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error, got: %v", i, err)
+			continue
+		}
+		if result.ArchiveName != "caddy.tar.gz" || result.Manifest == nil {
+			t.Errorf("Test %d: expected the archive and its manifest, got %+v", i, result)
+		}
+	}
+}
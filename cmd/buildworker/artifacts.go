@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// artifactStore keeps the results of background jobs on
+// disk, one folder per job, until they expire.
+type artifactStore struct {
+	dir string
+	ttl time.Duration
+}
+
+// save moves the file at src into the folder of job
+// and returns the URL path at which it is served.
+func (as artifactStore) save(job *jobInfo, src string) (string, error) {
+	jobDir, err := as.jobDir(job)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(src)
+	err = moveFile(src, filepath.Join(jobDir, name))
+	if err != nil {
+		return "", err
+	}
+	return path.Join("/artifacts", job.id, name), nil
+}
+
+// saveBytes writes contents to a file named name in the folder
+// of job and returns the URL path at which it is served.
+func (as artifactStore) saveBytes(job *jobInfo, name string, contents []byte) (string, error) {
+	jobDir, err := as.jobDir(job)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(jobDir, name), contents, 0600)
+	if err != nil {
+		return "", err
+	}
+	return path.Join("/artifacts", job.id, name), nil
+}
+
+// jobDir makes the folder of job, if it does not exist, with
+// a record of the client that the job belongs to, and returns
+// its path.
+func (as artifactStore) jobDir(job *jobInfo) (string, error) {
+	jobDir := filepath.Join(as.dir, job.id)
+	err := os.MkdirAll(jobDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(jobDir, ownerFile), []byte(job.client), 0600)
+	if err != nil {
+		return "", err
+	}
+	return jobDir, nil
+}
+
+// ServeHTTP serves GET /artifacts/<job>/<file> to the
+// client that the job belongs to.
+func (as artifactStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/artifacts/"), "/")
+	if len(parts) != 2 || !validPathSegment(parts[0]) || !validPathSegment(parts[1]) ||
+		strings.HasPrefix(parts[1], ".") {
+		http.NotFound(w, r)
+		return
+	}
+	owner, err := ioutil.ReadFile(filepath.Join(as.dir, parts[0], ownerFile))
+	if err != nil || string(owner) != jobFromRequest(r).client {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(as.dir, parts[0], parts[1]))
+}
+
+// moveFile moves the file at src to dst. If it can't be
+// renamed, as when dst is on another file system, it is
+// copied, then removed.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// cleanUp deletes the folders of jobs that are
+// older than the TTL, every interval, forever.
+func (as artifactStore) cleanUp(interval time.Duration) {
+	for range time.Tick(interval) {
+		infos, err := ioutil.ReadDir(as.dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Error("listing artifacts", "error", err)
+			}
+			continue
+		}
+		for _, info := range infos {
+			if info.IsDir() && time.Since(info.ModTime()) > as.ttl {
+				err := os.RemoveAll(filepath.Join(as.dir, info.Name()))
+				if err != nil {
+					slog.Error("deleting expired artifacts", "job", info.Name(), "error", err)
+				}
+			}
+		}
+	}
+}
+
+// validPathSegment returns true if s can safely be
+// used as a single element of a file path.
+func validPathSegment(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
+
+// publicURL returns the absolute URL of urlPath on this
+// server, as reachable by the client that made r.
+func publicURL(r *http.Request, urlPath string) string {
+	if publicBaseURL != "" {
+		return strings.TrimSuffix(publicBaseURL, "/") + urlPath
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + urlPath
+}
+
+// ownerFile is the file in the folder of each job that
+// has the name of the client that the job belongs to.
+const ownerFile = ".owner"
+
+var (
+	artifacts artifactStore
+
+	// publicBaseURL is the base URL of this server
+	// as reachable by clients, if it can't be
+	// inferred from requests.
+	publicBaseURL string
+)
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArtifactStore(t *testing.T) {
+	as := artifactStore{dir: t.TempDir()}
+	src := filepath.Join(t.TempDir(), "caddy.tar.gz")
+	err := ioutil.WriteFile(src, []byte("archive"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &jobInfo{id: "job1", client: "alice"}
+	urlPath, err := as.save(job, src)
+	if err != nil {
+		t.Fatalf("saving artifact: %v", err)
+	}
+	if urlPath != "/artifacts/job1/caddy.tar.gz" {
+		t.Errorf("unexpected URL path: %s", urlPath)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be moved, got %v", src, err)
+	}
+
+	for _, test := range []struct {
+		client string
+		path   string
+		status int
+	}{
+		{"alice", "/artifacts/job1/caddy.tar.gz", http.StatusOK},
+		{"bob", "/artifacts/job1/caddy.tar.gz", http.StatusNotFound},
+		{"alice", "/artifacts/job1/" + ownerFile, http.StatusNotFound},
+		{"alice", "/artifacts/job2/caddy.tar.gz", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		as.ServeHTTP(w, newJobRequest("GET", test.path, "job3", APIClient{Name: test.client}))
+		if w.Code != test.status {
+			t.Errorf("GET %s by %s: expected status %d, got %d", test.path, test.client, test.status, w.Code)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != "archive" {
+			t.Errorf("GET %s: unexpected contents '%s'", test.path, w.Body)
+		}
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	// a folder in the way makes both renaming and
+	// copying fail, and the source must be kept
+	src := filepath.Join(t.TempDir(), "file")
+	err := ioutil.WriteFile(src, []byte("contents"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "file")
+	err = os.Mkdir(dst, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := moveFile(src, dst); err == nil {
+		t.Error("expected an error moving onto a folder")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("expected the source to be kept after failing: %v", err)
+	}
+
+	os.Remove(dst)
+	err = moveFile(src, dst)
+	if err != nil {
+		t.Fatalf("moving file: %v", err)
+	}
+	contents, err := ioutil.ReadFile(dst)
+	if err != nil || string(contents) != "contents" {
+		t.Errorf("unexpected contents of moved file: '%s' (%v)", contents, err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Scope is a permission granted to an API client.
+type Scope string
+
+// Scopes that can be granted to API clients. The admin
+// scope implies all other scopes.
+const (
+	ScopeBuild   Scope = "build"
+	ScopeDeploy  Scope = "deploy"
+	ScopeMetrics Scope = "metrics"
+	ScopeAdmin   Scope = "admin"
+)
+
+// APIClient is a named client of the API. Only a salted,
+// slow hash of the client's token is ever stored.
+type APIClient struct {
+	Name      string  `json:"name"`
+	TokenHash string  `json:"token_hash"` // bcrypt hash of the token's secret
+	Scopes    []Scope `json:"scopes"`
+	HMACKey   string  `json:"hmac_key,omitempty"`  // base64; if set, requests to signed routes must be signed
+	CertName  string  `json:"cert_name,omitempty"` // common name of the client's TLS certificate, if any
+	Revoked   bool    `json:"revoked,omitempty"`
+}
+
+// Allowed returns true if c has been granted scope.
+func (c APIClient) Allowed(scope Scope) bool {
+	for _, s := range c.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// clientRegistry holds the API clients that are allowed
+// to make requests. It can be reloaded from its file at
+// any time so that tokens can be revoked without restarting.
+type clientRegistry struct {
+	mu      sync.RWMutex
+	file    string
+	clients map[string]APIClient
+	static  []APIClient // clients not loaded from file (i.e. from env)
+}
+
+// load (re)loads the clients file, if any, replacing
+// all clients that were previously loaded from it.
+func (reg *clientRegistry) load() error {
+	clients := make(map[string]APIClient)
+	for _, c := range reg.static {
+		clients[c.Name] = c
+	}
+	certNames := make(map[string]string) // to client name
+
+	if reg.file != "" {
+		contents, err := ioutil.ReadFile(reg.file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			var fileClients []APIClient
+			err = json.Unmarshal(contents, &fileClients)
+			if err != nil {
+				return fmt.Errorf("parsing %s: %v", reg.file, err)
+			}
+			for _, c := range fileClients {
+				if c.Name == "" || c.TokenHash == "" {
+					return fmt.Errorf("%s: client is missing name or token hash", reg.file)
+				}
+				if _, ok := clients[c.Name]; ok {
+					return fmt.Errorf("%s: duplicate client name: %s", reg.file, c.Name)
+				}
+				if c.CertName != "" {
+					// a certificate must identify one client
+					if other, ok := certNames[c.CertName]; ok {
+						return fmt.Errorf("%s: clients %s and %s have the same cert name: %s", reg.file, other, c.Name, c.CertName)
+					}
+					certNames[c.CertName] = c.Name
+				}
+				clients[c.Name] = c
+			}
+		}
+	}
+
+	reg.mu.Lock()
+	reg.clients = clients
+	reg.mu.Unlock()
+	return nil
+}
+
+// revoke revokes the client with the given name and
+// persists the change to the clients file. Clients that
+// are not from the file cannot be revoked, since reloading
+// the file would restore them.
+func (reg *clientRegistry) revoke(name string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	c, ok := reg.clients[name]
+	if !ok {
+		return fmt.Errorf("unknown client: %s", name)
+	}
+	if reg.isStatic(name) {
+		return fmt.Errorf("client %s is set by BUILDWORKER_CLIENT_ID and cannot be revoked; unset it and restart instead", name)
+	}
+	c.Revoked = true
+	reg.clients[name] = c
+
+	var fileClients []APIClient
+	for _, c := range reg.clients {
+		if !reg.isStatic(c.Name) {
+			fileClients = append(fileClients, c)
+		}
+	}
+	contents, err := json.MarshalIndent(fileClients, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(reg.file, contents, 0600)
+}
+
+func (reg *clientRegistry) isStatic(name string) bool {
+	for _, c := range reg.static {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the client that owns the given
+// token secret, if the token is valid and not revoked.
+func (reg *clientRegistry) authenticate(name, secret string) (APIClient, bool) {
+	reg.mu.RLock()
+	c, ok := reg.clients[name]
+	reg.mu.RUnlock()
+	if !ok {
+		// compare anyway so that response timing does
+		// not reveal which client names exist
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(secret))
+		return APIClient{}, false
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(c.TokenHash), []byte(secret))
+	if err != nil || c.Revoked {
+		return APIClient{}, false
+	}
+	return c, true
+}
+
+// authenticateCert returns the client whose certificate
+// name is cn, if there is one and it is not revoked. The
+// certificate must have been verified already.
+func (reg *clientRegistry) authenticateCert(cn string) (APIClient, bool) {
+	if cn == "" {
+		return APIClient{}, false
+	}
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	for _, c := range reg.clients {
+		if c.CertName == cn && !c.Revoked {
+			return c, true
+		}
+	}
+	return APIClient{}, false
+}
+
+// credentials extracts the client name and token secret from r.
+// Tokens can be given as "Authorization: Bearer <name>.<secret>"
+// or with HTTP Basic Auth where the username is the client name
+// and the password is the secret.
+func credentials(r *http.Request) (name, secret string, ok bool) {
+	if name, secret, ok = r.BasicAuth(); ok {
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	return splitToken(auth[len(prefix):])
+}
+
+// splitToken splits a token of the form "<name>.<secret>".
+// The secret never contains a dot, but a name might.
+func splitToken(token string) (name, secret string, ok bool) {
+	i := strings.LastIndex(token, ".")
+	if i < 1 || i == len(token)-1 {
+		return "", "", false
+	}
+	return token[:i], token[i+1:], true
+}
+
+// newClient generates a new client with a random token and
+// returns it along with the token, which is only ever shown once.
+// If withKey is true, a random request signing key is generated
+// for the client as well.
+func newClient(name string, scopes []Scope, withKey bool) (APIClient, string, error) {
+	if name == "" {
+		return APIClient{}, "", fmt.Errorf("client name is required")
+	}
+	randBytes := make([]byte, 32)
+	_, err := rand.Read(randBytes)
+	if err != nil {
+		return APIClient{}, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(randBytes)
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return APIClient{}, "", err
+	}
+	client := APIClient{Name: name, TokenHash: string(hash), Scopes: scopes}
+	if withKey {
+		_, err = rand.Read(randBytes)
+		if err != nil {
+			return APIClient{}, "", err
+		}
+		client.HMACKey = base64.StdEncoding.EncodeToString(randBytes)
+	}
+	return client, name + "." + secret, nil
+}
+
+// parseScopes parses a comma-separated list of scopes.
+func parseScopes(list string) ([]Scope, error) {
+	var scopes []Scope
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		switch Scope(s) {
+		case ScopeBuild, ScopeDeploy, ScopeMetrics, ScopeAdmin:
+			scopes = append(scopes, Scope(s))
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown scope: %s", s)
+		}
+	}
+	return scopes, nil
+}
+
+// authHandler only lets requests through from clients
+// that are authenticated and have been granted scope.
+func authHandler(scope Scope, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var client APIClient
+		var ok bool
+
+		// a verified client certificate identifies the client
+		// by itself; otherwise a token is required
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+			client, ok = apiClients.authenticateCert(cn)
+			if !ok {
+				requestLogger(r).Warn("unknown client certificate", "cert_name", cn, "remote", r.RemoteAddr, "path", r.URL.Path)
+			}
+		}
+		if !ok {
+			name, secret, hasCreds := credentials(r)
+			if !hasCreds {
+				requestLogger(r).Warn("missing credentials", "remote", r.RemoteAddr, "path", r.URL.Path)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			client, ok = apiClients.authenticate(name, secret)
+			if !ok {
+				requestLogger(r).Warn("wrong credentials", "client", name, "remote", r.RemoteAddr, "path", r.URL.Path)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		if !client.Allowed(scope) {
+			requestLogger(r).Warn("insufficient scope", "client", client.Name, "scope", scope, "path", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		jobFromRequest(r).client = client.Name
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientCtxKey, client)))
+	}
+}
+
+// clientFromRequest returns the authenticated client
+// making the request r, if any.
+func clientFromRequest(r *http.Request) (APIClient, bool) {
+	c, ok := r.Context().Value(clientCtxKey).(APIClient)
+	return c, ok
+}
+
+type ctxKey string
+
+const clientCtxKey ctxKey = "client"
+
+// setAPICredentials loads the API clients. The legacy
+// BUILDWORKER_CLIENT_ID and BUILDWORKER_CLIENT_KEY
+// credentials, if set, become a client with all scopes.
+func setAPICredentials() error {
+	envID := os.Getenv("BUILDWORKER_CLIENT_ID")
+	envKey := os.Getenv("BUILDWORKER_CLIENT_KEY")
+	if envID != "" && envKey != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(envKey), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		apiClients.static = append(apiClients.static, APIClient{
+			Name:      envID,
+			TokenHash: string(hash),
+			Scopes:    []Scope{ScopeAdmin},
+		})
+	}
+
+	err := apiClients.load()
+	if err != nil {
+		return err
+	}
+
+	if len(apiClients.clients) == 0 {
+		slog.Warn("no API clients; add clients to the clients file or set BUILDWORKER_CLIENT_ID and BUILDWORKER_CLIENT_KEY",
+			"clients_file", apiClients.file)
+	}
+	return nil
+}
+
+// dummyHash is compared against when a client name is unknown.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("buildworker"), bcrypt.DefaultCost)
+
+// apiClients are the clients allowed to access the API.
+var apiClients = new(clientRegistry)
+
+const defaultClientsFile = "clients.json"
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testClient returns a client with the given name and
+// scopes whose token secret is "secret-"+name.
+func testClient(t *testing.T, name string, scopes ...Scope) APIClient {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret-"+name), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return APIClient{Name: name, TokenHash: string(hash), Scopes: scopes}
+}
+
+// writeClientsFile writes clients to a clients file
+// in a temporary folder and returns its path.
+func writeClientsFile(t *testing.T, clients ...APIClient) string {
+	t.Helper()
+	contents, err := json.Marshal(clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "clients.json")
+	if err := ioutil.WriteFile(file, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestSplitToken(t *testing.T) {
+	for i, test := range []struct {
+		token, name, secret string
+		ok                  bool
+	}{
+		{"alice.abc", "alice", "abc", true},
+		{"dev.portal.abc", "dev.portal", "abc", true},
+		{"alice", "", "", false},
+		{".abc", "", "", false},
+		{"alice.", "", "", false},
+		{"", "", "", false},
+	} {
+		name, secret, ok := splitToken(test.token)
+		if name != test.name || secret != test.secret || ok != test.ok {
+			t.Errorf("Test %d (%s): expected (%s, %s, %v), got (%s, %s, %v)",
+				i, test.token, test.name, test.secret, test.ok, name, secret, ok)
+		}
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	for i, test := range []struct {
+		authorization, name, secret string
+		ok                          bool
+	}{
+		{"Bearer alice.abc", "alice", "abc", true},
+		{"bearer alice.abc", "alice", "abc", true},
+		{"Basic YWxpY2U6YWJj", "alice", "abc", true}, // alice:abc
+		{"Bearer alice", "", "", false},
+		{"Bearer", "", "", false},
+		{"Token alice.abc", "", "", false},
+		{"", "", "", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		name, secret, ok := credentials(r)
+		if name != test.name || secret != test.secret || ok != test.ok {
+			t.Errorf("Test %d (%s): expected (%s, %s, %v), got (%s, %s, %v)",
+				i, test.authorization, test.name, test.secret, test.ok, name, secret, ok)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	revoked := testClient(t, "mallory", ScopeBuild)
+	revoked.Revoked = true
+	reg := &clientRegistry{file: writeClientsFile(t, testClient(t, "alice", ScopeBuild), revoked)}
+	if err := reg.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		name, secret string
+		ok           bool
+	}{
+		{"alice", "secret-alice", true},
+		{"alice", "secret-mallory", false},
+		{"alice", "", false},
+		{"mallory", "secret-mallory", false},
+		{"bob", "secret-bob", false},
+	} {
+		client, ok := reg.authenticate(test.name, test.secret)
+		if ok != test.ok {
+			t.Errorf("Test %d (%s): expected ok=%v, got %v", i, test.name, test.ok, ok)
+		}
+		if ok && client.Name != test.name {
+			t.Errorf("Test %d: expected client %s, got %s", i, test.name, client.Name)
+		}
+	}
+}
+
+func TestLoadClients(t *testing.T) {
+	alice, bob := testClient(t, "alice", ScopeBuild), testClient(t, "bob", ScopeDeploy)
+	alice.CertName, bob.CertName = "alice.example.com", "bob.example.com"
+	static := testClient(t, "env", ScopeAdmin)
+
+	reg := &clientRegistry{file: writeClientsFile(t, alice, bob), static: []APIClient{static}}
+	if err := reg.load(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(reg.clients) != 3 {
+		t.Errorf("expected 3 clients, got %d", len(reg.clients))
+	}
+	if client, ok := reg.authenticateCert("bob.example.com"); !ok || client.Name != "bob" {
+		t.Errorf("expected bob by certificate, got %v, %v", client.Name, ok)
+	}
+	if _, ok := reg.authenticateCert(""); ok {
+		t.Error("expected no client for an empty certificate name")
+	}
+
+	// a file with errors keeps the clients loaded before
+	bob.CertName = alice.CertName
+	reg.file = writeClientsFile(t, alice, bob)
+	if err := reg.load(); err == nil || !strings.Contains(err.Error(), "same cert name") {
+		t.Errorf("expected an error for a duplicate cert name, got: %v", err)
+	}
+	for i, clients := range [][]APIClient{
+		{alice, alice},
+		{static},
+		{{Name: "nohash"}},
+	} {
+		reg.file = writeClientsFile(t, clients...)
+		if err := reg.load(); err == nil {
+			t.Errorf("Test %d: expected an error, got none", i)
+		}
+	}
+	if len(reg.clients) != 3 {
+		t.Errorf("expected the 3 clients to still be loaded, got %d", len(reg.clients))
+	}
+
+	// clients without cert names do not clash
+	alice.CertName, bob.CertName = "", ""
+	reg.file = writeClientsFile(t, alice, bob)
+	if err := reg.load(); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	reg := &clientRegistry{
+		file:   writeClientsFile(t, testClient(t, "alice", ScopeBuild), testClient(t, "bob", ScopeBuild)),
+		static: []APIClient{testClient(t, "env", ScopeAdmin)},
+	}
+	if err := reg.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.revoke("alice"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if err := reg.revoke("env"); err == nil {
+		t.Error("expected an error revoking a client not from the clients file")
+	}
+	if err := reg.revoke("carol"); err == nil {
+		t.Error("expected an error revoking an unknown client")
+	}
+
+	// the revocation is persisted, so it outlasts reloads
+	if err := reg.load(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expect := range map[string]bool{"alice": false, "bob": true, "env": true} {
+		if _, ok := reg.authenticate(name, "secret-"+name); ok != expect {
+			t.Errorf("expected authentication of %s to be %v, got %v", name, expect, ok)
+		}
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	oldClients := apiClients
+	t.Cleanup(func() { apiClients = oldClients })
+	certClient := testClient(t, "cert", ScopeMetrics)
+	certClient.CertName = "cert.example.com"
+	apiClients = &clientRegistry{file: writeClientsFile(t,
+		testClient(t, "builder", ScopeBuild),
+		testClient(t, "admin", ScopeAdmin),
+		certClient,
+	)}
+	if err := apiClients.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	withCert := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+			{Subject: pkix.Name{CommonName: cn}},
+		}}}
+	}
+	for i, test := range []struct {
+		scope         Scope
+		authorization string
+		tls           *tls.ConnectionState
+		expectStatus  int
+		expectClient  string
+	}{
+		{ScopeBuild, "Bearer builder.secret-builder", nil, http.StatusOK, "builder"},
+		{ScopeDeploy, "Bearer builder.secret-builder", nil, http.StatusForbidden, ""},
+		{ScopeDeploy, "Bearer admin.secret-admin", nil, http.StatusOK, "admin"},
+		{ScopeMetrics, "Bearer admin.secret-admin", nil, http.StatusOK, "admin"},
+		{ScopeBuild, "Bearer builder.wrong", nil, http.StatusUnauthorized, ""},
+		{ScopeBuild, "", nil, http.StatusUnauthorized, ""},
+		{ScopeMetrics, "", withCert("cert.example.com"), http.StatusOK, "cert"},
+		{ScopeBuild, "", withCert("cert.example.com"), http.StatusForbidden, ""},
+		{ScopeBuild, "", withCert("other.example.com"), http.StatusUnauthorized, ""},
+		{ScopeBuild, "Bearer builder.secret-builder", withCert("other.example.com"), http.StatusOK, "builder"},
+	} {
+		var client string
+		h := authHandler(test.scope, func(w http.ResponseWriter, r *http.Request) {
+			c, _ := clientFromRequest(r)
+			client = c.Name
+		})
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		r.TLS = test.tls
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != test.expectStatus {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.expectStatus, w.Code)
+		}
+		if client != test.expectClient {
+			t.Errorf("Test %d: expected client '%s', got '%s'", i, test.expectClient, client)
+		}
+	}
+}
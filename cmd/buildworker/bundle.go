@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// bundleFile is a file produced by a bundle
+// job and the form field it is sent in.
+type bundleFile struct {
+	field string // manifest, checksums, checksums_signature, archive, signature, sbom, or image
+	path  string
+}
+
+// bundlePlatforms returns the platforms that req asks for.
+func bundlePlatforms(req buildworker.BundleRequest) ([]buildworker.Platform, error) {
+	if req.AllPlatforms {
+		if len(req.Platforms) > 0 {
+			return nil, fmt.Errorf("platforms and all_platforms are mutually exclusive")
+		}
+		return buildworker.SupportedPlatforms(buildworker.UnsupportedPlatforms, req.GoVersion)
+	}
+	if len(req.Platforms) == 0 {
+		return nil, fmt.Errorf("missing required field: platforms or all_platforms")
+	}
+	for _, plat := range req.Platforms {
+		if plat.OS == "" || plat.Arch == "" {
+			return nil, fmt.Errorf("missing required fields: GOOS or GOARCH of platform")
+		}
+	}
+	return req.Platforms, nil
+}
+
+// bundleJob builds cfg for each of platforms into the folder dir
+// and signs the resulting archives and their checksums. It returns
+// the files to deliver; the result has the bundle.
+func bundleJob(r *http.Request, cfg buildworker.BuildConfig, platforms []buildworker.Platform, dir string) ([]bundleFile, jobResult) {
+	opts := buildEnvOptions(r)
+	opts.GoVersion = cfg.GoVersion
+	opts.Format = cfg.Format
+	opts.Image = cfg.Image
+	be, err := buildworker.OpenWithOptions(cfg.CaddyVersion, cfg.Plugins, opts)
+	if err != nil {
+		return nil, jobResult{status: http.StatusBadRequest, msg: "creating build env", err: err, log: be.Log.String()}
+	}
+	defer be.Close()
+
+	start := time.Now()
+	bundle, err := be.BuildAll(platforms, dir)
+	res := jobResult{log: be.Log.String(), bundle: bundle}
+	if bundle != nil {
+		res.resolved = bundle.Resolved
+	}
+	if err != nil {
+		res.status = http.StatusBadRequest
+		res.msg = "build"
+		res.err = err
+		return nil, res
+	}
+	requestLogger(r).Info("built bundle", "version", cfg.CaddyVersion, "phase", "build",
+		"built", len(bundle.Succeeded()), "requested", len(platforms), "duration", time.Since(start))
+
+	internalErr := func(msg string, err error) ([]bundleFile, jobResult) {
+		res.status = http.StatusInternalServerError
+		res.msg = msg
+		res.err = err
+		return nil, res
+	}
+
+	manifest, err := json.MarshalIndent(bundle, "", "\t")
+	if err != nil {
+		return internalErr("encoding manifest", err)
+	}
+	manifestPath := filepath.Join(dir, "manifest.json")
+	err = ioutil.WriteFile(manifestPath, manifest, 0600)
+	if err != nil {
+		return internalErr("writing manifest", err)
+	}
+	checksumsPath := filepath.Join(dir, checksumsFile)
+	err = ioutil.WriteFile(checksumsPath, bundle.Checksums(), 0600)
+	if err != nil {
+		return internalErr("writing checksums", err)
+	}
+	files := []bundleFile{
+		{"manifest", manifestPath},
+		{"checksums", checksumsPath},
+	}
+
+	sign := func(field, path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		signature, err := buildworker.Sign(f)
+		if err != nil {
+			return err
+		}
+		sigPath := path + ".asc"
+		err = ioutil.WriteFile(sigPath, signature.Bytes(), 0600)
+		if err != nil {
+			return err
+		}
+		files = append(files, bundleFile{field, sigPath})
+		return nil
+	}
+	err = sign("checksums_signature", checksumsPath)
+	if err != nil {
+		return internalErr("signing checksums", err)
+	}
+	for _, build := range bundle.Succeeded() {
+		archivePath := filepath.Join(dir, build.Archive)
+		err = sign("signature", archivePath)
+		if err != nil {
+			return internalErr("signing "+build.Archive, err)
+		}
+		files = append(files, bundleFile{"archive", archivePath})
+		if build.SBOM != "" {
+			files = append(files, bundleFile{"sbom", filepath.Join(dir, build.SBOM)})
+		}
+		if build.Image != "" {
+			files = append(files, bundleFile{"image", filepath.Join(dir, build.Image)})
+		}
+	}
+
+	return files, res
+}
+
+// httpBundle builds cfg for each of platforms and streams
+// the files of the bundle into the response body of w.
+func httpBundle(w http.ResponseWriter, r *http.Request, cfg buildworker.BuildConfig, platforms []buildworker.Platform) {
+	internalErr := func(intro string, err error) {
+		requestLogger(r).Error(intro, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+
+	tmpdir, err := ioutil.TempDir(tempDir(), "caddy_bundle_")
+	if err != nil {
+		internalErr("error getting temporary directory", err)
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	files, res := bundleJob(r, cfg, platforms, tmpdir)
+	if res.err != nil {
+		if res.status == http.StatusInternalServerError {
+			internalErr(res.msg, res.err)
+		} else {
+			writeError(w, r, res.status, res.msg, res.err, res.log)
+		}
+		return
+	}
+
+	writer := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", writer.FormDataContentType())
+	for _, file := range files {
+		err := writeFilePart(writer, file.field, file.path)
+		if err != nil {
+			// the response has been started, so
+			// the best we can do is cut it short
+			requestLogger(r).Error("writing bundle into form", "file", filepath.Base(file.path), "error", err)
+			return
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		requestLogger(r).Error("closing form writer", "error", err)
+	}
+}
+
+// writeFilePart copies the file at path into
+// a new form file of writer named field.
+func writeFilePart(writer *multipart.Writer, field, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	part, err := writer.CreateFormFile(field, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
+
+// backgroundBundle performs a bundle job after the request
+// has been responded to, keeps the files in the artifact
+// store, and notifies callbackURL when done.
+func backgroundBundle(r *http.Request, callbackURL string, cfg buildworker.BuildConfig, platforms []buildworker.Platform) {
+	tmpdir, err := os.MkdirTemp(tempDir(), "caddy_bundle_")
+	if err != nil {
+		notify(r, callbackURL, "build-bundle", jobResult{msg: "getting temporary directory", err: err}, "", "")
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	files, res := bundleJob(r, cfg, platforms, tmpdir)
+	if res.err != nil {
+		notify(r, callbackURL, "build-bundle", res, "", "")
+		return
+	}
+
+	job := jobFromRequest(r)
+	res.artifacts = make(map[string]string)
+	for _, file := range files {
+		fileURL, err := artifacts.save(job, file.path)
+		if err != nil {
+			notify(r, callbackURL, "build-bundle", jobResult{msg: "storing artifacts", err: err, resolved: res.resolved, bundle: res.bundle}, "", "")
+			return
+		}
+		res.artifacts[filepath.Base(file.path)] = publicURL(r, fileURL)
+	}
+	notify(r, callbackURL, "build-bundle", res, "", "")
+}
+
+// checksumsFile is the name of the file with the
+// checksums of the archives in a bundle.
+const checksumsFile = "SHA256SUMS"
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// deliverCallback POSTs payload to url, signed with the key of
+// the client that requested the job (or the webhook secret if
+// the client has no key), retrying with exponential backoff
+// until it is accepted or attempts run out. Every attempt is
+// recorded in the delivery log of the job.
+func deliverCallback(logger *slog.Logger, client APIClient, url string, payload buildworker.CallbackPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error("encoding callback payload", "error", err)
+		return
+	}
+
+	key, err := callbackKey(client)
+	if err != nil {
+		logger.Error("signing callback", "error", err)
+		return
+	}
+
+	backoff := callbackBackoff
+	for attempt := 1; attempt <= CallbackAttempts; attempt++ {
+		start := time.Now()
+		status, err := postCallback(url, key, body)
+		callbackDeliveries.add(payload.JobID, client.Name, Delivery{
+			Time:            start.UTC(),
+			URL:             url,
+			Attempt:         attempt,
+			StatusCode:      status,
+			Error:           errString(err),
+			DurationSeconds: time.Since(start).Seconds(),
+		})
+		if err == nil {
+			logger.Info("delivered callback", "url", url, "attempt", attempt)
+			return
+		}
+		logger.Warn("delivering callback", "url", url, "attempt", attempt, "error", err)
+		if attempt < CallbackAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	logger.Error("giving up on callback", "url", url, "attempts", CallbackAttempts)
+}
+
+// callbackKey returns the key that callbacks to client are
+// signed with: its own, or else the webhook secret.
+func callbackKey(client APIClient) ([]byte, error) {
+	if client.HMACKey != "" {
+		key, err := base64.StdEncoding.DecodeString(client.HMACKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key of client %s: %v", client.Name, err)
+		}
+		return key, nil
+	}
+	if webhookSecret == nil {
+		return nil, fmt.Errorf("client %s has no signing key, and no webhook secret is configured", client.Name)
+	}
+	return webhookSecret, nil
+}
+
+// postCallback makes one attempt to POST body, signed
+// with key, to url. It returns the status code of the
+// response, if any, and an error if the callback was
+// not accepted.
+func postCallback(url string, key, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	err = buildworker.SignRequest(req, key)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Delivery is a record of one attempt to deliver a callback.
+type Delivery struct {
+	Time            time.Time `json:"time"`
+	URL             string    `json:"url"`
+	Attempt         int       `json:"attempt"`
+	StatusCode      int       `json:"status_code,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// deliveryLog keeps the callback deliveries of the most
+// recent jobs in memory, along with the client that
+// each job belongs to.
+type deliveryLog struct {
+	mu    sync.Mutex
+	max   int
+	jobs  map[string]*jobDeliveries
+	order []string // job IDs, oldest first
+}
+
+type jobDeliveries struct {
+	client     string
+	deliveries []Delivery
+}
+
+func (dl *deliveryLog) add(jobID, client string, d Delivery) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.jobs == nil {
+		dl.jobs = make(map[string]*jobDeliveries)
+	}
+	jd, ok := dl.jobs[jobID]
+	if !ok {
+		if len(dl.order) >= dl.max {
+			delete(dl.jobs, dl.order[0])
+			dl.order = dl.order[1:]
+		}
+		dl.order = append(dl.order, jobID)
+		jd = &jobDeliveries{client: client}
+		dl.jobs[jobID] = jd
+	}
+	jd.deliveries = append(jd.deliveries, d)
+}
+
+// get returns the deliveries of the job, if
+// the job belongs to client.
+func (dl *deliveryLog) get(jobID, client string) []Delivery {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	jd, ok := dl.jobs[jobID]
+	if !ok || jd.client != client {
+		return nil
+	}
+	return append([]Delivery(nil), jd.deliveries...)
+}
+
+// checkCallbackURL returns an error if callbacks may
+// not be delivered to rawURL: if it is not an HTTP(S)
+// URL, or its host is not allowed (see callbackHosts),
+// or it has an internal address.
+func checkCallbackURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid callback URL: %s", rawURL)
+	}
+	host := u.Hostname()
+	if callbackHostAllowed(host) {
+		return nil
+	}
+	if len(callbackHosts) > 0 {
+		return fmt.Errorf("callbacks to %s are not allowed", host)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("resolving callback host: %v", err)
+	}
+	for _, addr := range addrs {
+		if internalIP(addr.IP) {
+			return fmt.Errorf("callbacks to %s are not allowed: it has the internal address %s", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// callbackHostAllowed returns whether host is
+// explicitly allowed to receive callbacks.
+func callbackHostAllowed(host string) bool {
+	for _, h := range callbackHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialCallback connects to addr for a callback. Unless the
+// host is allowed explicitly, connections to internal addresses
+// are refused, so that a host that resolved to a public address
+// when the job was accepted can't be pointed elsewhere later.
+func dialCallback(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if !callbackHostAllowed(host) {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			ipStr, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(ipStr); ip == nil || internalIP(ip) {
+				return fmt.Errorf("refusing to deliver callback to internal address %s", ipStr)
+			}
+			return nil
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// internalIP returns whether ip is not a public unicast
+// address: loopback, private, link-local (which includes
+// cloud metadata services), shared, multicast, or unspecified.
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// loadWebhookSecret loads the webhook secret from
+// the file at path, if path is not empty.
+func loadWebhookSecret(path string) error {
+	webhookSecret = nil
+	if path == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading webhook secret: %v", err)
+	}
+	secret := bytes.TrimSpace(contents)
+	if len(secret) == 0 {
+		return fmt.Errorf("webhook secret file %s is empty", path)
+	}
+	webhookSecret = secret
+	return nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// CallbackAttempts is how many times delivery
+// of a callback is attempted.
+const CallbackAttempts = 6
+
+var (
+	// callbackBackoff is how long to wait before the
+	// second attempt; the wait doubles each time.
+	callbackBackoff = 2 * time.Second
+
+	callbackClient = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{DialContext: dialCallback},
+	}
+	callbackDeliveries = &deliveryLog{max: 1000}
+
+	// webhookSecret signs callbacks to clients
+	// that have no signing key of their own.
+	webhookSecret []byte
+
+	// callbackHosts, if not empty, are the only hosts
+	// that callbacks may be delivered to, whatever
+	// their addresses.
+	callbackHosts []string
+
+	// sharedAddressSpace is 100.64.0.0/10 (RFC 6598),
+	// which is internal to carriers and clouds.
+	sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+)
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// callbackReceiver is a stand-in for the server that receives
+// callbacks. It responds to each request with the next of its
+// statuses (the last one once they run out), and records the
+// requests it received.
+type callbackReceiver struct {
+	t        *testing.T
+	key      []byte
+	statuses []int
+
+	mu       sync.Mutex
+	times    []time.Time
+	payloads []buildworker.CallbackPayload
+}
+
+func (cr *callbackReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		cr.t.Errorf("reading callback body: %v", err)
+	}
+	expected := buildworker.RequestSignature(cr.key, r.Method, r.URL.RequestURI(),
+		r.Header.Get(buildworker.TimestampHeader), r.Header.Get(buildworker.NonceHeader), body)
+	if sig := r.Header.Get(buildworker.SignatureHeader); !hmac.Equal([]byte(sig), []byte(expected)) {
+		cr.t.Errorf("callback has signature '%s', expected '%s'", sig, expected)
+	}
+	var payload buildworker.CallbackPayload
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		cr.t.Errorf("decoding callback payload: %v", err)
+	}
+
+	cr.times = append(cr.times, time.Now())
+	cr.payloads = append(cr.payloads, payload)
+	status := cr.statuses[len(cr.statuses)-1]
+	if len(cr.times) <= len(cr.statuses) {
+		status = cr.statuses[len(cr.times)-1]
+	}
+	w.WriteHeader(status)
+}
+
+// setUpCallbacks allows callbacks to the loopback address of
+// test servers, with a short backoff, for the duration of t.
+func setUpCallbacks(t *testing.T, backoff time.Duration) {
+	oldHosts, oldBackoff, oldSecret := callbackHosts, callbackBackoff, webhookSecret
+	oldDeliveries := callbackDeliveries
+	t.Cleanup(func() {
+		callbackHosts, callbackBackoff, webhookSecret = oldHosts, oldBackoff, oldSecret
+		callbackDeliveries = oldDeliveries
+	})
+	callbackHosts = []string{"127.0.0.1"}
+	callbackBackoff = backoff
+	webhookSecret = nil
+	callbackDeliveries = &deliveryLog{max: 10}
+}
+
+var testLogger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+func TestDeliverCallback(t *testing.T) {
+	setUpCallbacks(t, time.Millisecond)
+	key := []byte("client key")
+	client := APIClient{Name: "alice", HMACKey: base64.StdEncoding.EncodeToString(key)}
+	receiver := &callbackReceiver{t: t, key: key, statuses: []int{http.StatusOK}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	deliverCallback(testLogger, client, srv.URL+"/hook?x=1", buildworker.CallbackPayload{
+		JobID:  "job1",
+		Kind:   "build",
+		Status: "success",
+	})
+
+	if len(receiver.payloads) != 1 {
+		t.Fatalf("expected 1 callback, got %d", len(receiver.payloads))
+	}
+	if p := receiver.payloads[0]; p.JobID != "job1" || p.Kind != "build" || p.Status != "success" {
+		t.Errorf("unexpected payload: %+v", p)
+	}
+
+	deliveries := callbackDeliveries.get("job1", "alice")
+	if len(deliveries) != 1 {
+		t.Fatalf("expected 1 delivery in the log, got %d", len(deliveries))
+	}
+	if d := deliveries[0]; d.Attempt != 1 || d.StatusCode != http.StatusOK || d.Error != "" || d.URL != srv.URL+"/hook?x=1" {
+		t.Errorf("unexpected delivery: %+v", d)
+	}
+}
+
+func TestDeliverCallbackWebhookSecret(t *testing.T) {
+	setUpCallbacks(t, time.Millisecond)
+	webhookSecret = []byte("webhook secret")
+	receiver := &callbackReceiver{t: t, key: webhookSecret, statuses: []int{http.StatusNoContent}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	deliverCallback(testLogger, APIClient{Name: "bob"}, srv.URL, buildworker.CallbackPayload{JobID: "job2"})
+
+	if len(receiver.payloads) != 1 {
+		t.Fatalf("expected 1 callback, got %d", len(receiver.payloads))
+	}
+}
+
+func TestDeliverCallbackWithoutKey(t *testing.T) {
+	setUpCallbacks(t, time.Millisecond)
+	receiver := &callbackReceiver{t: t, statuses: []int{http.StatusOK}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	deliverCallback(testLogger, APIClient{Name: "bob"}, srv.URL, buildworker.CallbackPayload{JobID: "job3"})
+
+	if len(receiver.payloads) != 0 {
+		t.Errorf("expected no unsigned callbacks, got %d", len(receiver.payloads))
+	}
+}
+
+func TestDeliverCallbackRetries(t *testing.T) {
+	const backoff = 20 * time.Millisecond
+	setUpCallbacks(t, backoff)
+	key := []byte("client key")
+	client := APIClient{Name: "alice", HMACKey: base64.StdEncoding.EncodeToString(key)}
+	receiver := &callbackReceiver{t: t, key: key, statuses: []int{
+		http.StatusServiceUnavailable,
+		http.StatusInternalServerError,
+		http.StatusAccepted,
+	}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	deliverCallback(testLogger, client, srv.URL, buildworker.CallbackPayload{JobID: "job4"})
+
+	if len(receiver.times) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(receiver.times))
+	}
+	for i, wait := range []time.Duration{backoff, 2 * backoff} {
+		if got := receiver.times[i+1].Sub(receiver.times[i]); got < wait {
+			t.Errorf("attempt %d came %v after the previous one, expected at least %v", i+2, got, wait)
+		}
+	}
+
+	deliveries := callbackDeliveries.get("job4", "alice")
+	if len(deliveries) != 3 {
+		t.Fatalf("expected 3 deliveries in the log, got %d", len(deliveries))
+	}
+	for i, status := range []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusAccepted} {
+		d := deliveries[i]
+		if d.Attempt != i+1 || d.StatusCode != status {
+			t.Errorf("delivery %d: expected attempt %d with status %d, got %+v", i, i+1, status, d)
+		}
+		if (d.Error == "") != (status < 300) {
+			t.Errorf("delivery %d: unexpected error '%s'", i, d.Error)
+		}
+	}
+}
+
+func TestDeliverCallbackGivesUp(t *testing.T) {
+	setUpCallbacks(t, time.Millisecond)
+	key := []byte("client key")
+	client := APIClient{Name: "alice", HMACKey: base64.StdEncoding.EncodeToString(key)}
+	receiver := &callbackReceiver{t: t, key: key, statuses: []int{http.StatusBadGateway}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	deliverCallback(testLogger, client, srv.URL, buildworker.CallbackPayload{JobID: "job5"})
+
+	if len(receiver.times) != CallbackAttempts {
+		t.Errorf("expected %d attempts, got %d", CallbackAttempts, len(receiver.times))
+	}
+	if n := len(callbackDeliveries.get("job5", "alice")); n != CallbackAttempts {
+		t.Errorf("expected %d deliveries in the log, got %d", CallbackAttempts, n)
+	}
+}
+
+func TestDeliverCallbackToInternalAddress(t *testing.T) {
+	setUpCallbacks(t, time.Millisecond)
+	callbackHosts = nil
+	key := []byte("client key")
+	client := APIClient{Name: "alice", HMACKey: base64.StdEncoding.EncodeToString(key)}
+	receiver := &callbackReceiver{t: t, key: key, statuses: []int{http.StatusOK}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	deliverCallback(testLogger, client, srv.URL, buildworker.CallbackPayload{JobID: "job6"})
+
+	if len(receiver.times) != 0 {
+		t.Errorf("expected no callbacks to a loopback address, got %d", len(receiver.times))
+	}
+	deliveries := callbackDeliveries.get("job6", "alice")
+	if len(deliveries) == 0 || deliveries[0].Error == "" {
+		t.Errorf("expected failed deliveries in the log, got %+v", deliveries)
+	}
+}
+
+func TestDeliveryLog(t *testing.T) {
+	dl := &deliveryLog{max: 2}
+	dl.add("job1", "alice", Delivery{Attempt: 1})
+	dl.add("job1", "alice", Delivery{Attempt: 2})
+	dl.add("job2", "bob", Delivery{Attempt: 1})
+
+	if n := len(dl.get("job1", "alice")); n != 2 {
+		t.Errorf("expected 2 deliveries of job1, got %d", n)
+	}
+	if d := dl.get("job1", "bob"); d != nil {
+		t.Errorf("expected deliveries of job1 to be hidden from another client, got %+v", d)
+	}
+
+	dl.add("job3", "alice", Delivery{Attempt: 1})
+	if d := dl.get("job1", "alice"); d != nil {
+		t.Errorf("expected the oldest job to be evicted, got %+v", d)
+	}
+	if n := len(dl.get("job3", "alice")); n != 1 {
+		t.Errorf("expected 1 delivery of job3, got %d", n)
+	}
+}
+
+func TestCheckCallbackURL(t *testing.T) {
+	setUpCallbacks(t, time.Millisecond)
+	callbackHosts = nil
+	for _, u := range []string{
+		"ftp://example.com/hook",
+		"/hook",
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"http://[::1]/hook",
+		"http://10.1.2.3/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://100.100.100.200/",
+		"http://0.0.0.0/",
+	} {
+		if err := checkCallbackURL(context.Background(), u); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+	if err := checkCallbackURL(context.Background(), "https://93.184.215.14/hook"); err != nil {
+		t.Errorf("expected a public address to be allowed: %v", err)
+	}
+
+	callbackHosts = []string{"127.0.0.1", "hooks.example.com"}
+	if err := checkCallbackURL(context.Background(), "http://127.0.0.1:9000/hook"); err != nil {
+		t.Errorf("expected an allowed host to be allowed: %v", err)
+	}
+	if err := checkCallbackURL(context.Background(), "https://93.184.215.14/hook"); err == nil {
+		t.Errorf("expected hosts that are not allowed to be refused")
+	}
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// Config is the configuration of the build worker. It is
+// read from a JSON file, then overridden by environment
+// variables, then by command line flags.
+type Config struct {
+	// Addr is the address (host:port) to listen on.
+	Addr string `json:"addr"`
+
+	// ClientsFile is the file that API clients are
+	// loaded from (see APIClient).
+	ClientsFile string `json:"clients_file"`
+
+	Signing  SigningSettings `json:"signing"`
+	TLS      TLSSettings     `json:"tls"`
+	Timeouts Timeouts        `json:"timeouts"`
+
+	// MasterGopath is the master GOPATH. If empty,
+	// the GOPATH environment variable is used.
+	MasterGopath string `json:"master_gopath"`
+
+	// TempDir is where temporary GOPATHs, backups,
+	// and build results are made. If empty, the
+	// system's temporary folder is used.
+	TempDir string `json:"temp_dir"`
+
+	// Toolchains are the GOROOTs of the Go toolchains that
+	// requests can select by version, in addition to the
+	// go command on the PATH, which is used by default.
+	Toolchains []string `json:"toolchains"`
+
+	// ParallelBuildOps is the `go build -p` value.
+	ParallelBuildOps int `json:"parallel_build_ops"`
+
+	// ParallelPlatformBuilds is how many platforms a
+	// bundle build compiles at the same time.
+	ParallelPlatformBuilds int `json:"parallel_platform_builds"`
+
+	// MaxBodyBytes is the maximum size allowed for
+	// request bodies.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+
+	// MaxQueryStringLength is the maximum query string
+	// length allowed by requests.
+	MaxQueryStringLength int `json:"max_query_string_length"`
+
+	// UnsupportedPlatforms are the platforms not to build
+	// for; empty fields match any value.
+	UnsupportedPlatforms []buildworker.Platform `json:"unsupported_platforms"`
+
+	// PlatformMatrix is the file with the platform matrix
+	// (see buildworker.PlatformMatrix). If empty, the
+	// default matrix is used.
+	PlatformMatrix string `json:"platform_matrix"`
+
+	// ProbeFile is where the result of probing platforms
+	// is saved; platforms that failed the probe are not
+	// built for.
+	ProbeFile string `json:"probe_file"`
+
+	// Target is the program that is built and
+	// deployed; Caddy by default.
+	Target buildworker.Target `json:"target"`
+
+	// AuditLog is the file to record deploys and master
+	// GOPATH changes in, rotated once it grows larger
+	// than AuditLogMaxSizeMB (0 to never rotate).
+	AuditLog          string `json:"audit_log"`
+	AuditLogMaxSizeMB int64  `json:"audit_log_max_size_mb"`
+
+	// MinFreeDiskMB is the free disk space, in megabytes,
+	// required in the temporary folder and the master
+	// GOPATH for the worker to report ready.
+	MinFreeDiskMB uint64 `json:"min_free_disk_mb"`
+
+	// ArtifactDir is where the results of background builds
+	// are kept, for ArtifactTTL. If empty, a folder in
+	// TempDir is used.
+	ArtifactDir string   `json:"artifact_dir"`
+	ArtifactTTL Duration `json:"artifact_ttl"`
+
+	// MaxBackgroundJobs is how many jobs with a callback
+	// may run at the same time; more are refused.
+	MaxBackgroundJobs int `json:"max_background_jobs"`
+
+	Callbacks CallbackSettings `json:"callbacks"`
+
+	// CACertificates is the CA certificate bundle (PEM) to
+	// put in container images. If empty, the system's is used.
+	CACertificates string `json:"ca_certificates"`
+
+	// DeniedLicenses are the SPDX identifiers of licenses
+	// that plugins and their dependencies must not have to
+	// be deployed; "NOASSERTION" denies undetected licenses.
+	DeniedLicenses []string `json:"denied_licenses"`
+
+	// AdvisoryDB is the folder of the advisory database (OSV
+	// JSON files) that dependencies are checked against; if
+	// empty, they are not checked. VulnerabilityPolicy is
+	// "fail" to fail checks of vulnerable dependencies, or
+	// "warn" to only report them.
+	AdvisoryDB          string `json:"advisory_db"`
+	VulnerabilityPolicy string `json:"vulnerability_policy"`
+
+	// ForbiddenImports are the packages that plugins must not
+	// import. AnalysisSeverity sets the severity of the rules
+	// of the static analysis of plugins, by name: "error",
+	// "warning", or "off"; rules not set keep their defaults.
+	ForbiddenImports []string          `json:"forbidden_imports"`
+	AnalysisSeverity map[string]string `json:"analysis_severity"`
+
+	// SmokeTest enables running built binaries (of this
+	// system's platform, or with an emulator set in the
+	// platform matrix) to check their version and plugins
+	// before they are archived and signed.
+	SmokeTest bool `json:"smoke_test"`
+
+	// ReleaseDir is where releases are made, in a
+	// folder named after the version of each.
+	ReleaseDir string `json:"release_dir"`
+
+	// PublicURL is the base URL of this server as reachable
+	// by clients, if it can't be inferred from requests.
+	PublicURL string `json:"public_url"`
+}
+
+// SigningSettings configure the signing of builds
+// and the verification of request signatures.
+type SigningSettings struct {
+	KeyFile      string `json:"key_file"`      // PGP private key (ASCII-armored)
+	PasswordFile string `json:"password_file"` // password of the key, if encrypted
+
+	// RequireSignatures rejects unsigned deploy requests,
+	// even from clients without a signing key.
+	RequireSignatures bool `json:"require_signatures"`
+}
+
+// CallbackSettings configure the callbacks of
+// background jobs.
+type CallbackSettings struct {
+	// SecretFile has the secret that signs callbacks to
+	// clients that have no signing key of their own. If
+	// empty, such clients can't request callbacks.
+	SecretFile string `json:"secret_file"`
+
+	// AllowedHosts, if not empty, are the only hosts that
+	// callbacks may be sent to, and they may have internal
+	// addresses. Otherwise, callbacks may be sent to any
+	// host without a loopback, private, or link-local
+	// address.
+	AllowedHosts []string `json:"allowed_hosts"`
+}
+
+// TLSSettings configure HTTPS. If CertFile is empty,
+// the worker serves plain HTTP.
+type TLSSettings struct {
+	CertFile          string `json:"cert_file"`
+	KeyFile           string `json:"key_file"`
+	ClientCAFile      string `json:"client_ca_file"`
+	RequireClientCert bool   `json:"require_client_cert"`
+}
+
+// Timeouts limit how long things may take. Zero
+// means no limit.
+type Timeouts struct {
+	// Command is how long any one command run in
+	// a build environment may take.
+	Command Duration `json:"command"`
+
+	// ReadHeader, Read, Write, and Idle configure the
+	// HTTP server. Builds are streamed in responses, so
+	// Write must allow for the longest build.
+	ReadHeader Duration `json:"read_header"`
+	Read       Duration `json:"read"`
+	Write      Duration `json:"write"`
+	Idle       Duration `json:"idle"`
+}
+
+// Duration is a time.Duration that is written
+// in JSON as a string like "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON satisfies json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON satisfies json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\"")
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// defaultConfig returns the configuration
+// used when nothing else is specified.
+func defaultConfig() Config {
+	return Config{
+		Addr:        "127.0.0.1:2017",
+		ClientsFile: defaultClientsFile,
+		Signing: SigningSettings{
+			KeyFile:      defaultSigningKeyFile,
+			PasswordFile: defaultKeyPasswordFile,
+		},
+		Timeouts: Timeouts{
+			ReadHeader: Duration{10 * time.Second},
+			Idle:       Duration{2 * time.Minute},
+		},
+		ParallelBuildOps:       buildworker.ParallelBuildOps,
+		ParallelPlatformBuilds: buildworker.ParallelPlatformBuilds,
+		MaxBodyBytes:           10 * 1024 * 1024,
+		MaxQueryStringLength:   100 * 1024,
+		UnsupportedPlatforms:   buildworker.UnsupportedPlatforms,
+		Target:                 buildworker.Caddy,
+		ProbeFile:              "supported_platforms.json",
+		AuditLog:               "audit.log",
+		AuditLogMaxSizeMB:      100,
+		MinFreeDiskMB:          1024,
+		ArtifactTTL:            Duration{24 * time.Hour},
+		MaxBackgroundJobs:      defaultMaxBackgroundJobs,
+		VulnerabilityPolicy:    buildworker.VulnerabilityPolicy,
+		ForbiddenImports:       buildworker.ForbiddenImports,
+		AnalysisSeverity:       defaultAnalysisSeverity(),
+		ReleaseDir:             "releases",
+	}
+}
+
+// loadConfig reads the configuration file at path (if not
+// empty) into cfg, then applies overrides from environment
+// variables and from the command line flags that were set,
+// and validates the result.
+func loadConfig(path string) error {
+	// flags point into cfg, so remember the ones that were
+	// set in order to set them again after the file is read
+	setFlags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	cfg = defaultConfig()
+
+	if path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading config file: %v", err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(contents))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	for _, o := range envOverrides() {
+		val := os.Getenv(o.env)
+		if val == "" {
+			continue
+		}
+		err := setFromString(o.dest, val)
+		if err != nil {
+			return fmt.Errorf("environment variable %s: %v", o.env, err)
+		}
+	}
+
+	for name, val := range setFlags {
+		err := flag.Set(name, val)
+		if err != nil {
+			return fmt.Errorf("flag -%s: %v", name, err)
+		}
+	}
+
+	err := cfg.validate()
+	if err != nil {
+		return err
+	}
+
+	buildworker.Toolchains = make(map[string]string)
+	for _, goroot := range cfg.Toolchains {
+		_, err := buildworker.RegisterToolchain(goroot)
+		if err != nil {
+			return err
+		}
+	}
+
+	matrix = buildworker.DefaultMatrix
+	if cfg.PlatformMatrix != "" {
+		matrix, err = buildworker.LoadPlatformMatrix(cfg.PlatformMatrix)
+		if err != nil {
+			return fmt.Errorf("loading platform matrix: %v", err)
+		}
+	}
+	return nil
+}
+
+// envOverride is an environment variable that,
+// if set, overrides the setting at dest.
+type envOverride struct {
+	env  string
+	dest interface{}
+}
+
+// envOverrides returns the environment variables that
+// override settings in cfg. Later ones take precedence.
+func envOverrides() []envOverride {
+	return []envOverride{
+		{"BUILDWORKER_ADDR", &cfg.Addr},
+		{"BUILDWORKER_CLIENTS_FILE", &cfg.ClientsFile},
+		{"SIGNING_KEY_FILE", &cfg.Signing.KeyFile},
+		{"BUILDWORKER_SIGNING_KEY_FILE", &cfg.Signing.KeyFile},
+		{"KEY_PASSWORD_FILE", &cfg.Signing.PasswordFile},
+		{"BUILDWORKER_KEY_PASSWORD_FILE", &cfg.Signing.PasswordFile},
+		{"BUILDWORKER_REQUIRE_SIGNATURES", &cfg.Signing.RequireSignatures},
+		{"BUILDWORKER_TLS_CERT_FILE", &cfg.TLS.CertFile},
+		{"BUILDWORKER_TLS_KEY_FILE", &cfg.TLS.KeyFile},
+		{"BUILDWORKER_TLS_CLIENT_CA_FILE", &cfg.TLS.ClientCAFile},
+		{"BUILDWORKER_MASTER_GOPATH", &cfg.MasterGopath},
+		{"BUILDWORKER_TEMP_DIR", &cfg.TempDir},
+		{"BUILDWORKER_PARALLEL_BUILD_OPS", &cfg.ParallelBuildOps},
+		{"BUILDWORKER_PARALLEL_PLATFORM_BUILDS", &cfg.ParallelPlatformBuilds},
+		{"BUILDWORKER_PLATFORM_MATRIX", &cfg.PlatformMatrix},
+		{"BUILDWORKER_PROBE_FILE", &cfg.ProbeFile},
+		{"BUILDWORKER_MAX_BODY_BYTES", &cfg.MaxBodyBytes},
+		{"BUILDWORKER_COMMAND_TIMEOUT", &cfg.Timeouts.Command},
+		{"BUILDWORKER_AUDIT_LOG", &cfg.AuditLog},
+		{"BUILDWORKER_ARTIFACT_DIR", &cfg.ArtifactDir},
+		{"BUILDWORKER_MAX_BACKGROUND_JOBS", &cfg.MaxBackgroundJobs},
+		{"BUILDWORKER_WEBHOOK_SECRET_FILE", &cfg.Callbacks.SecretFile},
+		{"BUILDWORKER_CALLBACK_HOSTS", &cfg.Callbacks.AllowedHosts},
+		{"BUILDWORKER_RELEASE_DIR", &cfg.ReleaseDir},
+		{"BUILDWORKER_CA_CERTIFICATES", &cfg.CACertificates},
+		{"BUILDWORKER_DENIED_LICENSES", &cfg.DeniedLicenses},
+		{"BUILDWORKER_ADVISORY_DB", &cfg.AdvisoryDB},
+		{"BUILDWORKER_VULNERABILITY_POLICY", &cfg.VulnerabilityPolicy},
+		{"BUILDWORKER_FORBIDDEN_IMPORTS", &cfg.ForbiddenImports},
+		{"BUILDWORKER_SMOKE_TEST", &cfg.SmokeTest},
+		{"BUILDWORKER_PUBLIC_URL", &cfg.PublicURL},
+	}
+}
+
+// setFromString parses val into the setting at dest.
+func setFromString(dest interface{}, val string) error {
+	var err error
+	switch d := dest.(type) {
+	case *string:
+		*d = val
+	case *bool:
+		*d, err = strconv.ParseBool(val)
+	case *int:
+		*d, err = strconv.Atoi(val)
+	case *int64:
+		*d, err = strconv.ParseInt(val, 10, 64)
+	case *Duration:
+		d.Duration, err = time.ParseDuration(val)
+	case *[]string:
+		*d = nil
+		for _, s := range strings.Split(val, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*d = append(*d, s)
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported setting type %T", dest)
+	}
+	return err
+}
+
+// validate returns an error describing every
+// problem with c, if there are any.
+func (c Config) validate() error {
+	var problems []string
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		problem("addr: %v", err)
+	}
+	if c.ClientsFile == "" {
+		problem("clients_file: must not be empty")
+	}
+	if c.TLS.CertFile != "" && c.TLS.KeyFile == "" {
+		problem("tls: key_file is required with cert_file")
+	}
+	if c.TLS.CertFile == "" && (c.TLS.KeyFile != "" || c.TLS.ClientCAFile != "") {
+		problem("tls: cert_file is required to serve HTTPS")
+	}
+	if c.TLS.RequireClientCert && c.TLS.ClientCAFile == "" {
+		problem("tls: client_ca_file is required to require client certificates")
+	}
+	for name, d := range map[string]Duration{
+		"command":     c.Timeouts.Command,
+		"read_header": c.Timeouts.ReadHeader,
+		"read":        c.Timeouts.Read,
+		"write":       c.Timeouts.Write,
+		"idle":        c.Timeouts.Idle,
+	} {
+		if d.Duration < 0 {
+			problem("timeouts.%s: must not be negative", name)
+		}
+	}
+	if c.MasterGopath == "" && os.Getenv("GOPATH") == "" {
+		problem("master_gopath: must be set if the GOPATH environment variable is not")
+	}
+	if c.TempDir != "" && !isDir(c.TempDir) {
+		problem("temp_dir: %s is not a folder", c.TempDir)
+	}
+	if c.ParallelBuildOps < 1 {
+		problem("parallel_build_ops: must be at least 1")
+	}
+	if c.ParallelPlatformBuilds < 1 {
+		problem("parallel_platform_builds: must be at least 1")
+	}
+	if c.MaxBodyBytes < 1 {
+		problem("max_body_bytes: must be at least 1")
+	}
+	if c.MaxQueryStringLength < 0 {
+		problem("max_query_string_length: must not be negative")
+	}
+	for i, p := range c.UnsupportedPlatforms {
+		if p.OS == "" && p.Arch == "" && p.ARM == "" {
+			problem("unsupported_platforms[%d]: would match all platforms", i)
+		}
+	}
+	if err := c.Target.Validate(); err != nil {
+		problem("target: %v", err)
+	}
+	if c.ProbeFile == "" {
+		problem("probe_file: must not be empty")
+	}
+	if c.AuditLog == "" {
+		problem("audit_log: must not be empty")
+	}
+	if c.AuditLogMaxSizeMB < 0 {
+		problem("audit_log_max_size_mb: must not be negative")
+	}
+	if c.ArtifactTTL.Duration <= 0 {
+		problem("artifact_ttl: must be positive")
+	}
+	if c.MaxBackgroundJobs < 1 {
+		problem("max_background_jobs: must be at least 1")
+	}
+	for i, host := range c.Callbacks.AllowedHosts {
+		if host == "" || strings.ContainsAny(host, "/ \t") {
+			problem("callbacks.allowed_hosts[%d]: must be a host name or IP address", i)
+		}
+	}
+	if c.CACertificates != "" {
+		if _, err := os.Stat(c.CACertificates); err != nil {
+			problem("ca_certificates: %v", err)
+		}
+	}
+	for i, license := range c.DeniedLicenses {
+		if license == "" || strings.ContainsAny(license, " \t") {
+			problem("denied_licenses[%d]: must be an SPDX license identifier", i)
+		}
+	}
+	if c.AdvisoryDB != "" && !isDir(c.AdvisoryDB) {
+		problem("advisory_db: %s is not a folder", c.AdvisoryDB)
+	}
+	if c.VulnerabilityPolicy != "fail" && c.VulnerabilityPolicy != "warn" {
+		problem("vulnerability_policy: must be fail or warn")
+	}
+	for i, pkg := range c.ForbiddenImports {
+		if pkg == "" || strings.ContainsAny(pkg, " \t") {
+			problem("forbidden_imports[%d]: must be an import path", i)
+		}
+	}
+	for rule, severity := range c.AnalysisSeverity {
+		if !isAnalyzer(rule) {
+			problem("analysis_severity: unknown rule %s", rule)
+		}
+		if severity != "error" && severity != "warning" && severity != "off" {
+			problem("analysis_severity.%s: must be error, warning, or off", rule)
+		}
+	}
+	if c.ReleaseDir == "" {
+		problem("release_dir: must not be empty")
+	}
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("public_url: must be an absolute HTTP(S) URL")
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// apply puts c into effect.
+func (c Config) apply() {
+	buildworker.MasterGopath = c.MasterGopath
+	buildworker.TempDir = c.TempDir
+	buildworker.ParallelBuildOps = c.ParallelBuildOps
+	buildworker.ParallelPlatformBuilds = c.ParallelPlatformBuilds
+	buildworker.CommandTimeout = c.Timeouts.Command.Duration
+	buildworker.UnsupportedPlatforms = c.UnsupportedPlatforms
+	buildworker.Matrix = matrix
+	buildworker.DefaultTarget = c.Target
+	buildworker.CACertificates = c.CACertificates
+	buildworker.DeniedLicenses = c.DeniedLicenses
+	buildworker.AdvisoryDB = c.AdvisoryDB
+	buildworker.VulnerabilityPolicy = c.VulnerabilityPolicy
+	buildworker.ForbiddenImports = c.ForbiddenImports
+	buildworker.AnalysisSeverity = c.AnalysisSeverity
+	buildworker.SmokeTest = c.SmokeTest
+
+	apiClients.file = c.ClientsFile
+	requireSignatures = c.Signing.RequireSignatures
+
+	serverTLS.certFile = c.TLS.CertFile
+	serverTLS.keyFile = c.TLS.KeyFile
+	serverTLS.clientCAFile = c.TLS.ClientCAFile
+	serverTLS.requireClientCert = c.TLS.RequireClientCert
+
+	artifacts.dir = c.ArtifactDir
+	if artifacts.dir == "" {
+		artifacts.dir = filepath.Join(tempDir(), "buildworker_artifacts")
+	}
+	artifacts.ttl = c.ArtifactTTL.Duration
+	backgroundJobs = make(chan struct{}, c.MaxBackgroundJobs)
+	callbackHosts = c.Callbacks.AllowedHosts
+	publicBaseURL = c.PublicURL
+}
+
+// checkConfig is the `config check` subcommand: it loads
+// the configuration and everything it refers to, and
+// reports any problems without starting the server.
+func checkConfig(path string) error {
+	err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	cfg.apply()
+
+	err = apiClients.load()
+	if err != nil {
+		return fmt.Errorf("loading API clients from %s: %v", cfg.ClientsFile, err)
+	}
+	if cfg.TLS.CertFile != "" {
+		err = serverTLS.load()
+		if err != nil {
+			return err
+		}
+	}
+	err = loadSigningKey(cfg.Signing.KeyFile, cfg.Signing.PasswordFile)
+	if err != nil {
+		return err
+	}
+	err = loadWebhookSecret(cfg.Callbacks.SecretFile)
+	if err != nil {
+		return err
+	}
+
+	effective, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", effective)
+	return nil
+}
+
+// tempDir returns the folder in which
+// temporary files are made.
+func tempDir() string {
+	if cfg.TempDir != "" {
+		return cfg.TempDir
+	}
+	return os.TempDir()
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// defaultAnalysisSeverity returns a copy of the default
+// severities of the rules of the static analysis, so that
+// the configuration file can change some of them.
+func defaultAnalysisSeverity() map[string]string {
+	severity := make(map[string]string, len(buildworker.AnalysisSeverity))
+	for rule, s := range buildworker.AnalysisSeverity {
+		severity[rule] = s
+	}
+	return severity
+}
+
+// isAnalyzer returns whether rule is the
+// name of one of the analyzers of plugins.
+func isAnalyzer(rule string) bool {
+	for _, a := range buildworker.Analyzers {
+		if a.Name == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultMaxBackgroundJobs is the default
+// of max_background_jobs.
+const defaultMaxBackgroundJobs = 16
+
+var (
+	// cfg is the configuration in effect.
+	cfg = defaultConfig()
+
+	// matrix is the platform matrix loaded
+	// according to the configuration.
+	matrix = buildworker.DefaultMatrix
+)
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// healthCheck is the result of one readiness check.
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "OK")
+}
+
+// readyzHandler reports whether the worker is able to
+// build right now, along with the result of each check.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]healthCheck)
+	ready := true
+	check := func(name string, detail string, err error) {
+		if err != nil {
+			checks[name] = healthCheck{Detail: err.Error()}
+			ready = false
+			return
+		}
+		checks[name] = healthCheck{OK: true, Detail: detail}
+	}
+
+	version, err := buildworker.ToolchainVersion("")
+	check("go", version, err)
+
+	// every toolchain that requests can select must still
+	// work and be the version it was registered as
+	for _, v := range buildworker.InstalledToolchains() {
+		goroot, _ := buildworker.LookupToolchain(v)
+		version, err := buildworker.ToolchainVersion(v)
+		if err == nil && version != v {
+			err = fmt.Errorf("toolchain in %s is now %s", goroot, version)
+		}
+		check("toolchain_"+v, goroot, err)
+	}
+
+	out, err := exec.Command("git", "--version").Output()
+	check("git", strings.TrimSpace(string(out)), err)
+
+	masterGopath := buildworker.MasterGopathDir()
+	check("master_gopath", masterGopath, buildworker.CheckMasterGopath(masterGopath))
+
+	err = nil
+	if buildworker.MasterGopathLocked(masterGopath) {
+		err = fmt.Errorf("master GOPATH is locked for writing (update or restore in progress)")
+	}
+	check("master_gopath_lock", "unlocked", err)
+
+	err = nil
+	if buildworker.Signer == nil {
+		err = fmt.Errorf("no signing key loaded")
+	} else if buildworker.Signer.PrivateKey == nil || buildworker.Signer.PrivateKey.Encrypted {
+		err = fmt.Errorf("signing key is not decrypted")
+	}
+	check("signer", "", err)
+
+	for name, dir := range map[string]string{
+		"disk_temp":          tempDir(),
+		"disk_master_gopath": masterGopath,
+	} {
+		free, err := freeDiskSpace(dir)
+		if err == nil && free < cfg.MinFreeDiskMB*1024*1024 {
+			err = fmt.Errorf("only %d MB free in %s; need %d MB", free/1024/1024, dir, cfg.MinFreeDiskMB)
+		}
+		check(name, fmt.Sprintf("%d MB free in %s", free/1024/1024, dir), err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Ready  bool                   `json:"ready"`
+		Checks map[string]healthCheck `json:"checks"`
+	}{ready, checks})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// jobResult is the outcome of a build or deploy job.
+type jobResult struct {
+	status            int    // HTTP status to respond with, if the job failed
+	msg               string // what failed, if anything
+	err               error
+	log               string
+	resolved          map[string]string
+	report            *buildworker.CheckReport
+	manifest          *buildworker.BuildManifest
+	manifestSignature []byte // of the manifest as JSON
+	bundle            *buildworker.BuildBundle
+	release           *buildworker.ReleaseManifest
+	vulnReport        *buildworker.VulnReport
+	artifacts         map[string]string // file name to URL
+}
+
+// deployJob opens a build environment with the given version
+// of the target and plugins, and deploys. Deploying with plugins
+// deploys the (one) plugin; otherwise the target is deployed.
+func deployJob(r *http.Request, caddyVersion string, plugins []buildworker.CaddyPlugin, requiredPlatforms []buildworker.Platform, goVersion string) jobResult {
+	opts := buildEnvOptions(r)
+	opts.GoVersion = goVersion
+	be, err := buildworker.OpenWithOptions(caddyVersion, plugins, opts)
+	if err != nil {
+		return jobResult{status: http.StatusBadRequest, msg: "setting up deploy environment", err: err, log: be.Log.String()}
+	}
+	defer be.Close()
+
+	pkg, version := buildworker.DefaultTarget.Package, caddyVersion
+	if len(plugins) > 0 {
+		pkg, version = plugins[0].Package, plugins[0].Version
+	}
+
+	start := time.Now()
+	err = be.Deploy(requiredPlatforms)
+	res := jobResult{log: be.Log.String(), report: be.Report}
+	res.resolved, _ = be.ResolvedVersions()
+	if err != nil {
+		res.status = http.StatusBadRequest
+		res.msg = "deploying " + pkg
+		res.err = err
+		return res
+	}
+	requestLogger(r).Info("deployed", "package", pkg, "version", version,
+		"phase", "deploy", "duration", time.Since(start))
+	return res
+}
+
+// buildJob builds cfg for plat into the folder dir and signs
+// the resulting archive. It returns the path to the archive
+// and its signature; the result has the build's manifest.
+func buildJob(r *http.Request, cfg buildworker.BuildConfig, plat buildworker.Platform, dir string) (string, *bytes.Buffer, jobResult) {
+	// TODO: This does a deep copy of all plugins including their
+	// testdata folders and test files. We might be able to
+	// add parameters to an alternate Open function so that it can be configured
+	// to only copy certain things if we want it to...
+	opts := buildEnvOptions(r)
+	opts.GoVersion = cfg.GoVersion
+	opts.Format = cfg.Format
+	opts.Image = cfg.Image
+	be, err := buildworker.OpenWithOptions(cfg.CaddyVersion, cfg.Plugins, opts)
+	if err != nil {
+		return "", nil, jobResult{status: http.StatusBadRequest, msg: "creating build env", err: err, log: be.Log.String()}
+	}
+	defer be.Close()
+
+	start := time.Now()
+	outputFile, err := be.Build(plat, dir)
+	res := jobResult{log: be.Log.String()}
+	res.resolved, _ = be.ResolvedVersions()
+	if err != nil {
+		res.status = http.StatusBadRequest
+		res.msg = "build"
+		res.err = err
+		return "", nil, res
+	}
+	defer outputFile.Close()
+	requestLogger(r).Info("built", "version", cfg.CaddyVersion, "platform", plat.String(),
+		"phase", "build", "duration", time.Since(start))
+
+	manifest, err := be.Manifest(plat, outputFile.Name())
+	if err != nil {
+		res.status = http.StatusInternalServerError
+		res.msg = "making manifest"
+		res.err = err
+		return "", nil, res
+	}
+	res.manifest = &manifest
+
+	signature, err := buildworker.Sign(outputFile)
+	if err != nil {
+		res.status = http.StatusInternalServerError
+		res.msg = "signing archive"
+		res.err = err
+		return "", nil, res
+	}
+
+	// the manifest is signed too, so that what it says about
+	// the build (such as the image digest) can be trusted
+	manifestSig, err := buildworker.SignManifest(manifest)
+	if err != nil {
+		res.status = http.StatusInternalServerError
+		res.msg = "signing manifest"
+		res.err = err
+		return "", nil, res
+	}
+	res.manifestSignature = manifestSig.Bytes()
+
+	return outputFile.Name(), signature, res
+}
+
+// backgroundBuild performs a build job after the request has
+// been responded to, keeps the result in the artifact store,
+// and notifies callbackURL when done.
+func backgroundBuild(r *http.Request, callbackURL string, cfg buildworker.BuildConfig, plat buildworker.Platform) {
+	tmpdir, err := os.MkdirTemp(tempDir(), "caddy_build_")
+	if err != nil {
+		notify(r, callbackURL, "build", jobResult{msg: "getting temporary directory", err: err}, "", "")
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	archivePath, signature, res := buildJob(r, cfg, plat, tmpdir)
+	if res.err != nil {
+		notify(r, callbackURL, "build", res, "", "")
+		return
+	}
+
+	job := jobFromRequest(r)
+	archiveURL, err := artifacts.save(job, archivePath)
+	if err == nil {
+		var sigURL string
+		sigURL, err = artifacts.saveBytes(job, filepath.Base(archivePath)+".asc", signature.Bytes())
+		res.artifacts = make(map[string]string)
+		if err == nil && res.manifest.SBOM != "" {
+			var sbomURL string
+			sbomURL, err = artifacts.save(job, buildworker.SBOMPath(archivePath))
+			res.artifacts[res.manifest.SBOM] = publicURL(r, sbomURL)
+		}
+		if err == nil && res.manifest.Image != "" {
+			var imageURL string
+			imageURL, err = artifacts.save(job, buildworker.ImagePath(archivePath))
+			res.artifacts[res.manifest.Image] = publicURL(r, imageURL)
+		}
+		if err == nil {
+			notify(r, callbackURL, "build", res, publicURL(r, archiveURL), publicURL(r, sigURL))
+			return
+		}
+	}
+	notify(r, callbackURL, "build", jobResult{msg: "storing artifacts", err: err, resolved: res.resolved}, "", "")
+}
+
+// notify delivers the outcome of the job of r to callbackURL.
+// It returns once delivery succeeded or was given up on, so
+// that the job keeps its slot (see accept) until then.
+func notify(r *http.Request, callbackURL, kind string, res jobResult, artifactURL, signatureURL string) {
+	payload := buildworker.CallbackPayload{
+		JobID:        jobFromRequest(r).id,
+		Kind:         kind,
+		Status:       "success",
+		Resolved:     res.resolved,
+		CheckReport:  res.report,
+		Manifest:     res.manifest,
+		ArtifactURL:  artifactURL,
+		SignatureURL: signatureURL,
+		Bundle:       res.bundle,
+		Artifacts:    res.artifacts,
+		Release:      res.release,
+		VulnReport:   res.vulnReport,
+	}
+	if res.err != nil {
+		requestLogger(r).Error(res.msg, "error", res.err)
+		payload.Status = "failure"
+		payload.Error = res.err.Error()
+	}
+	client, _ := clientFromRequest(r)
+	deliverCallback(requestLogger(r), client, callbackURL, payload)
+}
+
+// accept runs job, which notifies callbackURL when done, in the
+// background, and responds that the job of r was accepted. The
+// job is refused if callbackURL may not receive callbacks, if
+// callbacks to the client could not be signed, or if too many
+// background jobs are running already.
+func accept(w http.ResponseWriter, r *http.Request, callbackURL string, job func()) {
+	err := checkCallbackURL(r.Context(), callbackURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client, _ := clientFromRequest(r)
+	if _, err := callbackKey(client); err != nil {
+		requestLogger(r).Warn("refusing callback", "error", err)
+		http.Error(w, "callbacks require a signing key, and this client has none", http.StatusBadRequest)
+		return
+	}
+
+	slots := backgroundJobs // the slot is freed where it was taken
+	select {
+	case slots <- struct{}{}:
+	default:
+		http.Error(w, "too many background jobs; try again later", http.StatusServiceUnavailable)
+		return
+	}
+	go func() {
+		defer func() { <-slots }()
+		job()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(struct{ JobID string }{jobFromRequest(r).id})
+}
+
+// backgroundJobs has a slot for each background
+// job that may run at the same time.
+var backgroundJobs = make(chan struct{}, defaultMaxBackgroundJobs)
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newJobRequest returns a request of a job with
+// the given ID by client, as authenticated.
+func newJobRequest(method, target, jobID string, client APIClient) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	ctx := context.WithValue(r.Context(), jobCtxKey, &jobInfo{id: jobID, client: client.Name})
+	ctx = context.WithValue(ctx, clientCtxKey, client)
+	return r.WithContext(ctx)
+}
+
+func TestAccept(t *testing.T) {
+	setUpCallbacks(t, time.Millisecond)
+	oldJobs := backgroundJobs
+	t.Cleanup(func() { backgroundJobs = oldJobs })
+	backgroundJobs = make(chan struct{}, 1)
+
+	key := []byte("client key")
+	client := APIClient{Name: "alice", HMACKey: base64.StdEncoding.EncodeToString(key)}
+	receiver := &callbackReceiver{t: t, key: key, statuses: []int{http.StatusOK}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	r := newJobRequest("POST", "/build", "job1", client)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	release := make(chan struct{})
+	accept(w, r, srv.URL, func() {
+		<-release
+		notify(r, srv.URL, "build", jobResult{}, "", "")
+		close(done)
+	})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, w.Code, w.Body)
+	}
+	var resp struct{ JobID string }
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.JobID != "job1" {
+		t.Errorf("expected job ID job1, got '%s'", resp.JobID)
+	}
+
+	// the one slot is taken until the job is done
+	w = httptest.NewRecorder()
+	accept(w, newJobRequest("POST", "/build", "job2", client), srv.URL, func() {
+		t.Error("job ran without a free slot")
+	})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d with no free slot, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	close(release)
+	<-done
+	if len(receiver.payloads) != 1 || receiver.payloads[0].JobID != "job1" || receiver.payloads[0].Kind != "build" {
+		t.Errorf("unexpected callbacks: %+v", receiver.payloads)
+	}
+	if n := len(callbackDeliveries.get("job1", "alice")); n != 1 {
+		t.Errorf("expected 1 delivery in the log, got %d", n)
+	}
+}
+
+func TestAcceptRefusals(t *testing.T) {
+	setUpCallbacks(t, time.Millisecond)
+	oldJobs := backgroundJobs
+	t.Cleanup(func() { backgroundJobs = oldJobs })
+	backgroundJobs = make(chan struct{}, 1)
+
+	withKey := APIClient{Name: "alice", HMACKey: base64.StdEncoding.EncodeToString([]byte("key"))}
+	for i, test := range []struct {
+		client      APIClient
+		callbackURL string
+		expect      string
+	}{
+		{withKey, "not a url", "invalid callback URL"},
+		{withKey, "http://internal.example.com/hook", "not allowed"},
+		{APIClient{Name: "bob"}, "http://127.0.0.1/hook", "signing key"},
+	} {
+		w := httptest.NewRecorder()
+		accept(w, newJobRequest("POST", "/build", "job", test.client), test.callbackURL, func() {
+			t.Errorf("test %d: job ran", i)
+		})
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), test.expect) {
+			t.Errorf("test %d: expected status %d with '%s', got %d: %s",
+				i, http.StatusBadRequest, test.expect, w.Code, w.Body)
+		}
+	}
+}
+
+func TestNotifyFailure(t *testing.T) {
+	setUpCallbacks(t, time.Millisecond)
+	webhookSecret = []byte("webhook secret")
+	receiver := &callbackReceiver{t: t, key: webhookSecret, statuses: []int{http.StatusOK}}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	r := newJobRequest("POST", "/deploy-plugin", "job1", APIClient{Name: "bob"})
+	notify(r, srv.URL, "deploy-plugin", jobResult{
+		msg:      "deploying",
+		err:      errTest,
+		resolved: map[string]string{"example.com/plugin": "abc"},
+	}, "", "")
+
+	if len(receiver.payloads) != 1 {
+		t.Fatalf("expected 1 callback, got %d", len(receiver.payloads))
+	}
+	p := receiver.payloads[0]
+	if p.Status != "failure" || p.Error != errTest.Error() || p.Resolved["example.com/plugin"] != "abc" {
+		t.Errorf("unexpected payload: %+v", p)
+	}
+}
+
+var errTest = errors.New("test failure")
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// jobInfo identifies the job a request belongs to. The
+// client is filled in once the request is authenticated.
+type jobInfo struct {
+	id     string
+	client string
+}
+
+// jobHandler assigns a job ID to each request, returns it
+// to the client in a response header, and logs the request
+// once it has been handled.
+func jobHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job := &jobInfo{id: newJobID()}
+		w.Header().Set(JobIDHeader, job.id)
+		r = r.WithContext(context.WithValue(r.Context(), jobCtxKey, job))
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		requestLogger(r).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote", r.RemoteAddr,
+			"status", rec.status,
+			"duration", time.Since(start))
+	}
+}
+
+// jobFromRequest returns the job that r belongs to.
+func jobFromRequest(r *http.Request) *jobInfo {
+	job, ok := r.Context().Value(jobCtxKey).(*jobInfo)
+	if !ok {
+		return new(jobInfo)
+	}
+	return job
+}
+
+// requestLogger returns the server logger with the
+// job and client of r attached to every entry.
+func requestLogger(r *http.Request) *slog.Logger {
+	job := jobFromRequest(r)
+	logger := slog.Default()
+	if job.id != "" {
+		logger = logger.With("job", job.id)
+	}
+	if job.client != "" {
+		logger = logger.With("client", job.client)
+	}
+	return logger
+}
+
+// buildEnvOptions returns the options for opening
+// a build environment to handle r.
+func buildEnvOptions(r *http.Request) buildworker.Options {
+	job := jobFromRequest(r)
+	return buildworker.Options{JobID: job.id, ClientID: job.client}
+}
+
+// writeError logs err and responds with it as an Error,
+// along with the build log and the job ID.
+func writeError(w http.ResponseWriter, r *http.Request, status int, msg string, err error, buildLog string) {
+	requestLogger(r).Error(msg, "error", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Error{
+		Message: err.Error(),
+		Log:     buildLog,
+		JobID:   jobFromRequest(r).id,
+	})
+}
+
+// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// newJobID returns a new random job ID.
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setupLogging makes the server log structured (JSON lines).
+// Anything logged with the standard log package goes to the
+// same log.
+func setupLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+}
+
+// JobIDHeader is the response header that
+// carries the ID of the request's job.
+const JobIDHeader = "X-Job-ID"
+
+const jobCtxKey ctxKey = "job"
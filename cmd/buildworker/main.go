@@ -2,42 +2,183 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
-	"crypto/subtle"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/openpgp"
 
 	"github.com/caddyserver/buildworker"
 )
 
 func init() {
-	flag.StringVar(&addr, "addr", addr, "The address (host:port) to listen on")
-	setAPICredentials()
-	setSigningKey()
+	flag.StringVar(&configFile, "config", os.Getenv("BUILDWORKER_CONFIG"), "Configuration file (JSON)")
+	flag.StringVar(&cfg.Addr, "addr", cfg.Addr, "The address (host:port) to listen on")
+	flag.StringVar(&newClientName, "newclient", "", "Generate a token for a new API client with this name, then exit")
+	flag.StringVar(&newClientScopes, "scopes", string(ScopeBuild), "Comma-separated scopes to grant the new client (build, deploy, metrics, admin)")
+	flag.BoolVar(&newClientKey, "hmac", false, "Also generate a request signing key for the new client")
+	flag.StringVar(&cfg.TLS.CertFile, "tls-cert", "", "Serve HTTPS using this certificate file (PEM)")
+	flag.StringVar(&cfg.TLS.KeyFile, "tls-key", "", "Private key file (PEM) for the certificate")
+	flag.StringVar(&cfg.TLS.ClientCAFile, "tls-client-ca", "", "Verify client certificates against this CA bundle (PEM)")
+	flag.BoolVar(&cfg.TLS.RequireClientCert, "tls-require-client-cert", false, "Reject TLS connections without a valid client certificate")
+	flag.StringVar(&cfg.AuditLog, "audit-log", cfg.AuditLog, "File to record deploys and master GOPATH changes in (JSON lines)")
+	flag.Int64Var(&cfg.AuditLogMaxSizeMB, "audit-log-max-size", cfg.AuditLogMaxSizeMB, "Size (MB) at which the audit log is rotated; 0 to never rotate")
+	flag.Uint64Var(&cfg.MinFreeDiskMB, "min-free-disk", cfg.MinFreeDiskMB, "Free disk space (MB) required for /readyz to report ready")
+	flag.BoolVar(&cfg.Signing.RequireSignatures, "require-signatures", false, "Reject unsigned deploy requests, even from clients without a signing key")
+	flag.StringVar(&cfg.ArtifactDir, "artifact-dir", "", "Folder to keep the results of background builds in")
+	flag.DurationVar(&cfg.ArtifactTTL.Duration, "artifact-ttl", cfg.ArtifactTTL.Duration, "How long to keep the results of background builds")
+	flag.StringVar(&cfg.PublicURL, "public-url", "", "Base URL of this server as reachable by clients, for links in callbacks")
 }
 
 func main() {
 	flag.Parse()
+	setupLogging()
 
-	addRoute := func(method, path string, h http.HandlerFunc) {
-		http.HandleFunc(path, methodHandler(method, maxSizeHandler(authHandler(h))))
+	if flag.Arg(0) == "config" {
+		if flag.Arg(1) != "check" || flag.NArg() > 2 {
+			log.Fatal("usage: buildworker [-config file] config check")
+		}
+		err := checkConfig(configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration OK")
+		return
+	}
+
+	if newClientName != "" {
+		scopes, err := parseScopes(newClientScopes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, token, err := newClient(newClientName, scopes, newClientKey)
+		if err != nil {
+			log.Fatalf("generating client: %v", err)
+		}
+		entry, err := json.MarshalIndent(client, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Add this entry to the clients file:\n%s\n\n", entry)
+		fmt.Printf("Give this token to the client (it will not be shown again):\n%s\n", token)
+		return
+	}
+
+	err := loadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.apply()
+
+	err = loadPlatformProbes()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "probe" {
+		version := flag.Arg(1)
+		if version == "" {
+			version = "master"
+		}
+		err := runProbe(version, flag.Arg(2))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err = loadSigningKey(cfg.Signing.KeyFile, cfg.Signing.PasswordFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.Arg(0) == "release" {
+		if flag.NArg() != 2 {
+			log.Fatal("usage: buildworker [-config file] release <tag>")
+		}
+		err := runRelease(flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err = setAPICredentials()
+	if err != nil {
+		log.Fatalf("loading API clients: %v", err)
+	}
+
+	buildworker.Audit, err = buildworker.OpenAuditLog(cfg.AuditLog, cfg.AuditLogMaxSizeMB*1024*1024)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = loadWebhookSecret(cfg.Callbacks.SecretFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go artifacts.cleanUp(time.Hour)
+
+	useTLS := cfg.TLS.CertFile != ""
+	if useTLS {
+		err = serverTLS.load()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// reload the clients file and certificates on SIGHUP so
+	// tokens can be revoked and certificates renewed without
+	// restarting
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := apiClients.load()
+			if err != nil {
+				slog.Error("reloading API clients", "error", err)
+			} else {
+				slog.Info("reloaded API clients")
+			}
+			if useTLS {
+				err = serverTLS.load()
+				if err != nil {
+					slog.Error("reloading TLS certificates", "error", err)
+				} else {
+					slog.Info("reloaded TLS certificates")
+				}
+			}
+		}
+	}()
+
+	addRoute := func(method, path string, scope Scope, h http.HandlerFunc) {
+		http.HandleFunc(path, jobHandler(methodHandler(method, maxSizeHandler(authHandler(scope, h)))))
+	}
+
+	// deploys mutate the master GOPATH, so they are
+	// protected against replay by request signatures
+	addSignedRoute := func(method, path string, scope Scope, h http.HandlerFunc) {
+		addRoute(method, path, scope, signatureHandler(h))
 	}
 
-	addRoute("POST", "/deploy-caddy", func(w http.ResponseWriter, r *http.Request) {
+	addSignedRoute("POST", "/deploy-caddy", ScopeDeploy, func(w http.ResponseWriter, r *http.Request) {
 		var info buildworker.DeployRequest
 		err := json.NewDecoder(r.Body).Decode(&info)
 		if err != nil {
-			log.Println(err)
+			requestLogger(r).Warn("decoding request", "error", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -47,31 +188,31 @@ func main() {
 			return
 		}
 
-		be, err := buildworker.Open(info.CaddyVersion, nil)
+		_, err = buildworker.LookupToolchain(info.GoVersion)
 		if err != nil {
-			log.Printf("setting up deploy environment: %v", err)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: be.Log.String()})
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer be.Close()
 
-		err = be.Deploy(nil) // no required platforms since checks should have already been performed
-		if err != nil {
-			log.Printf("deploying Caddy: %v", err)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: be.Log.String()})
+		if info.CallbackURL != "" {
+			accept(w, r, info.CallbackURL, func() {
+				// no required platforms since checks should have already been performed
+				notify(r, info.CallbackURL, "deploy-caddy", deployJob(r, info.CaddyVersion, nil, nil, info.GoVersion), "", "")
+			})
 			return
 		}
+
+		res := deployJob(r, info.CaddyVersion, nil, nil, info.GoVersion) // no required platforms since checks should have already been performed
+		if res.err != nil {
+			writeError(w, r, res.status, res.msg, res.err, res.log)
+		}
 	})
 
-	addRoute("POST", "/deploy-plugin", func(w http.ResponseWriter, r *http.Request) {
+	addSignedRoute("POST", "/deploy-plugin", ScopeDeploy, func(w http.ResponseWriter, r *http.Request) {
 		var info buildworker.DeployRequest
 		err := json.NewDecoder(r.Body).Decode(&info)
 		if err != nil {
-			log.Println(err)
+			requestLogger(r).Warn("decoding request", "error", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -81,33 +222,32 @@ func main() {
 			return
 		}
 
-		be, err := buildworker.Open(info.CaddyVersion, []buildworker.CaddyPlugin{
-			{Package: info.PluginPackage, Version: info.PluginVersion},
-		})
+		_, err = buildworker.LookupToolchain(info.GoVersion)
 		if err != nil {
-			log.Printf("setting up deploy environment: %v", err)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: be.Log.String()})
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer be.Close()
 
-		err = be.Deploy(info.RequiredPlatforms)
-		if err != nil {
-			log.Printf("deploying plugin: %v", err)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: be.Log.String()})
+		plugins := []buildworker.CaddyPlugin{{Package: info.PluginPackage, Version: info.PluginVersion}}
+
+		if info.CallbackURL != "" {
+			accept(w, r, info.CallbackURL, func() {
+				notify(r, info.CallbackURL, "deploy-plugin", deployJob(r, info.CaddyVersion, plugins, info.RequiredPlatforms, info.GoVersion), "", "")
+			})
 			return
 		}
+
+		res := deployJob(r, info.CaddyVersion, plugins, info.RequiredPlatforms, info.GoVersion)
+		if res.err != nil {
+			writeError(w, r, res.status, res.msg, res.err, res.log)
+		}
 	})
 
-	addRoute("POST", "/build", func(w http.ResponseWriter, r *http.Request) {
+	addRoute("POST", "/build", ScopeBuild, func(w http.ResponseWriter, r *http.Request) {
 		var info buildworker.BuildRequest
 		err := json.NewDecoder(r.Body).Decode(&info)
 		if err != nil {
-			log.Println(err)
+			requestLogger(r).Warn("decoding request", "error", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -117,75 +257,200 @@ func main() {
 			return
 		}
 
-		httpBuild(w, info.BuildConfig.CaddyVersion, info.BuildConfig.Plugins, info.Platform)
+		_, err = buildworker.LookupToolchain(info.GoVersion)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if info.CallbackURL != "" {
+			accept(w, r, info.CallbackURL, func() {
+				backgroundBuild(r, info.CallbackURL, info.BuildConfig, info.Platform)
+			})
+			return
+		}
+
+		httpBuild(w, r, info.BuildConfig, info.Platform)
 	})
 
-	addRoute("GET", "/supported-platforms", func(w http.ResponseWriter, r *http.Request) {
-		sup, err := buildworker.SupportedPlatforms(buildworker.UnsupportedPlatforms)
+	addRoute("POST", "/build-bundle", ScopeBuild, func(w http.ResponseWriter, r *http.Request) {
+		var info buildworker.BundleRequest
+		err := json.NewDecoder(r.Body).Decode(&info)
+		if err != nil {
+			requestLogger(r).Warn("decoding request", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		platforms, err := bundlePlatforms(info)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = buildworker.LookupToolchain(info.GoVersion)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if info.CallbackURL != "" {
+			accept(w, r, info.CallbackURL, func() {
+				backgroundBundle(r, info.CallbackURL, info.BuildConfig, platforms)
+			})
+			return
+		}
+
+		httpBundle(w, r, info.BuildConfig, platforms)
+	})
+
+	addSignedRoute("POST", "/release", ScopeDeploy, releaseHandler)
+
+	addRoute("POST", "/vuln-check", ScopeBuild, vulnCheckHandler)
+
+	addRoute("POST", "/plugin-metadata", ScopeBuild, metadataHandler)
+
+	addRoute("GET", "/artifacts/", ScopeBuild, artifacts.ServeHTTP)
+
+	addRoute("GET", "/callbacks", ScopeBuild, func(w http.ResponseWriter, r *http.Request) {
+		jobID := r.URL.Query().Get("job")
+		if jobID == "" {
+			http.Error(w, "missing required parameter: job", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(callbackDeliveries.get(jobID, jobFromRequest(r).client))
+	})
+
+	addRoute("POST", "/revoke-client", ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var info struct {
+			Name string `json:"name"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&info)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if info.Name == "" {
+			http.Error(w, "missing required field", http.StatusBadRequest)
+			return
+		}
+		err = apiClients.revoke(info.Name)
+		if err != nil {
+			requestLogger(r).Warn("revoking client", "revoked_client", info.Name, "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requestLogger(r).Info("revoked client", "revoked_client", info.Name)
+	})
+
+	addRoute("GET", "/audit", ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		q := buildworker.AuditQuery{Package: r.URL.Query().Get("package")}
+		for param, t := range map[string]*time.Time{
+			"since": &q.Since,
+			"until": &q.Until,
+		} {
+			if val := r.URL.Query().Get(param); val != "" {
+				var err error
+				*t, err = time.Parse(time.RFC3339, val)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid %s: %v", param, err), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		entries, err := buildworker.Audit.Query(q)
+		if err != nil {
+			requestLogger(r).Error("querying audit log", "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+
+	addRoute("GET", "/supported-platforms", ScopeBuild, func(w http.ResponseWriter, r *http.Request) {
+		goVersion := r.URL.Query().Get("go_version")
+		_, err := buildworker.LookupToolchain(goVersion)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sup, err := buildworker.SupportedPlatforms(buildworker.UnsupportedPlatforms, goVersion)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		json.NewEncoder(w).Encode(sup)
 	})
 
-	fmt.Println("Build worker serving on", addr)
-	http.ListenAndServe(addr, nil)
+	addRoute("POST", "/probe-platforms", ScopeAdmin, probeHandler)
+
+	addRoute("GET", "/platform-probe", ScopeBuild, platformProbeHandler)
+
+	addRoute("GET", "/toolchains", ScopeBuild, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buildworker.InstalledToolchains())
+	})
+
+	addRoute("GET", "/metrics", ScopeMetrics, promhttp.Handler().ServeHTTP)
+
+	// health checks are not authenticated so that
+	// load balancers can use them
+	http.HandleFunc("/healthz", methodHandler("GET", healthzHandler))
+	http.HandleFunc("/readyz", methodHandler("GET", readyzHandler))
+
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		ReadHeaderTimeout: cfg.Timeouts.ReadHeader.Duration,
+		ReadTimeout:       cfg.Timeouts.Read.Duration,
+		WriteTimeout:      cfg.Timeouts.Write.Duration,
+		IdleTimeout:       cfg.Timeouts.Idle.Duration,
+	}
+	if useTLS {
+		srv.TLSConfig = serverTLS.serverConfig()
+		slog.Info("build worker serving HTTPS", "addr", cfg.Addr)
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+	slog.Info("build worker serving", "addr", cfg.Addr)
+	log.Fatal(srv.ListenAndServe())
 }
 
 // httpBuild builds Caddy according to the configuration in cfg
 // and plat, and immediately streams the binary into the response
 // body of w.
-func httpBuild(w http.ResponseWriter, caddyVersion string, plugins []buildworker.CaddyPlugin, plat buildworker.Platform) {
+func httpBuild(w http.ResponseWriter, r *http.Request, cfg buildworker.BuildConfig, plat buildworker.Platform) {
 	internalErr := func(intro string, err error) {
-		log.Printf("%s: %v", intro, err)
+		requestLogger(r).Error(intro, "platform", plat.String(), "error", err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 	}
 
 	// make a temporary folder where the result of the build will go
-	tmpdir, err := ioutil.TempDir("", "caddy_build_")
+	tmpdir, err := ioutil.TempDir(tempDir(), "caddy_build_")
 	if err != nil {
 		internalErr("error getting temporary directory", err)
 		return
 	}
 	defer os.RemoveAll(tmpdir)
 
-	// TODO: This does a deep copy of all plugins including their
-	// testdata folders and test files. We might be able to
-	// add parameters to an alternate Open function so that it can be configured
-	// to only copy certain things if we want it to...
-	be, err := buildworker.Open(caddyVersion, plugins)
-	if err != nil {
-		log.Printf("creating build env: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: be.Log.String()})
-		return
-	}
-	defer be.Close()
-
-	outputFile, err := be.Build(plat, tmpdir)
-	if err != nil {
-		log.Printf("build: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(Error{Message: err.Error(), Log: be.Log.String()})
-		return
-	}
-	defer outputFile.Close()
-	name := filepath.Base(outputFile.Name())
-
-	signatureBuf, err := buildworker.Sign(outputFile)
-	if err != nil {
-		internalErr("signing archive", err)
+	archivePath, signatureBuf, res := buildJob(r, cfg, plat, tmpdir)
+	if res.err != nil {
+		if res.status == http.StatusInternalServerError {
+			internalErr(res.msg, res.err)
+		} else {
+			writeError(w, r, res.status, res.msg, res.err, res.log)
+		}
 		return
 	}
+	name := filepath.Base(archivePath)
 	signatureName := name + ".asc"
 
-	_, err = outputFile.Seek(0, 0)
+	outputFile, err := os.Open(archivePath)
 	if err != nil {
-		internalErr("seeking to beginning of file", err)
+		internalErr("opening archive", err)
 		return
 	}
+	defer outputFile.Close()
 
 	writer := multipart.NewWriter(w)
 	w.Header().Set("Content-Type", writer.FormDataContentType())
@@ -199,6 +464,45 @@ func httpBuild(w http.ResponseWriter, caddyVersion string, plugins []buildworker
 		internalErr("copying signature into form", err)
 		return
 	}
+	part, err = writer.CreateFormFile("manifest", name+".manifest.json")
+	if err != nil {
+		internalErr("creating manifest form file", err)
+		return
+	}
+	manifest, err := res.manifest.JSON()
+	if err != nil {
+		internalErr("encoding manifest", err)
+		return
+	}
+	_, err = part.Write(manifest)
+	if err != nil {
+		internalErr("writing manifest into form", err)
+		return
+	}
+	part, err = writer.CreateFormFile("manifest_signature", name+".manifest.json.asc")
+	if err != nil {
+		internalErr("creating manifest signature form file", err)
+		return
+	}
+	_, err = part.Write(res.manifestSignature)
+	if err != nil {
+		internalErr("copying manifest signature into form", err)
+		return
+	}
+	if res.manifest.SBOM != "" {
+		err = writeFilePart(writer, "sbom", buildworker.SBOMPath(archivePath))
+		if err != nil {
+			internalErr("copying SBOM into form", err)
+			return
+		}
+	}
+	if res.manifest.Image != "" {
+		err = writeFilePart(writer, "image", buildworker.ImagePath(archivePath))
+		if err != nil {
+			internalErr("copying image into form", err)
+			return
+		}
+	}
 	part, err = writer.CreateFormFile("archive", name)
 	if err != nil {
 		internalErr("creating archive form file", err)
@@ -230,122 +534,76 @@ func methodHandler(method string, h http.HandlerFunc) http.HandlerFunc {
 
 func maxSizeHandler(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if len(r.URL.RawQuery) > MaxQueryStringLength {
+		if len(r.URL.RawQuery) > cfg.MaxQueryStringLength {
 			http.Error(w, "query string exceeded length limit", http.StatusRequestURITooLong)
 			return
 		}
-		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
-		h.ServeHTTP(w, r)
-	}
-}
-
-func authHandler(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		username, password, _ := r.BasicAuth()
-		if username != apiUsername || !correctPassword(password) {
-			truncPass := password
-			if len(password) > 5 {
-				truncPass = password[:5]
-			}
-			log.Printf("Wrong credentials: user=%s pass=%s...", username, truncPass)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
 		h.ServeHTTP(w, r)
 	}
 }
 
-func correctPassword(pwd string) bool {
-	hash := sha1.New()
-	hash.Write([]byte(pwd))
-	sum := hash.Sum(nil)
-	return subtle.ConstantTimeCompare(sum, apiPassword) == 1
-}
-
-func setAPICredentials() {
-	apiUsername = os.Getenv("BUILDWORKER_CLIENT_ID")
-	envPassword := os.Getenv("BUILDWORKER_CLIENT_KEY")
-	hash := sha1.New()
-	hash.Write([]byte(envPassword))
-	apiPassword = hash.Sum(nil)
-	if apiUsername == "" && envPassword == "" {
-		fmt.Println("WARNING: No authentication credentials. Set BUILDWORKER_CLIENT_ID and BUILDWORKER_CLIENT_KEY.")
-	}
-}
-
-func setSigningKey() {
-	signingKeyFile := defaultSigningKeyFile
-	keyPasswordFile := defaultKeyPasswordFile
-
-	if custom := os.Getenv("SIGNING_KEY_FILE"); custom != "" {
-		signingKeyFile = custom
-	}
-	if custom := os.Getenv("KEY_PASSWORD_FILE"); custom != "" {
-		keyPasswordFile = custom
-	}
-
+// loadSigningKey loads the key that builds are signed with
+// into buildworker.Signer, decrypting it with the password in
+// keyPasswordFile if needed. If the default key file does not
+// exist, signing is simply not enabled.
+func loadSigningKey(signingKeyFile, keyPasswordFile string) error {
 	// open key file
 	privKeyFile, err := os.Open(signingKeyFile)
 	if err != nil {
-		if os.IsNotExist(err) && signingKeyFile == defaultKeyPasswordFile {
-			return // no signing enabled, but not a problem
+		if os.IsNotExist(err) && signingKeyFile == defaultSigningKeyFile {
+			return nil // no signing enabled, but not a problem
 		}
-		log.Fatalf("unable to load signing key file: %v", err)
+		return fmt.Errorf("unable to load signing key file: %v", err)
 	}
+	defer privKeyFile.Close()
 
 	// read key file
 	entities, err := openpgp.ReadArmoredKeyRing(privKeyFile)
 	if err != nil {
-		log.Fatalf("reading key file: %v", err)
+		return fmt.Errorf("reading key file: %v", err)
 	}
 	if len(entities) < 1 {
-		log.Fatal("no entities loaded")
+		return fmt.Errorf("no entities loaded")
 	}
-	buildworker.Signer = entities[0]
+	signer := entities[0]
 
-	if buildworker.Signer.PrivateKey.Encrypted {
+	if signer.PrivateKey.Encrypted {
 		// open and read password file; trim any edge whitespace
 		passBytes, err := ioutil.ReadFile(keyPasswordFile)
 		if err != nil {
-			log.Fatalf("unable to load key password file: %v", err)
+			return fmt.Errorf("unable to load key password file: %v", err)
 		}
 		passphrase := bytes.TrimSpace(passBytes)
 
 		// decrypt private key
-		err = buildworker.Signer.PrivateKey.Decrypt(passphrase)
+		err = signer.PrivateKey.Decrypt(passphrase)
 		if err != nil {
-			log.Fatalf("decrypting private key: %v", err)
+			return fmt.Errorf("decrypting private key: %v", err)
 		}
 	}
+
+	buildworker.Signer = signer
+	return nil
 }
 
 // Error is a structured way to return an error
 // message along with a detailed log.
 type Error struct {
 	Message string
-	Log     string
+	Log     string // JSON lines
+	JobID   string
 }
 
-const (
-	// MaxQueryStringLength is the maximum query string
-	// length allowed by requests.
-	MaxQueryStringLength = 100 * 1024
-
-	// MaxBodyBytes is the maximum size allowed for
-	// request bodies.
-	MaxBodyBytes = 10 * 1024 * 1024
-)
-
-// Credentials for accessing the API
-var (
-	apiUsername string
-	apiPassword []byte // hashed
-)
-
 // Key for signing binaries/archives
 const (
 	defaultSigningKeyFile  = "private_key.asc"
 	defaultKeyPasswordFile = "private_key_password.txt"
 )
 
-var addr = "127.0.0.1:2017"
+var (
+	configFile      string
+	newClientName   string
+	newClientScopes string
+	newClientKey    bool
+)
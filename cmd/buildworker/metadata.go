@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// metadataCache remembers the metadata of plugins by package
+// and commit and the commit of Caddy it was loaded with, since
+// it does not change for those. It holds at most max entries;
+// when full, the oldest is evicted.
+type metadataCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]buildworker.PluginMetadata
+	order   []string // keys in the order they were added
+}
+
+// metadataKey returns the key of the metadata of
+// pkg at commit, loaded with Caddy at caddyCommit.
+func metadataKey(pkg, commit, caddyCommit string) string {
+	return pkg + "@" + commit + " caddy@" + caddyCommit
+}
+
+// get returns the metadata of pkg at commit, loaded
+// with Caddy at caddyCommit, if cached.
+func (mc *metadataCache) get(pkg, commit, caddyCommit string) (buildworker.PluginMetadata, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	md, ok := mc.entries[metadataKey(pkg, commit, caddyCommit)]
+	return md, ok
+}
+
+// put caches md.
+func (mc *metadataCache) put(md buildworker.PluginMetadata) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.entries == nil {
+		mc.entries = make(map[string]buildworker.PluginMetadata)
+	}
+	key := metadataKey(md.Package, md.Commit, md.CaddyCommit)
+	if _, ok := mc.entries[key]; ok {
+		return
+	}
+	for len(mc.order) >= mc.max {
+		delete(mc.entries, mc.order[0])
+		mc.order = mc.order[1:]
+	}
+	mc.entries[key] = md
+	mc.order = append(mc.order, key)
+}
+
+// MaxCachedMetadata is how many plugin
+// commits the metadata is cached of.
+const MaxCachedMetadata = 1000
+
+var metadata = &metadataCache{max: MaxCachedMetadata}
+
+// metadataJob provisions the plugin of req and extracts its
+// metadata, unless it is cached for the commits that the
+// plugin and Caddy resolve to. Those are looked up without
+// provisioning first, if they can be.
+func metadataJob(r *http.Request, req buildworker.MetadataRequest) (buildworker.PluginMetadata, jobResult) {
+	caddyPackage := buildworker.DefaultTarget.Package
+	caddyVersion := req.CaddyVersion
+	if caddyVersion == "" {
+		caddyVersion = "master"
+	}
+	commit, err := buildworker.ResolveVersion(req.PluginPackage, req.PluginVersion)
+	if err == nil {
+		var caddyCommit string
+		caddyCommit, err = buildworker.ResolveVersion(caddyPackage, caddyVersion)
+		if err == nil {
+			if md, ok := metadata.get(req.PluginPackage, commit, caddyCommit); ok {
+				return md, jobResult{}
+			}
+		}
+	}
+	if err != nil {
+		requestLogger(r).Debug("resolving versions without provisioning", "error", err)
+	}
+
+	opts := buildEnvOptions(r)
+	opts.GoVersion = req.GoVersion
+	plugins := []buildworker.CaddyPlugin{{Package: req.PluginPackage, Version: req.PluginVersion}}
+	be, err := buildworker.OpenWithOptions(caddyVersion, plugins, opts)
+	if err != nil {
+		return buildworker.PluginMetadata{}, jobResult{status: http.StatusBadRequest, msg: "creating build env", err: err, log: be.Log.String()}
+	}
+	defer be.Close()
+
+	res := jobResult{}
+	res.resolved, _ = be.ResolvedVersions()
+	if md, ok := metadata.get(req.PluginPackage, res.resolved[req.PluginPackage], res.resolved[caddyPackage]); ok {
+		return md, res
+	}
+	md, err := be.PluginMetadata(req.PluginPackage)
+	if err != nil {
+		res.status = http.StatusBadRequest
+		res.msg = "extracting metadata"
+		res.err = err
+		res.log = be.Log.String()
+		return md, res
+	}
+	metadata.put(md)
+	return md, res
+}
+
+// metadataHandler handles POST /plugin-metadata.
+func metadataHandler(w http.ResponseWriter, r *http.Request) {
+	var info buildworker.MetadataRequest
+	err := json.NewDecoder(r.Body).Decode(&info)
+	if err != nil {
+		requestLogger(r).Warn("decoding request", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if info.PluginPackage == "" || info.PluginVersion == "" {
+		http.Error(w, "missing required field(s)", http.StatusBadRequest)
+		return
+	}
+
+	_, err = buildworker.LookupToolchain(info.GoVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	md, res := metadataJob(r, info)
+	if res.err != nil {
+		writeError(w, r, res.status, res.msg, res.err, res.log)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(md)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// probePlatforms probes which platforms the given version of
+// the target can be built for with the toolchain selected by
+// opts, then saves the result to the probe file, replacing the
+// previous probe of that toolchain, and puts it in effect. It
+// returns the probe and the log of the build environment.
+func probePlatforms(version string, opts buildworker.Options) (*buildworker.PlatformProbe, string, error) {
+	probing.Lock()
+	defer probing.Unlock()
+
+	be, err := buildworker.OpenWithOptions(version, nil, opts)
+	if err != nil {
+		return nil, be.Log.String(), err
+	}
+	defer be.Close()
+
+	probe, err := be.ProbePlatforms()
+	if err != nil {
+		return nil, be.Log.String(), err
+	}
+	probes := buildworker.CurrentPlatformProbes()
+	probes[probe.GoVersion] = probe
+	err = probes.Save(cfg.ProbeFile)
+	if err != nil {
+		return nil, be.Log.String(), fmt.Errorf("saving probe: %v", err)
+	}
+	buildworker.SetPlatformProbes(probes)
+	return probe, be.Log.String(), nil
+}
+
+// loadPlatformProbes puts the probes saved in the
+// probe file in effect, if there are any.
+func loadPlatformProbes() error {
+	probes, err := buildworker.LoadPlatformProbes(cfg.ProbeFile)
+	if os.IsNotExist(err) {
+		slog.Info("no platform probe; run `buildworker probe` to probe platforms", "probe_file", cfg.ProbeFile)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading platform probes: %v", err)
+	}
+	buildworker.SetPlatformProbes(probes)
+	return nil
+}
+
+// runProbe is the `probe` subcommand.
+func runProbe(version, goVersion string) error {
+	probe, _, err := probePlatforms(version, buildworker.Options{GoVersion: goVersion})
+	if err != nil {
+		return err
+	}
+	for _, r := range probe.Results {
+		if r.OK {
+			fmt.Printf("ok\t%s\n", r.Platform)
+		} else {
+			fmt.Printf("FAIL\t%s\n", r.Platform)
+		}
+	}
+	fmt.Printf("%d of %d platforms supported by %s at %s; saved to %s\n",
+		len(probe.Supported()), len(probe.Results), probe.GoVersion, probe.Commit, cfg.ProbeFile)
+	return nil
+}
+
+// probeHandler handles POST /probe-platforms.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		version = "master"
+	}
+	opts := buildEnvOptions(r)
+	opts.GoVersion = r.URL.Query().Get("go_version")
+	_, err := buildworker.LookupToolchain(opts.GoVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	probe, buildLog, err := probePlatforms(version, opts)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "probing platforms", err, buildLog)
+		return
+	}
+	requestLogger(r).Info("probed platforms", "version", version, "go_version", probe.GoVersion,
+		"supported", len(probe.Supported()), "probed", len(probe.Results))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(probe)
+}
+
+// probing is locked while platforms are probed, since
+// there is no point in probing more than once at a time.
+var probing sync.Mutex
+
+// platformProbeHandler handles GET /platform-probe.
+func platformProbeHandler(w http.ResponseWriter, r *http.Request) {
+	goVersion, err := buildworker.ToolchainVersion(r.URL.Query().Get("go_version"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	probe := buildworker.CurrentPlatformProbe(goVersion)
+	if probe == nil {
+		http.Error(w, "platforms have not been probed with "+goVersion, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(probe)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// makeRelease makes (or resumes) the release of the given
+// version of the target in its folder in the release folder.
+func makeRelease(version string, opts buildworker.Options) jobResult {
+	if !validPathSegment(version) {
+		return jobResult{status: http.StatusBadRequest, msg: "making release", err: fmt.Errorf("invalid version: %s", version)}
+	}
+
+	releasing.Lock()
+	defer releasing.Unlock()
+
+	be, err := buildworker.OpenWithOptions(version, nil, opts)
+	if err != nil {
+		return jobResult{status: http.StatusBadRequest, msg: "creating build env", err: err, log: be.Log.String()}
+	}
+	defer be.Close()
+
+	rm, err := be.Release(filepath.Join(cfg.ReleaseDir, version))
+	res := jobResult{log: be.Log.String(), release: rm}
+	if rm != nil {
+		res.resolved = map[string]string{rm.Package: rm.Commit}
+	}
+	if err != nil {
+		// failures of the release itself are the client's
+		// to fix; others, such as signing, are the worker's
+		res.status = http.StatusInternalServerError
+		var failure *buildworker.ReleaseFailure
+		if errors.As(err, &failure) {
+			res.status = http.StatusBadRequest
+		}
+		res.msg = "releasing " + version
+		res.err = err
+	}
+	return res
+}
+
+// runRelease is the `release` subcommand.
+func runRelease(version string) error {
+	start := time.Now()
+	res := makeRelease(version, buildworker.Options{})
+	if res.err != nil {
+		return fmt.Errorf("%s: %v", res.msg, res.err)
+	}
+	for _, b := range res.release.Builds {
+		fmt.Printf("%s\t%s\n", b.Platform, b.Archive)
+	}
+	fmt.Printf("released %s (%s) for %d platforms in %s in %v\n",
+		version, res.release.Commit, len(res.release.Builds),
+		filepath.Join(cfg.ReleaseDir, version), time.Since(start).Round(time.Second))
+	return nil
+}
+
+// releaseHandler handles POST /release.
+func releaseHandler(w http.ResponseWriter, r *http.Request) {
+	var info buildworker.ReleaseRequest
+	err := json.NewDecoder(r.Body).Decode(&info)
+	if err != nil {
+		requestLogger(r).Warn("decoding request", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if info.Version == "" {
+		http.Error(w, "missing required field", http.StatusBadRequest)
+		return
+	}
+
+	_, err = buildworker.LookupToolchain(info.GoVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := buildEnvOptions(r)
+	opts.GoVersion = info.GoVersion
+
+	if info.CallbackURL != "" {
+		accept(w, r, info.CallbackURL, func() {
+			notify(r, info.CallbackURL, "release", makeRelease(info.Version, opts), "", "")
+		})
+		return
+	}
+
+	res := makeRelease(info.Version, opts)
+	if res.err != nil {
+		writeError(w, r, res.status, res.msg, res.err, res.log)
+		return
+	}
+	requestLogger(r).Info("released", "version", info.Version, "platforms", len(res.release.Builds))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res.release)
+}
+
+// releasing is locked while a release is made, since
+// releases use every platform and a lot of resources.
+var releasing sync.Mutex
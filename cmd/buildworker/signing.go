@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// signatureHandler verifies the HMAC signature of requests
+// from clients that have a signing key. Clients without a
+// key are let through unless signatures are required. It
+// must be wrapped by authHandler so the client is known.
+func signatureHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, ok := clientFromRequest(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if client.HMACKey == "" {
+			if requireSignatures {
+				requestLogger(r).Warn("unsigned request", "path", r.URL.Path)
+				http.Error(w, "request signature required", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := base64.StdEncoding.DecodeString(client.HMACKey)
+		if err != nil {
+			requestLogger(r).Error("invalid signing key", "error", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		timestamp := r.Header.Get(buildworker.TimestampHeader)
+		nonce := r.Header.Get(buildworker.NonceHeader)
+		signature := r.Header.Get(buildworker.SignatureHeader)
+		if timestamp == "" || nonce == "" || signature == "" {
+			requestLogger(r).Warn("unsigned request", "path", r.URL.Path)
+			http.Error(w, "request signature required", http.StatusUnauthorized)
+			return
+		}
+
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid timestamp", http.StatusBadRequest)
+			return
+		}
+		reqTime := time.Unix(unix, 0)
+		if skew := time.Since(reqTime); skew > MaxClockSkew || skew < -MaxClockSkew {
+			requestLogger(r).Warn("request timestamp outside window", "skew", skew)
+			http.Error(w, "request timestamp outside of allowed window", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		expected := buildworker.RequestSignature(key, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			requestLogger(r).Warn("wrong request signature", "path", r.URL.Path)
+			http.Error(w, "invalid request signature", http.StatusUnauthorized)
+			return
+		}
+
+		// only remember nonces of authentic requests, otherwise
+		// anyone could fill the cache with garbage
+		if !nonces.add(client.Name+"/"+nonce, reqTime) {
+			requestLogger(r).Warn("replayed request", "path", r.URL.Path)
+			http.Error(w, "request already processed", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}
+}
+
+// nonceCache remembers nonces that have been seen within
+// the clock skew window. It holds at most max nonces; when
+// full, the oldest nonce is evicted and requests as old as
+// it are no longer accepted, so evicted nonces cannot be
+// replayed either.
+type nonceCache struct {
+	mu    sync.Mutex
+	max   int
+	seen  map[string]time.Time
+	order []string  // nonces in the order they were added
+	floor time.Time // requests at or before this time are rejected
+}
+
+// add records nonce as seen at time t. It returns
+// false if the nonce was already seen or if t is
+// too old to be tracked.
+func (nc *nonceCache) add(nonce string, t time.Time) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	if nc.seen == nil {
+		nc.seen = make(map[string]time.Time)
+	}
+
+	// forget nonces that are outside the window anyway
+	cutoff := time.Now().Add(-MaxClockSkew)
+	for len(nc.order) > 0 && !nc.seen[nc.order[0]].After(cutoff) {
+		delete(nc.seen, nc.order[0])
+		nc.order = nc.order[1:]
+	}
+
+	if !t.After(nc.floor) {
+		return false
+	}
+	if _, ok := nc.seen[nonce]; ok {
+		return false
+	}
+
+	for len(nc.order) >= nc.max {
+		oldest := nc.order[0]
+		if seenAt := nc.seen[oldest]; seenAt.After(nc.floor) {
+			nc.floor = seenAt
+		}
+		delete(nc.seen, oldest)
+		nc.order = nc.order[1:]
+	}
+
+	nc.seen[nonce] = t
+	nc.order = append(nc.order, nonce)
+	return true
+}
+
+// MaxClockSkew is how far a signed request's timestamp
+// may be from the current time.
+const MaxClockSkew = 5 * time.Minute
+
+// MaxNonces is how many nonces are remembered for
+// replay protection.
+const MaxNonces = 100000
+
+var nonces = &nonceCache{max: MaxNonces}
+
+// requireSignatures rejects unsigned requests to signed
+// routes even from clients that have no signing key.
+var requireSignatures bool
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// signedRequest returns a request by client to /deploy-plugin
+// signed with key, timestamp, and nonce.
+func signedRequest(client APIClient, key []byte, body string, timestamp time.Time, nonce string) *http.Request {
+	r := httptest.NewRequest("POST", "/deploy-plugin", strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	r.Header.Set(buildworker.TimestampHeader, ts)
+	r.Header.Set(buildworker.NonceHeader, nonce)
+	r.Header.Set(buildworker.SignatureHeader, buildworker.RequestSignature(key, "POST", "/deploy-plugin", ts, nonce, []byte(body)))
+	return r.WithContext(context.WithValue(r.Context(), clientCtxKey, client))
+}
+
+func TestSignatureHandler(t *testing.T) {
+	oldNonces, oldRequire := nonces, requireSignatures
+	t.Cleanup(func() { nonces, requireSignatures = oldNonces, oldRequire })
+	nonces = &nonceCache{max: MaxNonces}
+
+	key := []byte("client key")
+	client := APIClient{Name: "alice", HMACKey: base64.StdEncoding.EncodeToString(key)}
+	other := APIClient{Name: "bob", HMACKey: base64.StdEncoding.EncodeToString([]byte("other key"))}
+	now := time.Now()
+
+	var body string
+	h := signatureHandler(func(w http.ResponseWriter, r *http.Request) {
+		contents, _ := ioutil.ReadAll(r.Body)
+		body = string(contents)
+	})
+
+	for i, test := range []struct {
+		r            *http.Request
+		expectStatus int
+	}{
+		{signedRequest(client, key, "{}", now, "n1"), http.StatusOK},
+		{signedRequest(client, key, "{}", now, "n1"), http.StatusUnauthorized},                                // replayed
+		{signedRequest(client, key, "{}", now.Add(time.Second), "n1"), http.StatusUnauthorized},               // replayed with a new timestamp
+		{signedRequest(other, []byte("other key"), "{}", now, "n1"), http.StatusOK},                           // nonces are per client
+		{signedRequest(client, key, "{}", now.Add(-MaxClockSkew-time.Minute), "n2"), http.StatusUnauthorized}, // expired
+		{signedRequest(client, key, "{}", now.Add(MaxClockSkew+time.Minute), "n3"), http.StatusUnauthorized},  // from the future
+		{signedRequest(client, key, "{}", now.Add(-MaxClockSkew/2), "n4"), http.StatusOK},
+		{signedRequest(client, []byte("wrong key"), "{}", now, "n5"), http.StatusUnauthorized},
+		{signedRequest(client, key, "{}", now, "n5"), http.StatusOK}, // a forged request does not use up the nonce
+	} {
+		w := httptest.NewRecorder()
+		body = ""
+		h(w, test.r)
+		if w.Code != test.expectStatus {
+			t.Errorf("Test %d: expected status %d, got %d: %s", i, test.expectStatus, w.Code, w.Body)
+		}
+		if w.Code == http.StatusOK && body != "{}" {
+			t.Errorf("Test %d: expected the body to be passed on, got '%s'", i, body)
+		}
+	}
+
+	// a tampered body fails verification
+	r := signedRequest(client, key, "{}", now, "n6")
+	r.Body = http.NoBody
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for a tampered body, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// clients without a key need not sign, unless required
+	r = httptest.NewRequest("POST", "/deploy-plugin", strings.NewReader("{}"))
+	r = r.WithContext(context.WithValue(r.Context(), clientCtxKey, APIClient{Name: "carol"}))
+	w = httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d for a client without a key, got %d", http.StatusOK, w.Code)
+	}
+	requireSignatures = true
+	w = httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d with signatures required, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	nc := &nonceCache{max: 2}
+	now := time.Now()
+	if !nc.add("a", now.Add(-3*time.Second)) || !nc.add("b", now.Add(-2*time.Second)) {
+		t.Fatal("expected new nonces to be added")
+	}
+	if nc.add("a", now) {
+		t.Error("expected a seen nonce to be rejected")
+	}
+
+	// when full, the oldest nonce is evicted, and requests
+	// as old as it are rejected so it cannot be replayed
+	if !nc.add("c", now.Add(-time.Second)) {
+		t.Fatal("expected a new nonce to be added")
+	}
+	if nc.add("a", now.Add(-3*time.Second)) {
+		t.Error("expected an evicted nonce to be rejected")
+	}
+	if nc.add("d", now.Add(-4*time.Second)) {
+		t.Error("expected a nonce older than the evicted one to be rejected")
+	}
+	if !nc.add("e", now) {
+		t.Error("expected a recent nonce to be added")
+	}
+}
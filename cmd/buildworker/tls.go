@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// tlsConfig holds the server's certificate and the pool of
+// CAs that client certificates are verified against. Both
+// can be reloaded from disk without restarting the server.
+type tlsConfig struct {
+	certFile, keyFile string
+	clientCAFile      string
+	requireClientCert bool
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// load (re)loads the certificate, key, and client CA bundle.
+// If loading fails, the previous values stay in effect.
+func (tc *tlsConfig) load() error {
+	cert, err := tls.LoadX509KeyPair(tc.certFile, tc.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+
+	var pool *x509.CertPool
+	if tc.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(tc.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading client CA bundle: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA bundle %s", tc.clientCAFile)
+		}
+	}
+
+	tc.mu.Lock()
+	tc.cert = &cert
+	tc.clientCAs = pool
+	tc.mu.Unlock()
+	return nil
+}
+
+// serverConfig returns a TLS config for the server that
+// always uses the most recently loaded certificates.
+func (tc *tlsConfig) serverConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			tc.mu.RLock()
+			defer tc.mu.RUnlock()
+			return tc.cert, nil
+		},
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		tc.mu.RLock()
+		defer tc.mu.RUnlock()
+		// the config for the connection replaces the base
+		// config entirely, so it must offer HTTP/2 as well
+		cfg := &tls.Config{
+			MinVersion:   base.MinVersion,
+			NextProtos:   base.NextProtos,
+			Certificates: []tls.Certificate{*tc.cert},
+		}
+		if tc.clientCAs != nil {
+			cfg.ClientCAs = tc.clientCAs
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			if tc.requireClientCert {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		return cfg, nil
+	}
+	return base
+}
+
+// serverTLS is the TLS configuration of the server;
+// TLS is enabled if a certificate file is set.
+var serverTLS = new(tlsConfig)
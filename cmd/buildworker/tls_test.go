@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate made for a test.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert returns a certificate for cn signed by parent,
+// or self-signed if parent is nil. CA certificates can sign.
+func newTestCert(t *testing.T, cn string, isCA bool, parent *testCert) testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// tlsGet makes a request to srv on a new connection
+// with clientCert, if not nil, and returns the response.
+func tlsGet(srv *httptest.Server, clientCert *testCert) (*http.Response, error) {
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if clientCert != nil {
+		cert, err := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, ForceAttemptHTTP2: true}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	tc := &tlsConfig{
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+	}
+	writeCert := func(c testCert) {
+		t.Helper()
+		if err := ioutil.WriteFile(tc.certFile, c.certPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(tc.keyFile, c.keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, second := newTestCert(t, "first.example.com", false, nil), newTestCert(t, "second.example.com", false, nil)
+	writeCert(first)
+	if err := tc.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = tc.serverConfig()
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := tlsGet(srv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != "first.example.com" {
+		t.Errorf("expected the first certificate, got %s", cn)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+
+	// reloading switches certificates for new connections
+	writeCert(second)
+	if err := tc.load(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = tlsGet(srv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != "second.example.com" {
+		t.Errorf("expected the second certificate after reloading, got %s", cn)
+	}
+
+	// a failed reload keeps the certificate in use
+	if err := ioutil.WriteFile(tc.keyFile, first.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.load(); err == nil {
+		t.Error("expected an error loading a mismatched key")
+	}
+	resp, err = tlsGet(srv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != "second.example.com" {
+		t.Errorf("expected the second certificate after a failed reload, got %s", cn)
+	}
+	writeCert(second)
+
+	// client certificates are verified against the
+	// reloaded CA bundle and required if configured
+	ca, otherCA := newTestCert(t, "ca", true, nil), newTestCert(t, "other ca", true, nil)
+	clientCert := newTestCert(t, "client.example.com", false, &ca)
+	otherClientCert := newTestCert(t, "client.example.com", false, &otherCA)
+	tc.clientCAFile = filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(tc.clientCAFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tc.requireClientCert = true
+	if err := tc.load(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = tlsGet(srv, &clientCert)
+	if err != nil {
+		t.Fatalf("expected a client certificate from the CA to be accepted, got: %v", err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2 with client certificates, got %s", resp.Proto)
+	}
+	if _, err := tlsGet(srv, &otherClientCert); err == nil {
+		t.Error("expected a client certificate from another CA to be rejected")
+	}
+	if _, err := tlsGet(srv, nil); err == nil {
+		t.Error("expected a connection without a client certificate to be rejected")
+	}
+}
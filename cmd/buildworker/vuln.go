@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/caddyserver/buildworker"
+)
+
+// vulnCheckJob checks the dependencies of a build of the
+// versions in req for known vulnerabilities.
+func vulnCheckJob(r *http.Request, req buildworker.VulnCheckRequest) jobResult {
+	opts := buildEnvOptions(r)
+	opts.GoVersion = req.GoVersion
+	be, err := buildworker.OpenWithOptions(req.CaddyVersion, req.Plugins, opts)
+	if err != nil {
+		return jobResult{status: http.StatusBadRequest, msg: "creating build env", err: err, log: be.Log.String()}
+	}
+	defer be.Close()
+
+	report, err := be.CheckVulnerabilities()
+	res := jobResult{log: be.Log.String(), vulnReport: report}
+	res.resolved, _ = be.ResolvedVersions()
+	if err != nil {
+		// the versions were resolved when the build env was
+		// created, so failures here are the worker's, such as
+		// an advisory database that cannot be read
+		res.status = http.StatusInternalServerError
+		res.msg = "checking vulnerabilities"
+		res.err = err
+		return res
+	}
+	requestLogger(r).Info("checked vulnerabilities", "version", req.CaddyVersion,
+		"dependencies", len(report.Dependencies), "vulnerabilities", len(report.Vulnerabilities))
+	return res
+}
+
+// vulnCheckHandler handles POST /vuln-check.
+func vulnCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if buildworker.AdvisoryDB == "" {
+		http.Error(w, "no advisory database configured", http.StatusNotImplemented)
+		return
+	}
+
+	var info buildworker.VulnCheckRequest
+	err := json.NewDecoder(r.Body).Decode(&info)
+	if err != nil {
+		requestLogger(r).Warn("decoding request", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, plugin := range info.Plugins {
+		if plugin.Package == "" || plugin.Version == "" {
+			http.Error(w, "missing required fields: package or version of plugin", http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, err = buildworker.LookupToolchain(info.GoVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if info.CallbackURL != "" {
+		accept(w, r, info.CallbackURL, func() {
+			notify(r, info.CallbackURL, "vuln-check", vulnCheckJob(r, info), "", "")
+		})
+		return
+	}
+
+	res := vulnCheckJob(r, info)
+	if res.err != nil {
+		writeError(w, r, res.status, res.msg, res.err, res.log)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res.vulnReport)
+}
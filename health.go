@@ -0,0 +1,77 @@
+package buildworker
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// CheckMasterGopath returns an error if the master GOPATH
+// at gopath is not fit to build from: if it is missing,
+// or if restoring it from a backup failed, leaving it
+// only partially restored.
+func CheckMasterGopath(gopath string) error {
+	if gopath == "" {
+		return fmt.Errorf("no master GOPATH set")
+	}
+	if !dirExists(filepath.Join(gopath, "src")) {
+		return fmt.Errorf("master GOPATH %s has no src folder", gopath)
+	}
+
+	gopathStateMu.Lock()
+	restoreErr := failedRestores[gopath]
+	writing := gopathWriteLocked[gopath]
+	gopathStateMu.Unlock()
+
+	if restoreErr != nil {
+		return fmt.Errorf("restoring master GOPATH failed: %v", restoreErr)
+	}
+
+	// restoreMasterGopath moves the master GOPATH aside
+	// while it restores; if that copy is still there and
+	// no restore is in progress, a previous restore failed
+	// (perhaps before the process was restarted)
+	leftovers, err := filepath.Glob(gopath + "_tmp_*")
+	if err != nil {
+		return err
+	}
+	if len(leftovers) > 0 && !writing {
+		return fmt.Errorf("master GOPATH may be partially restored; found %s", leftovers[0])
+	}
+
+	return nil
+}
+
+// MasterGopathLocked returns true if the master GOPATH
+// at gopath is locked for writing, for example because
+// it is being updated or restored. Builds will wait
+// until the lock is released.
+func MasterGopathLocked(gopath string) bool {
+	gopathStateMu.Lock()
+	defer gopathStateMu.Unlock()
+	return gopathWriteLocked[gopath]
+}
+
+// setGopathWriteLocked records whether gopath is locked for writing.
+func setGopathWriteLocked(gopath string, locked bool) {
+	gopathStateMu.Lock()
+	gopathWriteLocked[gopath] = locked
+	gopathStateMu.Unlock()
+}
+
+// setRestoreError records the outcome of restoring gopath.
+func setRestoreError(gopath string, err error) {
+	gopathStateMu.Lock()
+	if err != nil {
+		failedRestores[gopath] = err
+	} else {
+		delete(failedRestores, gopath)
+	}
+	gopathStateMu.Unlock()
+}
+
+var (
+	gopathWriteLocked = make(map[string]bool)
+	failedRestores    = make(map[string]error)
+	gopathStateMu     sync.Mutex
+)
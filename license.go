@@ -0,0 +1,227 @@
+package buildworker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DeniedLicenses are the SPDX identifiers of licenses that
+// plugins and their dependencies must not have; deploys of
+// plugins that have any are rejected. "NOASSERTION" denies
+// code whose license cannot be detected.
+var DeniedLicenses []string
+
+// licenseTitles identify licenses that have a title by the
+// title and version that their texts begin with (lowercase,
+// with punctuation and whitespace collapsed to single spaces).
+// Only the beginning of a text is searched, since licenses
+// refer to each other in their terms: the GPL names the Affero
+// GPL, and the MPL names the GPLs as secondary licenses.
+var licenseTitles = []struct {
+	id    string // SPDX identifier
+	title string
+}{
+	{"AGPL-3.0", "gnu affero general public license version 3"},
+	{"LGPL-3.0", "gnu lesser general public license version 3"},
+	{"LGPL-2.1", "gnu lesser general public license version 2.1"},
+	{"GPL-3.0", "gnu general public license version 3"},
+	{"GPL-2.0", "gnu general public license version 2"},
+	{"MPL-2.0", "mozilla public license version 2.0"},
+	{"MPL-1.1", "mozilla public license version 1.1"},
+	{"EPL-2.0", "eclipse public license v 2.0"},
+	{"EPL-1.0", "eclipse public license v 1.0"},
+	{"Apache-2.0", "apache license version 2.0"},
+	{"CC0-1.0", "cc0 1.0 universal"},
+}
+
+// licenseTitleLength is how much of the beginning of a
+// normalized license text is searched for a title, which
+// leaves room for a copyright line or a project's name.
+const licenseTitleLength = 300
+
+// licensePhrases identify licenses without a title by phrases
+// of their texts (lowercase, with whitespace collapsed). They
+// are tried in order, so more specific licenses come first.
+var licensePhrases = []struct {
+	id      string // SPDX identifier
+	phrases []string
+}{
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "neither the name"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+	{"MIT", []string{"permission is hereby granted, free of charge"}},
+	{"ISC", []string{"permission to use, copy, modify, and/or distribute this software for any purpose"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+}
+
+// classifyLicense returns the SPDX identifier of
+// the license in text, or "" if it is not known.
+func classifyLicense(text []byte) string {
+	lower := strings.ToLower(string(text))
+
+	// titles are compared word by word, so that "version 2"
+	// does not match "version 2.1" or "version 20"
+	words := strings.FieldsFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.'
+	})
+	for i, w := range words {
+		words[i] = strings.Trim(w, ".")
+	}
+	beginning := " " + strings.Join(words, " ") + " "
+	if len(beginning) > licenseTitleLength {
+		beginning = beginning[:licenseTitleLength]
+	}
+	for _, l := range licenseTitles {
+		if strings.Contains(beginning, " "+l.title+" ") {
+			return l.id
+		}
+	}
+
+	normalized := strings.Join(strings.Fields(lower), " ")
+	for _, l := range licensePhrases {
+		matches := true
+		for _, phrase := range l.phrases {
+			if !strings.Contains(normalized, phrase) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return l.id
+		}
+	}
+	return ""
+}
+
+// licenseFiles returns the paths of the license files
+// in the folder dir, such as LICENSE or COPYING.txt.
+func licenseFiles(dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		name := strings.ToUpper(info.Name())
+		for _, prefix := range []string{"LICENSE", "LICENCE", "COPYING", "UNLICENSE"} {
+			if strings.HasPrefix(name, prefix) {
+				files = append(files, filepath.Join(dir, info.Name()))
+				break
+			}
+		}
+	}
+	return files
+}
+
+// detectLicense returns the licenses of the files in the
+// folder dir as an SPDX license expression, according to
+// its license files, or "NOASSERTION" if there are no
+// license files or none of them are recognized.
+func detectLicense(dir string) string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, file := range licenseFiles(dir) {
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		id := classifyLicense(text)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return "NOASSERTION"
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, " AND ")
+}
+
+// checkLicenses detects the licenses of the plugin pkg and the
+// repositories of the packages it imports, records them in the
+// report, and returns an error if any are in DeniedLicenses.
+// The target's own repository is not checked.
+func (be BuildEnv) checkLicenses(pkg string) error {
+	host := Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}
+	deps, err := be.dependencies(host, be.TemporaryPath(pkg), "./...")
+	if err != nil {
+		return err
+	}
+	be.Report.addLicenses(deps)
+	var problems []string
+	for _, dep := range deps {
+		if dep.Repo == be.target.Package {
+			continue
+		}
+		if denied := deniedLicenses(dep.License); len(denied) > 0 {
+			problems = append(problems, fmt.Sprintf("%s (%s)", dep.Repo, strings.Join(denied, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("denied licenses: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// deniedLicenses returns the licenses in the SPDX
+// license expression that are in DeniedLicenses.
+func deniedLicenses(expression string) []string {
+	var denied []string
+	for _, id := range strings.Split(expression, " AND ") {
+		for _, deny := range DeniedLicenses {
+			if strings.EqualFold(id, deny) {
+				denied = append(denied, id)
+				break
+			}
+		}
+	}
+	return denied
+}
+
+// thirdPartyNotices returns the contents of NoticesFile for
+// a build with deps (see Dependencies): the license texts of
+// the repositories other than the target's.
+func (be BuildEnv) thirdPartyNotices(deps []Dependency) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s includes the following third-party software, which is\n", be.target.Name)
+	fmt.Fprintf(&buf, "subject to the licenses below.\n")
+	for _, dep := range deps {
+		if dep.Repo == be.target.Package {
+			continue // its licenses are in its dist files
+		}
+		fmt.Fprintf(&buf, "\n%s\n\n", strings.Repeat("=", 72))
+		fmt.Fprintf(&buf, "%s\n", dep.Repo)
+		if dep.URL != "" {
+			fmt.Fprintf(&buf, "Source: %s\n", dep.URL)
+		}
+		if dep.Commit != "" {
+			fmt.Fprintf(&buf, "Commit: %s\n", dep.Commit)
+		}
+		fmt.Fprintf(&buf, "License: %s\n", dep.License)
+		files := licenseFiles(dep.dir)
+		if len(files) == 0 {
+			fmt.Fprintf(&buf, "\nNo license file was found.\n")
+		}
+		for _, file := range files {
+			text, err := ioutil.ReadFile(file)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(&buf, "\n--- %s ---\n\n%s\n", filepath.Base(file), bytes.TrimSpace(text))
+		}
+	}
+	return buf.Bytes()
+}
+
+// NoticesFile is the name of the file, put in archives,
+// with the licenses of the third-party code in a build.
+const NoticesFile = "THIRD_PARTY_NOTICES.txt"
@@ -0,0 +1,209 @@
+package buildworker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestClassifyLicense(t *testing.T) {
+	// testdata/licenses has the texts of licenses, named by their
+	// SPDX identifiers; AGPL-3.0 has only the beginning of its text
+	for i, test := range []struct {
+		file   string
+		expect string
+	}{
+		{"AGPL-3.0", "AGPL-3.0"},
+		{"Apache-2.0", "Apache-2.0"},
+		{"BSD-2-Clause", "BSD-2-Clause"},
+		{"BSD-3-Clause", "BSD-3-Clause"},
+		{"CC0-1.0", "CC0-1.0"},
+		{"GPL-2.0", "GPL-2.0"},
+		{"GPL-3.0", "GPL-3.0"},
+		{"ISC", "ISC"},
+		{"LGPL-2.1", "LGPL-2.1"},
+		{"LGPL-3.0", "LGPL-3.0"},
+		{"MIT", "MIT"},
+		{"MPL-1.1", "MPL-1.1"},
+		{"MPL-2.0", "MPL-2.0"},
+		{"Artistic-1.0", ""},
+		{"GFDL-1.3", ""},
+	} {
+		text, err := ioutil.ReadFile(filepath.Join("testdata", "licenses", test.file))
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if actual := classifyLicense(text); actual != test.expect {
+			t.Errorf("Test %d (%s): expected '%s', got '%s'", i, test.file, test.expect, actual)
+		}
+	}
+
+	for i, test := range []struct {
+		text   string
+		expect string
+	}{
+		// titles as some projects write them
+		{"Mozilla Public License, version 2.0\n\n1. Definitions", "MPL-2.0"},
+		{"Eclipse Public License - v 2.0\n\nTHE ACCOMPANYING PROGRAM", "EPL-2.0"},
+		{"Copyright 2020 Example\n\nApache License\nVersion 2.0, January 2004", "Apache-2.0"},
+		{"This is free and unencumbered software released into the public domain.", "Unlicense"},
+		// titles must be at the beginning and match the version exactly
+		{"GNU GENERAL PUBLIC LICENSE\nVersion 2.1", ""},
+		{strings.Repeat("Redistributions must retain the notice. ", 10) + "GNU General Public License version 3", ""},
+		{"", ""},
+	} {
+		if actual := classifyLicense([]byte(test.text)); actual != test.expect {
+			t.Errorf("Test %d: expected '%s', got '%s'", i, test.expect, actual)
+		}
+	}
+}
+
+func TestSPDXID(t *testing.T) {
+	a, b := spdxID("github.com/a-b/c"), spdxID("github.com/a/b-c")
+	if a == b {
+		t.Errorf("expected different identifiers, both are '%s'", a)
+	}
+	if a != spdxID("github.com/a-b/c") {
+		t.Errorf("expected the same identifier for the same repository")
+	}
+	if !regexp.MustCompile(`^SPDXRef-[a-zA-Z0-9.-]+$`).MatchString(a) {
+		t.Errorf("expected a valid SPDX identifier, got '%s'", a)
+	}
+}
+
+func TestDeniedLicenses(t *testing.T) {
+	oldDenied := DeniedLicenses
+	t.Cleanup(func() { DeniedLicenses = oldDenied })
+	DeniedLicenses = []string{"GPL-3.0", "agpl-3.0", "NOASSERTION"}
+
+	for i, test := range []struct {
+		expression string
+		expect     []string
+	}{
+		{"MIT", nil},
+		{"GPL-3.0", []string{"GPL-3.0"}},
+		{"AGPL-3.0", []string{"AGPL-3.0"}},
+		{"NOASSERTION", []string{"NOASSERTION"}},
+		{"Apache-2.0 AND MIT", nil},
+		{"GPL-3.0 AND MIT", []string{"GPL-3.0"}},
+		{"Apache-2.0 AND GPL-3.0", []string{"GPL-3.0"}},
+		{"AGPL-3.0 AND GPL-3.0 AND MIT", []string{"AGPL-3.0", "GPL-3.0"}},
+		{"LGPL-3.0 AND GPL-2.0", nil},
+	} {
+		actual := deniedLicenses(test.expression)
+		if strings.Join(actual, ",") != strings.Join(test.expect, ",") {
+			t.Errorf("Test %d (%s): expected %v, got %v", i, test.expression, test.expect, actual)
+		}
+	}
+}
+
+// testBuildEnv returns a build environment with the
+// given GOPATHs, for the go command on the PATH.
+func testBuildEnv(t *testing.T, tmpGopath, masterGopath string) BuildEnv {
+	t.Helper()
+	oldMatrix := Matrix
+	t.Cleanup(func() { Matrix = oldMatrix })
+	Matrix = PlatformMatrix{Rules: []PlatformRule{{Env: map[string]string{
+		"GO111MODULE": "off",
+		"GOCACHE":     t.TempDir(),
+	}}}}
+
+	logBuf := new(bytes.Buffer)
+	logger := newLogger(logBuf, "", "")
+	return BuildEnv{
+		masterGopath: masterGopath,
+		tmpGopath:    tmpGopath,
+		target:       Target{Name: "caddy", Package: "example.com/caddy"},
+		Log:          logBuf,
+		log:          logger,
+		cmdOutput:    &lineLogger{logger: logger.With("stream", "output")},
+		Report:       new(CheckReport),
+	}
+}
+
+// writeRepo makes a repository at the import path repo in
+// gopath with a package of the same name that imports
+// imports, and license files named by the files in
+// testdata/licenses that have their texts.
+func writeRepo(t *testing.T, gopath, repo string, imports []string, licenses ...string) {
+	t.Helper()
+	dir := filepath.Join(gopath, "src", repo)
+	if err := os.MkdirAll(filepath.Join(dir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := "package " + path.Base(repo) + "\n"
+	for _, imp := range imports {
+		src += "\nimport _ \"" + imp + "\"\n"
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkg.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i, license := range licenses {
+		text, err := ioutil.ReadFile(filepath.Join("testdata", "licenses", license))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := "LICENSE"
+		if i > 0 {
+			name += "-" + license
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), text, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckLicenses(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	oldDenied := DeniedLicenses
+	t.Cleanup(func() { DeniedLicenses = oldDenied })
+
+	tmpGopath, masterGopath := t.TempDir(), t.TempDir()
+	writeRepo(t, tmpGopath, "example.com/plugin",
+		[]string{"example.com/caddy", "example.com/dual", "example.com/gpl", "example.com/none"}, "MIT")
+	writeRepo(t, masterGopath, "example.com/caddy", nil, "GPL-3.0")
+	writeRepo(t, masterGopath, "example.com/dual", nil, "MIT", "Apache-2.0")
+	writeRepo(t, masterGopath, "example.com/gpl", nil, "GPL-3.0")
+	writeRepo(t, masterGopath, "example.com/none", nil)
+
+	for i, test := range []struct {
+		denied    []string
+		expectErr string
+	}{
+		{nil, ""},
+		{[]string{"AGPL-3.0"}, ""},
+		{[]string{"GPL-3.0"}, "denied licenses: example.com/gpl (GPL-3.0)"},
+		{[]string{"apache-2.0", "NOASSERTION"}, "denied licenses: example.com/dual (Apache-2.0); example.com/none (NOASSERTION)"},
+	} {
+		DeniedLicenses = test.denied
+		be := testBuildEnv(t, tmpGopath, masterGopath)
+		err := be.checkLicenses("example.com/plugin")
+		if test.expectErr == "" && err != nil {
+			t.Errorf("Test %d: expected no error, got: %v\n%s", i, err, be.Log)
+		} else if test.expectErr != "" && (err == nil || err.Error() != test.expectErr) {
+			t.Errorf("Test %d: expected error '%s', got: %v", i, test.expectErr, err)
+		}
+
+		// licenses are recorded whether or not they are denied,
+		// including that of the target, which is not checked
+		expect := map[string]string{
+			"example.com/caddy":  "GPL-3.0",
+			"example.com/dual":   "Apache-2.0 AND MIT",
+			"example.com/gpl":    "GPL-3.0",
+			"example.com/none":   "NOASSERTION",
+			"example.com/plugin": "MIT",
+		}
+		if !reflect.DeepEqual(be.Report.Licenses, expect) {
+			t.Errorf("Test %d: expected licenses %v, got %v", i, expect, be.Report.Licenses)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package buildworker
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// newLogger returns a logger that writes JSON lines to w,
+// with the job and the client, if not empty, in every entry.
+func newLogger(w io.Writer, jobID, clientID string) *slog.Logger {
+	logger := slog.New(slog.NewJSONHandler(w, nil))
+	if jobID != "" {
+		logger = logger.With("job", jobID)
+	}
+	if clientID != "" {
+		logger = logger.With("client", clientID)
+	}
+	return logger
+}
+
+// withLogBuffer returns a copy of be that logs, including the
+// output of its commands, to buf instead of its Log, with the
+// given attributes in every entry. Work done concurrently with
+// copies like this does not interleave its log entries; copy
+// buf to Log when the work is done.
+func (be BuildEnv) withLogBuffer(buf *bytes.Buffer, args ...interface{}) BuildEnv {
+	be.log = newLogger(buf, be.jobID, be.clientID).With(args...)
+	be.cmdOutput = &lineLogger{logger: be.log.With("stream", "output")}
+	return be
+}
+
+// lineLogger is an io.Writer that logs each line written
+// to it as a separate entry, so that output of commands
+// becomes part of the structured build log.
+type lineLogger struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+	buf    []byte
+}
+
+func (ll *lineLogger) Write(p []byte) (int, error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	ll.buf = append(ll.buf, p...)
+	for {
+		i := bytes.IndexByte(ll.buf, '\n')
+		if i < 0 {
+			break
+		}
+		ll.logger.Info(string(ll.buf[:i]))
+		ll.buf = ll.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs any partial line that is left over.
+func (ll *lineLogger) flush() {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if len(ll.buf) > 0 {
+		ll.logger.Info(string(ll.buf))
+		ll.buf = nil
+	}
+}
@@ -0,0 +1,105 @@
+package buildworker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BuildManifest describes a build: what was requested,
+// what it resolved to, and how it was built, so that the
+// build can be verified and reproduced.
+type BuildManifest struct {
+	Time      time.Time         `json:"time"`
+	Package   string            `json:"package"` // of the target
+	Requested map[string]string `json:"requested"`
+	Resolved  map[string]string `json:"resolved"` // package to commit SHA
+	Platform  Platform          `json:"platform"`
+	GoVersion string            `json:"go_version"`
+	Archive   string            `json:"archive"` // file name
+	SHA256    string            `json:"sha256"`  // of the archive, hex-encoded
+
+	// Image is the file name of the container image (an
+	// OCI image layout tarball) made of a linux build, if
+	// any, ImageSHA256 its checksum, and ImageDigest the
+	// digest of the image in it.
+	Image       string `json:"image,omitempty"`
+	ImageSHA256 string `json:"image_sha256,omitempty"`
+	ImageDigest string `json:"image_digest,omitempty"`
+
+	// SBOM is the file name of the build's software bill
+	// of materials, and SBOMSHA256 its checksum.
+	SBOM       string `json:"sbom,omitempty"`
+	SBOMSHA256 string `json:"sbom_sha256,omitempty"`
+}
+
+// Manifest returns the manifest of the archive at
+// archivePath, which was built by be for plat.
+func (be BuildEnv) Manifest(plat Platform, archivePath string) (BuildManifest, error) {
+	m := BuildManifest{
+		Time:      time.Now().UTC(),
+		Package:   be.target.Package,
+		Requested: be.pkgs,
+		Platform:  plat,
+		Archive:   filepath.Base(archivePath),
+	}
+	var err error
+	m.Resolved, err = be.ResolvedVersions()
+	if err != nil {
+		return m, err
+	}
+	m.GoVersion, err = be.GoVersion()
+	if err != nil {
+		return m, fmt.Errorf("getting Go version: %v", err)
+	}
+	m.SHA256, err = fileSHA256(archivePath)
+	if err != nil {
+		return m, err
+	}
+	m.Image, m.ImageSHA256, m.ImageDigest, err = imageOf(archivePath)
+	if err != nil {
+		return m, err
+	}
+	m.SBOM, m.SBOMSHA256, err = sbomOf(archivePath)
+	if err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// JSON returns the manifest encoded as JSON, which
+// is what SignManifest signs.
+func (m BuildManifest) JSON() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// SignManifest signs the JSON encoding of m (see JSON)
+// like Sign signs files.
+func SignManifest(m BuildManifest) (*bytes.Buffer, error) {
+	contents, err := m.JSON()
+	if err != nil {
+		return nil, err
+	}
+	return sign(bytes.NewReader(contents))
+}
+
+// fileSHA256 returns the hex-encoded SHA-256
+// checksum of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,232 @@
+package buildworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// PlatformMatrix declares which platforms are built for and
+// how. Its rules are applied in order to each platform that
+// `go tool dist list` reports; when rules conflict, the last
+// matching rule wins.
+type PlatformMatrix struct {
+	Rules []PlatformRule `json:"rules"`
+}
+
+// PlatformRule configures the platforms that match it.
+type PlatformRule struct {
+	// Match selects the platforms the rule applies to;
+	// empty fields match any value.
+	Match Platform `json:"match"`
+
+	// Variants, if set, expands each matching platform
+	// that has no GOARM value into one platform for each
+	// GOARM value listed.
+	Variants []string `json:"variants,omitempty"`
+
+	// Skip, if set, decides whether matching
+	// platforms are not built for.
+	Skip *bool `json:"skip,omitempty"`
+
+	// Env is added to the environment of builds; only
+	// the variables in AllowedPlatformEnv may be set.
+	Env map[string]string `json:"env,omitempty"`
+
+	// Tags are build tags to build with.
+	Tags []string `json:"tags,omitempty"`
+
+	// Archive is the format of archives; one
+	// of ArchiveFormats.
+	Archive string `json:"archive,omitempty"`
+
+	// BinarySuffix is appended to the name of
+	// the binary, for example ".exe".
+	BinarySuffix string `json:"binary_suffix,omitempty"`
+
+	// Emulator is the command, with arguments, that runs
+	// binaries of matching platforms on this system (such
+	// as qemu-user) for smoke tests; see SmokeTest.
+	Emulator []string `json:"emulator,omitempty"`
+}
+
+// PlatformSettings are the settings to build
+// a platform with, as resolved from a matrix.
+type PlatformSettings struct {
+	Skip         bool
+	Env          []string // KEY=value, sorted
+	Tags         []string
+	Archive      string
+	BinarySuffix string
+	Emulator     []string
+}
+
+// Settings returns the settings to build for p with.
+func (m PlatformMatrix) Settings(p Platform) PlatformSettings {
+	var s PlatformSettings
+	env := make(map[string]string)
+	for _, rule := range m.Rules {
+		if !rule.Match.matches(p) {
+			continue
+		}
+		if rule.Skip != nil {
+			s.Skip = *rule.Skip
+		}
+		for key, val := range rule.Env {
+			env[key] = val
+		}
+		for _, tag := range rule.Tags {
+			if !containsString(s.Tags, tag) {
+				s.Tags = append(s.Tags, tag)
+			}
+		}
+		if rule.Archive != "" {
+			s.Archive = rule.Archive
+		}
+		if rule.BinarySuffix != "" {
+			s.BinarySuffix = rule.BinarySuffix
+		}
+		if len(rule.Emulator) > 0 {
+			s.Emulator = rule.Emulator
+		}
+	}
+	for key, val := range env {
+		s.Env = append(s.Env, key+"="+val)
+	}
+	sort.Strings(s.Env)
+	if s.Archive == "" {
+		s.Archive = "tar.gz"
+	}
+	return s
+}
+
+// expand returns platforms with the variants
+// of the matrix's rules expanded.
+func (m PlatformMatrix) expand(platforms []Platform) []Platform {
+	var expanded []Platform
+	for _, p := range platforms {
+		var variants []string
+		for _, rule := range m.Rules {
+			if len(rule.Variants) > 0 && rule.Match.matches(p) {
+				variants = rule.Variants
+			}
+		}
+		if p.ARM != "" || len(variants) == 0 {
+			expanded = append(expanded, p)
+			continue
+		}
+		for _, v := range variants {
+			variant := p
+			variant.ARM = v
+			expanded = append(expanded, variant)
+		}
+	}
+	return expanded
+}
+
+// Validate returns an error if any rule of m is invalid.
+func (m PlatformMatrix) Validate() error {
+	for i, rule := range m.Rules {
+		if rule.Archive != "" && !containsString(ArchiveFormats, rule.Archive) {
+			return fmt.Errorf("rule %d: unknown archive format '%s'", i, rule.Archive)
+		}
+		for key := range rule.Env {
+			if !containsString(AllowedPlatformEnv, key) {
+				return fmt.Errorf("rule %d: environment variable %s may not be set", i, key)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadPlatformMatrix reads and validates the
+// platform matrix in the JSON file at path.
+func LoadPlatformMatrix(path string) (PlatformMatrix, error) {
+	var m PlatformMatrix
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&m)
+	if err != nil {
+		return m, fmt.Errorf("%s: %v", path, err)
+	}
+	err = m.Validate()
+	if err != nil {
+		return m, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// matches returns true if other has the same values
+// as p for the fields of p that are not empty.
+func (p Platform) matches(other Platform) bool {
+	return (p.OS == "" || p.OS == other.OS) &&
+		(p.Arch == "" || p.Arch == other.Arch) &&
+		(p.ARM == "" || p.ARM == other.ARM)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// for pointing to in the Skip field of rules
+var doSkip, dontSkip = true, false
+
+// DefaultMatrix is the platform matrix used unless
+// Matrix is changed.
+var DefaultMatrix = PlatformMatrix{
+	Rules: []PlatformRule{
+		{Env: map[string]string{"CGO_ENABLED": "0"}},
+
+		// assume 5, 6, and 7 are the versions of ARM we
+		// can build for, but only build ARMv5 for linux; see:
+		// https://github.com/golang/go/issues/18418
+		{Match: Platform{Arch: "arm"}, Variants: []string{"5", "6", "7"}},
+		{Match: Platform{Arch: "arm", ARM: "5"}, Skip: &doSkip},
+		{Match: Platform{OS: "linux", Arch: "arm", ARM: "5"}, Skip: &dontSkip},
+
+		// TODO.
+		// As of Go 1.6, darwin might have some trouble if cgo is disabled.
+		// https://www.reddit.com/r/golang/comments/46bd5h/ama_we_are_the_go_contributors_ask_us_anything/d03rmc9
+		// As of Go 1.8beta3, this may not be necessary:
+		// https://twitter.com/bradfitz/status/811630858742341632
+		// https://github.com/golang/go/commit/3357daa96e2b04f83be70d29b70858ddc7c803f4
+		{Match: Platform{OS: "darwin"}, Env: map[string]string{"CGO_ENABLED": "1"}, Archive: "zip"},
+
+		{Match: Platform{OS: "windows"}, Archive: "zip", BinarySuffix: ".exe"},
+	},
+}
+
+// Matrix is the platform matrix that build
+// environments and SupportedPlatforms use.
+var Matrix = DefaultMatrix
+
+// ArchiveFormats are the formats that a platform can
+// be built into. "binary" is the bare binary; "deb"
+// and "rpm" are Linux packages.
+var ArchiveFormats = []string{"binary", "zip", "tar", "tar.gz", "tar.xz", "tar.zst", "deb", "rpm"}
+
+// AllowedPlatformEnv are the environment variables
+// that a platform matrix may set for builds.
+var AllowedPlatformEnv = []string{
+	"CGO_ENABLED",
+	"GOARM",
+	"GOAMD64",
+	"GOARM64",
+	"GOMIPS",
+	"GOMIPS64",
+	"GO386",
+	"GOPPC64",
+	"GORISCV64",
+	"GOWASM",
+}
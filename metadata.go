@@ -0,0 +1,208 @@
+package buildworker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PluginMetadata describes a plugin as its source does:
+// what it registers with Caddy, and its package doc.
+type PluginMetadata struct {
+	Package     string   `json:"package"`
+	Commit      string   `json:"commit"`       // that the metadata is of
+	CaddyCommit string   `json:"caddy_commit"` // of the target it was loaded with
+	Doc         string   `json:"doc"`          // package doc comment
+	Plugins     []string `json:"plugins"`      // names of registered plugins
+	ServerTypes []string `json:"server_types"` // names of registered server types
+	Directives  []string `json:"directives"`   // names of plugins registered for a server type
+
+	// Registrations are all the things
+	// that the plugin registers.
+	Registrations []Registration `json:"registrations"`
+}
+
+// PluginMetadata extracts the metadata of the plugin pkg
+// from its source, without building it. The plugin must
+// be one of the plugins of the build environment.
+func (be BuildEnv) PluginMetadata(pkg string) (PluginMetadata, error) {
+	commit, err := gitHead(be.TemporaryPath(pkg))
+	if err != nil {
+		return PluginMetadata{}, fmt.Errorf("getting commit of %s: %v", pkg, err)
+	}
+	caddyCommit, err := gitHead(be.TemporaryPath(be.target.Package))
+	if err != nil {
+		return PluginMetadata{}, fmt.Errorf("getting commit of %s: %v", be.target.Package, err)
+	}
+	roots, err := be.loadPackages(be.TemporaryPath(pkg), ".")
+	if err != nil {
+		return PluginMetadata{}, err
+	}
+	regs, err := be.registrations(pkg, roots)
+	if err != nil {
+		return PluginMetadata{}, err
+	}
+
+	md := PluginMetadata{
+		Package:       pkg,
+		Commit:        commit,
+		CaddyCommit:   caddyCommit,
+		Plugins:       []string{},
+		ServerTypes:   []string{},
+		Directives:    []string{},
+		Registrations: regs,
+	}
+
+	// the doc comment is conventionally in doc.go,
+	// but may be in any file of the package
+	for _, f := range roots[0].Syntax {
+		if f.Doc == nil {
+			continue
+		}
+		filename := roots[0].Fset.Position(f.Package).Filename
+		if md.Doc == "" || filepath.Base(filename) == "doc.go" {
+			md.Doc = strings.TrimSpace(f.Doc.Text())
+		}
+	}
+
+	for _, reg := range regs {
+		if reg.Name == "" {
+			continue // not known without running it
+		}
+		switch reg.Kind {
+		case "plugin":
+			md.Plugins = appendUnique(md.Plugins, reg.Name)
+			if reg.ServerType != "" {
+				md.Directives = appendUnique(md.Directives, reg.Name)
+			}
+		case "server type":
+			md.ServerTypes = appendUnique(md.ServerTypes, reg.Name)
+		case "directive":
+			md.Directives = appendUnique(md.Directives, reg.Name)
+		}
+	}
+	sort.Strings(md.Plugins)
+	sort.Strings(md.ServerTypes)
+	sort.Strings(md.Directives)
+	return md, nil
+}
+
+// ResolveVersion returns the commit that version (a full commit
+// SHA, a tag, or a branch) of pkg is at in the origin of pkg's
+// repository in the master GOPATH, without fetching or checking
+// out anything: tags and branches are looked up with `git
+// ls-remote`, whose output is reused for remoteRefsTTL. It
+// returns an error if pkg is not in the master GOPATH or
+// version is not a tag or branch of the origin, as is the
+// case for abbreviated commit SHAs.
+func ResolveVersion(pkg, version string) (string, error) {
+	if commitSHA.MatchString(version) {
+		return version, nil
+	}
+	be := BuildEnv{masterGopath: MasterGopathDir()}
+
+	// the repository must not be updated while it is read
+	rlock(be.masterGopath)
+	repo := be.RepoPath(pkg)
+	if !strings.HasPrefix(repo, filepath.Join(be.masterGopath, "src")+string(filepath.Separator)) {
+		runlock(be.masterGopath)
+		return "", fmt.Errorf("%s is not in the master GOPATH", pkg)
+	}
+	refs, err := remoteRefs(repo)
+	runlock(be.masterGopath)
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote %s: %v", pkg, err)
+	}
+
+	// annotated tags are listed with the commit they
+	// point to as the tag followed by ^{}
+	for _, ref := range []string{"refs/tags/" + version + "^{}", "refs/tags/" + version, "refs/heads/" + version} {
+		if sha, ok := refs[ref]; ok {
+			return sha, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a tag or branch of %s", version, pkg)
+}
+
+// remoteRefs returns the commits of the tags and branches
+// of the origin of the repository at repo, keyed by ref
+// name, as of at most remoteRefsTTL ago. The master GOPATH
+// must be locked for reading.
+func remoteRefs(repo string) (map[string]string, error) {
+	remoteRefsMu.Lock()
+	cached, ok := remoteRefsCache[repo]
+	remoteRefsMu.Unlock()
+	if ok && time.Since(cached.time) < remoteRefsTTL {
+		return cached.refs, nil
+	}
+
+	ctx := context.Background()
+	if CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CommandTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--tags", "--heads", "origin")
+	cmd.Dir = repo
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	remoteRefsMu.Lock()
+	for r, c := range remoteRefsCache {
+		if time.Since(c.time) >= remoteRefsTTL {
+			delete(remoteRefsCache, r)
+		}
+	}
+	remoteRefsCache[repo] = cachedRefs{refs: refs, time: time.Now()}
+	remoteRefsMu.Unlock()
+	return refs, nil
+}
+
+// cachedRefs are the refs of the origin of
+// a repository, as listed at time.
+type cachedRefs struct {
+	refs map[string]string
+	time time.Time
+}
+
+// The refs of the origins of repositories, keyed by
+// the path of the repository in the master GOPATH.
+var (
+	remoteRefsCache = make(map[string]cachedRefs)
+	remoteRefsMu    sync.Mutex
+)
+
+// remoteRefsTTL is how long the refs of an origin are
+// used to resolve versions before they are listed again,
+// so that looking up the metadata of many plugins does
+// not make as many requests to their hosts.
+const remoteRefsTTL = 30 * time.Second
+
+// commitSHA matches full commit SHAs.
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// appendUnique appends s to list, unless
+// list already has it.
+func appendUnique(list []string, s string) []string {
+	if containsString(list, s) {
+		return list
+	}
+	return append(list, s)
+}
@@ -0,0 +1,79 @@
+package buildworker
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveVersion(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	oldGopath := MasterGopath
+	t.Cleanup(func() { MasterGopath = oldGopath })
+	MasterGopath = t.TempDir()
+
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	origin := t.TempDir()
+	git(origin, "init", "-q", "-b", "main")
+	git(origin, "commit", "-q", "--allow-empty", "-m", "first")
+	first := git(origin, "rev-parse", "HEAD")
+	git(origin, "tag", "v1.0.0")
+	git(origin, "commit", "-q", "--allow-empty", "-m", "second")
+	second := git(origin, "rev-parse", "HEAD")
+	git(origin, "tag", "-a", "-m", "annotated", "v1.1.0")
+	repo := filepath.Join(MasterGopath, "src", "example.com", "plugin")
+	git(origin, "clone", "-q", origin, repo)
+
+	for i, test := range []struct {
+		pkg, version string
+		expect       string // empty if an error is expected
+	}{
+		{"example.com/plugin", "v1.0.0", first},
+		{"example.com/plugin", "v1.1.0", second},
+		{"example.com/plugin", "main", second},
+		{"example.com/plugin/sub", "v1.0.0", first},
+		{"example.com/plugin", first, first},
+		{"example.com/plugin", first[:12], ""},
+		{"example.com/plugin", "v2.0.0", ""},
+		{"example.com/other", "v1.0.0", ""},
+	} {
+		actual, err := ResolveVersion(test.pkg, test.version)
+		if test.expect == "" {
+			if err == nil {
+				t.Errorf("Test %d: expected an error, got %s", i, actual)
+			}
+			continue
+		}
+		if err != nil || actual != test.expect {
+			t.Errorf("Test %d: expected %s, got %s (error: %v)", i, test.expect, actual, err)
+		}
+	}
+
+	// refs are listed again only after remoteRefsTTL
+	git(origin, "tag", "v2.0.0")
+	if _, err := ResolveVersion("example.com/plugin", "v2.0.0"); err == nil {
+		t.Error("expected the refs listed before to be reused")
+	}
+	remoteRefsMu.Lock()
+	delete(remoteRefsCache, repo)
+	remoteRefsMu.Unlock()
+	if actual, err := ResolveVersion("example.com/plugin", "v2.0.0"); err != nil || actual != second {
+		t.Errorf("expected %s once the refs are listed again, got %s (error: %v)", second, actual, err)
+	}
+}
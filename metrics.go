@@ -0,0 +1,153 @@
+package buildworker
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics about builds, deploys, and the master GOPATH. They are
+// registered with the default Prometheus registry, so programs
+// can expose them with promhttp.Handler().
+var (
+	buildsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "buildworker",
+		Name:      "builds_total",
+		Help:      "Number of builds by platform and outcome.",
+	}, []string{"os", "arch", "outcome"})
+
+	buildDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "buildworker",
+		Name:      "build_duration_seconds",
+		Help:      "Duration of builds by platform and outcome.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"os", "arch", "outcome"})
+
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "buildworker",
+		Name:      "phase_duration_seconds",
+		Help:      "Duration of build phases: provision, plugin, compile, archive, sign.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"phase"})
+
+	deploysTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "buildworker",
+		Name:      "deploys_total",
+		Help:      "Number of deploys by kind (caddy or plugin) and outcome (success, failure, reverted, revert_failed).",
+	}, []string{"kind", "outcome"})
+
+	lockWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "buildworker",
+		Name:      "gopath_lock_wait_seconds",
+		Help:      "Time spent waiting to lock the master GOPATH, by mode (read or write).",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 12),
+	}, []string{"mode"})
+
+	jobsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "buildworker",
+		Name:      "jobs_active",
+		Help:      "Number of open build environments.",
+	})
+
+	lockWaiters = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "buildworker",
+		Name:      "gopath_lock_waiters",
+		Help:      "Number of lock requests waiting for the master GOPATH, by any job.",
+	})
+
+	tempDiskUsage = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "buildworker",
+		Name:      "temp_disk_bytes",
+		Help:      "Disk space used by temporary GOPATHs of open build environments.",
+	}, func() float64 {
+		return float64(cachedTempGopathsSize())
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		buildsTotal,
+		buildDuration,
+		phaseDuration,
+		deploysTotal,
+		lockWait,
+		jobsActive,
+		lockWaiters,
+		tempDiskUsage,
+	)
+}
+
+// observePhase records the duration of phase, which
+// began at start. Use it with defer.
+func observePhase(phase string, start time.Time) {
+	phaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+// tempGopaths is the set of temporary GOPATHs
+// that are currently in use.
+var (
+	tempGopaths   = make(map[string]struct{})
+	tempGopathsMu sync.Mutex
+)
+
+func trackTempGopath(path string) {
+	tempGopathsMu.Lock()
+	tempGopaths[path] = struct{}{}
+	tempGopathsMu.Unlock()
+}
+
+func untrackTempGopath(path string) {
+	tempGopathsMu.Lock()
+	delete(tempGopaths, path)
+	tempGopathsMu.Unlock()
+}
+
+// cachedTempGopathsSize returns the total size of the temporary
+// GOPATHs in use as of at most tempDiskUsageTTL ago, so that
+// scraping metrics does not walk the GOPATHs every time.
+func cachedTempGopathsSize() int64 {
+	tempDiskUsageMu.Lock()
+	defer tempDiskUsageMu.Unlock()
+	if time.Since(tempDiskUsageTime) >= tempDiskUsageTTL {
+		tempDiskUsageSize = tempGopathsSize()
+		tempDiskUsageTime = time.Now()
+	}
+	return tempDiskUsageSize
+}
+
+// The last computed size of the temporary GOPATHs.
+var (
+	tempDiskUsageSize int64
+	tempDiskUsageTime time.Time
+	tempDiskUsageMu   sync.Mutex
+)
+
+// tempDiskUsageTTL is how long the computed size of
+// the temporary GOPATHs is reported before it is
+// computed again.
+const tempDiskUsageTTL = 30 * time.Second
+
+// tempGopathsSize returns the total size in bytes
+// of all temporary GOPATHs in use.
+func tempGopathsSize() int64 {
+	tempGopathsMu.Lock()
+	paths := make([]string, 0, len(tempGopaths))
+	for path := range tempGopaths {
+		paths = append(paths, path)
+	}
+	tempGopathsMu.Unlock()
+
+	var size int64
+	for _, path := range paths {
+		filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return size
+}
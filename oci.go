@@ -0,0 +1,368 @@
+package buildworker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CACertificates is the CA certificate bundle (PEM) that
+// container images include. If empty, the first bundle
+// found in a common location on this system is used.
+var CACertificates string
+
+// caCertificatesPaths are where CA certificate
+// bundles are commonly found.
+var caCertificatesPaths = []string{
+	"/etc/ssl/certs/ca-certificates.crt", // Debian, Ubuntu, Alpine
+	"/etc/pki/tls/certs/ca-bundle.crt",   // Fedora, RHEL
+	"/etc/ssl/ca-bundle.pem",             // openSUSE
+	"/etc/ssl/cert.pem",                  // macOS, BSDs
+}
+
+// PluginsLabel is the label of container images that lists
+// the plugins plugged in, as space-separated import paths,
+// each with "@" and the commit it was built at.
+const PluginsLabel = "io.caddyserver.buildworker.plugins"
+
+// Media types of the parts of OCI images.
+const (
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// ociDescriptor describes a blob of an OCI image.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// makeImage makes a container image of the binary at binaryPath,
+// built for plat, at dest, with the docs among distFiles.
+func (be BuildEnv) makeImage(plat Platform, version, dest string, distFiles []string, binaryPath string) error {
+	files, err := be.packageFiles(distFiles, binaryPath)
+	if err != nil {
+		return err
+	}
+	// images have the binary and docs; services
+	// are managed by the container runtime
+	var imageFiles []packageFile
+	for _, f := range files {
+		if f.doc || f.src == binaryPath {
+			imageFiles = append(imageFiles, f)
+		}
+	}
+	return be.makeOCIImage(plat, version, dest, imageFiles)
+}
+
+// makeOCIImage makes a tarball of an OCI image layout at dest,
+// with one image of the given version of the target for plat.
+// The image has one layer with files, which should include the
+// binary at /usr/bin/<name>, and the CA certificates.
+func (be BuildEnv) makeOCIImage(plat Platform, version, dest string, files []packageFile) error {
+	if plat.OS != "linux" {
+		return fmt.Errorf("container images are only for linux, not %s", plat.OS)
+	}
+	caCerts, err := caCertificates()
+	if err != nil {
+		return err
+	}
+	resolved, err := be.ResolvedVersions()
+	if err != nil {
+		return err
+	}
+	created := time.Now().UTC()
+	blobs := make(map[string][]byte)
+	addBlob := func(mediaType string, contents []byte) ociDescriptor {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(contents))
+		blobs[digest] = contents
+		return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(contents))}
+	}
+
+	// the layer is made uncompressed first, since the
+	// image's config refers to it by the digest of its
+	// uncompressed contents (its "diff ID")
+	var layerContents bytes.Buffer
+	layerTar := tar.NewWriter(&layerContents)
+	dirs := make(map[string]bool)
+	writeDirs := func(file string) error {
+		for _, dir := range parentDirs(file) {
+			if dirs[dir] {
+				continue
+			}
+			dirs[dir] = true
+			err := layerTar.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     strings.TrimPrefix(dir, "/") + "/",
+				Mode:     0755,
+				ModTime:  created,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	files = append(files, packageFile{dest: caCertificatesPath, mode: 0644})
+	sort.Slice(files, func(i, j int) bool { return files[i].dest < files[j].dest })
+	for _, f := range files {
+		err := writeDirs(f.dest)
+		if err != nil {
+			return err
+		}
+		contents := caCerts
+		if f.src != "" {
+			contents, err = ioutil.ReadFile(f.src)
+			if err != nil {
+				return err
+			}
+		}
+		err = writeTarFile(layerTar, strings.TrimPrefix(f.dest, "/"), contents, f.mode, created)
+		if err != nil {
+			return err
+		}
+	}
+	err = layerTar.Close()
+	if err != nil {
+		return err
+	}
+	diffID := fmt.Sprintf("sha256:%x", sha256.Sum256(layerContents.Bytes()))
+	var layer bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&layer, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	_, err = gz.Write(layerContents.Bytes())
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	layerDesc := addBlob(ociLayerMediaType, layer.Bytes())
+
+	// labels describe what was built
+	labels := map[string]string{
+		"org.opencontainers.image.title":    be.target.Name,
+		"org.opencontainers.image.version":  version,
+		"org.opencontainers.image.revision": resolved[be.target.Package],
+		"org.opencontainers.image.created":  created.Format(time.RFC3339),
+	}
+	if be.target.Description != "" {
+		labels["org.opencontainers.image.description"], _ = splitDescription(be.target)
+	}
+	if be.target.Homepage != "" {
+		labels["org.opencontainers.image.url"] = be.target.Homepage
+	}
+	var plugins []string
+	for pkg, sha := range resolved {
+		if pkg != be.target.Package {
+			plugins = append(plugins, pkg+"@"+sha)
+		}
+	}
+	sort.Strings(plugins)
+	labels[PluginsLabel] = strings.Join(plugins, " ")
+
+	platform := ociPlatform{Architecture: plat.Arch, OS: plat.OS, Variant: ociVariant(plat)}
+	imageConfig := map[string]interface{}{
+		"created":      created,
+		"architecture": platform.Architecture,
+		"os":           platform.OS,
+		"config": map[string]interface{}{
+			"Entrypoint": []string{"/usr/bin/" + be.target.Name},
+			"Env": []string{
+				"PATH=/usr/bin",
+				"SSL_CERT_FILE=" + caCertificatesPath,
+			},
+			"Labels": labels,
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{diffID},
+		},
+	}
+	if platform.Variant != "" {
+		imageConfig["variant"] = platform.Variant
+	}
+	config, err := json.Marshal(imageConfig)
+	if err != nil {
+		return err
+	}
+	configDesc := addBlob(ociConfigMediaType, config)
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestMediaType,
+		"config":        configDesc,
+		"layers":        []ociDescriptor{layerDesc},
+		"annotations":   labels,
+	})
+	if err != nil {
+		return err
+	}
+	manifestDesc := addBlob(ociManifestMediaType, manifest)
+	manifestDesc.Platform = &platform
+	manifestDesc.Annotations = map[string]string{
+		"org.opencontainers.image.ref.name": version,
+	}
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociIndexMediaType,
+		"manifests":     []ociDescriptor{manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the image layout, in a tarball
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	tw := tar.NewWriter(out)
+	writeFile := func(name string, contents []byte) error {
+		return writeTarFile(tw, name, contents, 0644, created)
+	}
+	err = writeFile("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	if err != nil {
+		return err
+	}
+	err = writeFile("index.json", index)
+	if err != nil {
+		return err
+	}
+	digests := make([]string, 0, len(blobs))
+	for digest := range blobs {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+	for _, digest := range digests {
+		err = writeFile("blobs/sha256/"+strings.TrimPrefix(digest, "sha256:"), blobs[digest])
+		if err != nil {
+			return err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// ociImageDigest returns the digest of the (first) image
+// manifest in the OCI image layout tarball at path.
+func ociImageDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("%s has no index.json", path)
+		}
+		if err != nil {
+			return "", err
+		}
+		if hdr.Name != "index.json" {
+			continue
+		}
+		var index struct {
+			Manifests []ociDescriptor `json:"manifests"`
+		}
+		err = json.NewDecoder(tr).Decode(&index)
+		if err != nil {
+			return "", fmt.Errorf("decoding index.json: %v", err)
+		}
+		if len(index.Manifests) == 0 {
+			return "", fmt.Errorf("%s has no images", path)
+		}
+		return index.Manifests[0].Digest, nil
+	}
+}
+
+// ociVariant returns the OCI variant of plat's architecture.
+func ociVariant(plat Platform) string {
+	switch plat.Arch {
+	case "arm":
+		return "v" + plat.ARM
+	case "arm64":
+		return "v8"
+	}
+	return ""
+}
+
+// caCertificates returns the contents of the CA
+// certificate bundle to put in container images.
+func caCertificates() ([]byte, error) {
+	if CACertificates != "" {
+		return ioutil.ReadFile(CACertificates)
+	}
+	for _, path := range caCertificatesPaths {
+		contents, err := ioutil.ReadFile(path)
+		if err == nil {
+			return contents, nil
+		}
+	}
+	return nil, fmt.Errorf("no CA certificates found in %s; set the CA certificates file",
+		strings.Join(caCertificatesPaths, ", "))
+}
+
+// ImagePath returns the path of the container image that
+// is made next to the archive at archivePath, if any.
+func ImagePath(archivePath string) string {
+	return archivePath + ociExt
+}
+
+// imageOf returns the file name, the hex-encoded SHA-256
+// checksum, and the image digest of the container image of
+// the archive at archivePath, or "" if it has none.
+func imageOf(archivePath string) (string, string, string, error) {
+	path := ImagePath(archivePath)
+	sum, err := fileSHA256(path)
+	if os.IsNotExist(err) {
+		return "", "", "", nil
+	}
+	if err != nil {
+		return "", "", "", err
+	}
+	digest, err := ociImageDigest(path)
+	if err != nil {
+		return "", "", "", fmt.Errorf("getting image digest: %v", err)
+	}
+	return filepath.Base(path), sum, digest, nil
+}
+
+// ociExt is the file extension of
+// OCI image layout tarballs.
+const ociExt = ".oci.tar"
+
+// caCertificatesPath is where container
+// images have the CA certificates.
+const caCertificatesPath = "/etc/ssl/certs/ca-certificates.crt"
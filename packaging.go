@@ -0,0 +1,421 @@
+package buildworker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/rpmpack"
+)
+
+// packageFile is a file that a package installs.
+type packageFile struct {
+	src  string      // path on disk
+	dest string      // absolute install path, with forward slashes
+	mode os.FileMode // permission bits
+	doc  bool        // documentation
+}
+
+// packageFiles returns the files that packages of the target
+// install: the binary at binaryPath into /usr/bin, the files
+// among distFiles (the paths of the target's DistFiles in the
+// temporary GOPATH) that are ServiceFiles where they belong,
+// and the other dist files as documentation.
+func (be BuildEnv) packageFiles(distFiles []string, binaryPath string) ([]packageFile, error) {
+	name := be.target.Name
+	files := []packageFile{{src: binaryPath, dest: "/usr/bin/" + name, mode: 0755}}
+	corePath := be.TemporaryPath(be.target.Package)
+	for _, distFile := range distFiles {
+		base := filepath.Dir(distFile)
+		err := filepath.Walk(distFile, func(fpath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(corePath, fpath)
+			if err != nil {
+				return err
+			}
+			if dest, ok := be.target.ServiceFiles[filepath.ToSlash(rel)]; ok {
+				files = append(files, packageFile{src: fpath, dest: dest, mode: 0644})
+				return nil
+			}
+			docRel, err := filepath.Rel(base, fpath)
+			if err != nil {
+				return err
+			}
+			files = append(files, packageFile{
+				src:  fpath,
+				dest: path.Join("/usr/share/doc", name, filepath.ToSlash(docRel)),
+				mode: info.Mode().Perm(),
+				doc:  true,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].dest < files[j].dest })
+	return files, nil
+}
+
+// makePackage makes a Linux package in the given format
+// (deb or rpm) of the given version of the target for plat
+// at dest, installing files.
+func (be BuildEnv) makePackage(format string, plat Platform, version, dest string, files []packageFile) error {
+	if plat.OS != "linux" {
+		return fmt.Errorf("%s packages are only for linux, not %s", format, plat.OS)
+	}
+	switch format {
+	case "deb":
+		arch, ok := debArch(plat)
+		if !ok {
+			return fmt.Errorf("no deb architecture for %s", plat)
+		}
+		return be.makeDeb(dest, packageVersion(version), arch, files)
+	case "rpm":
+		arch, ok := rpmArch(plat)
+		if !ok {
+			return fmt.Errorf("no rpm architecture for %s", plat)
+		}
+		return be.makeRPM(dest, packageVersion(version), arch, files)
+	}
+	return fmt.Errorf("unknown package format: %s", format)
+}
+
+// makeDeb makes a Debian package at dest.
+func (be BuildEnv) makeDeb(dest, version, arch string, files []packageFile) error {
+	mtime := time.Now()
+
+	// data.tar.gz has the files to install, with
+	// entries for the folders they are in
+	var data, md5sums bytes.Buffer
+	var installedSize int64
+	dataTar, err := newTarGz(&data)
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		for _, dir := range parentDirs(f.dest) {
+			if dirs[dir] {
+				continue
+			}
+			dirs[dir] = true
+			err := dataTar.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     "." + dir + "/",
+				Mode:     0755,
+				ModTime:  mtime,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		contents, err := ioutil.ReadFile(f.src)
+		if err != nil {
+			return err
+		}
+		err = dataTar.writeFile("."+f.dest, contents, f.mode, mtime)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&md5sums, "%x  %s\n", md5.Sum(contents), strings.TrimPrefix(f.dest, "/"))
+		installedSize += int64(len(contents))
+	}
+	err = dataTar.Close()
+	if err != nil {
+		return err
+	}
+
+	// control.tar.gz describes the package
+	var control bytes.Buffer
+	fmt.Fprintf(&control, "Package: %s\n", be.target.Name)
+	fmt.Fprintf(&control, "Version: %s\n", version)
+	fmt.Fprintf(&control, "Architecture: %s\n", arch)
+	fmt.Fprintf(&control, "Maintainer: %s\n", be.target.Maintainer)
+	fmt.Fprintf(&control, "Installed-Size: %d\n", (installedSize+1023)/1024)
+	fmt.Fprintf(&control, "Priority: optional\n")
+	if be.target.Homepage != "" {
+		fmt.Fprintf(&control, "Homepage: %s\n", be.target.Homepage)
+	}
+	fmt.Fprintf(&control, "Description: %s\n", debDescription(be.target))
+	var controlArchive bytes.Buffer
+	controlTar, err := newTarGz(&controlArchive)
+	if err != nil {
+		return err
+	}
+	err = controlTar.writeFile("./control", control.Bytes(), 0644, mtime)
+	if err != nil {
+		return err
+	}
+	err = controlTar.writeFile("./md5sums", md5sums.Bytes(), 0644, mtime)
+	if err != nil {
+		return err
+	}
+	err = controlTar.Close()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	err = writeAr(out, mtime, []arMember{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlArchive.Bytes()},
+		{"data.tar.gz", data.Bytes()},
+	})
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// makeRPM makes an RPM package at dest.
+func (be BuildEnv) makeRPM(dest, version, arch string, files []packageFile) error {
+	summary, _ := splitDescription(be.target)
+	rpm, err := rpmpack.NewRPM(rpmpack.RPMMetaData{
+		Name:        be.target.Name,
+		Summary:     summary,
+		Description: be.target.Description,
+		Version:     version,
+		Release:     "1",
+		Arch:        arch,
+		OS:          "linux",
+		URL:         be.target.Homepage,
+		Packager:    be.target.Maintainer,
+		Compressor:  "gzip",
+	})
+	if err != nil {
+		return err
+	}
+	mtime := uint32(time.Now().Unix())
+	for _, f := range files {
+		contents, err := ioutil.ReadFile(f.src)
+		if err != nil {
+			return err
+		}
+		fileType := rpmpack.GenericFile
+		if f.doc {
+			fileType = rpmpack.DocFile
+		}
+		rpm.AddFile(rpmpack.RPMFile{
+			Name:  f.dest,
+			Body:  contents,
+			Mode:  uint(f.mode),
+			Owner: "root",
+			Group: "root",
+			MTime: mtime,
+			Type:  fileType,
+		})
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	err = rpm.Write(out)
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// tarGzWriter writes a gzip-compressed tarball.
+type tarGzWriter struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func newTarGz(w io.Writer) (*tarGzWriter, error) {
+	gz, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	return &tarGzWriter{Writer: tar.NewWriter(gz), gz: gz}, nil
+}
+
+// writeFile adds a regular file to the tarball.
+func (tw *tarGzWriter) writeFile(name string, contents []byte, mode os.FileMode, mtime time.Time) error {
+	return writeTarFile(tw.Writer, name, contents, mode, mtime)
+}
+
+func (tw *tarGzWriter) Close() error {
+	err := tw.Writer.Close()
+	if err != nil {
+		return err
+	}
+	return tw.gz.Close()
+}
+
+// writeTarFile adds a regular file to tw.
+func writeTarFile(tw *tar.Writer, name string, contents []byte, mode os.FileMode, mtime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(mode),
+		Size:     int64(len(contents)),
+		ModTime:  mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(contents)
+	return err
+}
+
+// arMember is a file in an ar archive.
+type arMember struct {
+	name     string
+	contents []byte
+}
+
+// writeAr writes an ar archive of members to w, in the
+// common format that Debian packages use.
+func writeAr(w io.Writer, mtime time.Time, members []arMember) error {
+	_, err := io.WriteString(w, "!<arch>\n")
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if len(m.name) > 16 {
+			return fmt.Errorf("ar member name too long: %s", m.name)
+		}
+		_, err := fmt.Fprintf(w, "%-16s%-12d%-6d%-6d%-8o%-10d`\n",
+			m.name, mtime.Unix(), 0, 0, 0100644, len(m.contents))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(m.contents)
+		if err != nil {
+			return err
+		}
+		// members are aligned to even offsets
+		if len(m.contents)%2 == 1 {
+			_, err = io.WriteString(w, "\n")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parentDirs returns the folders that file is in,
+// outermost first, excluding the root.
+func parentDirs(file string) []string {
+	var dirs []string
+	for dir := path.Dir(file); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs
+}
+
+// packageVersion returns version (of the core package) in a
+// form that package managers accept: without the "v" prefix,
+// with pre-releases sorting before releases, and starting with
+// a digit, so that branches and commits sort before releases.
+func packageVersion(version string) string {
+	version = strings.TrimPrefix(version, "v")
+	version = strings.Replace(version, "-", "~", -1)
+	if version == "" || version[0] < '0' || version[0] > '9' {
+		version = "0.0.0~" + version
+	}
+	return version
+}
+
+// splitDescription returns the first line of the target's
+// description, for a summary, and the rest.
+func splitDescription(t Target) (string, string) {
+	desc := strings.TrimSpace(t.Description)
+	if desc == "" {
+		desc = t.Name
+	}
+	lines := strings.SplitN(desc, "\n", 2)
+	if len(lines) == 1 {
+		return lines[0], ""
+	}
+	return lines[0], strings.TrimSpace(lines[1])
+}
+
+// debDescription formats the target's description
+// for the Description field of a Debian package.
+func debDescription(t Target) string {
+	summary, rest := splitDescription(t)
+	if rest == "" {
+		return summary
+	}
+	var lines []string
+	for _, line := range strings.Split(rest, "\n") {
+		if strings.TrimSpace(line) == "" {
+			line = "."
+		}
+		lines = append(lines, " "+line)
+	}
+	return summary + "\n" + strings.Join(lines, "\n")
+}
+
+// debArch returns the Debian architecture of plat.
+func debArch(plat Platform) (string, bool) {
+	switch plat.Arch {
+	case "arm":
+		if plat.ARM == "5" {
+			return "armel", true
+		}
+		return "armhf", true
+	case "ppc64le":
+		return "ppc64el", true
+	case "mipsle":
+		return "mipsel", true
+	case "mips64le":
+		return "mips64el", true
+	case "386":
+		return "i386", true
+	case "amd64", "arm64", "mips", "mips64", "ppc64", "riscv64", "s390x", "loong64":
+		return plat.Arch, true
+	}
+	return "", false
+}
+
+// rpmArch returns the RPM architecture of plat.
+func rpmArch(plat Platform) (string, bool) {
+	switch plat.Arch {
+	case "amd64":
+		return "x86_64", true
+	case "386":
+		return "i386", true
+	case "arm64":
+		return "aarch64", true
+	case "arm":
+		switch plat.ARM {
+		case "5":
+			return "armv5tel", true
+		case "6":
+			return "armv6hl", true
+		}
+		return "armv7hl", true
+	case "ppc64", "ppc64le", "riscv64", "s390x", "mips", "mips64", "loong64":
+		return plat.Arch, true
+	case "mipsle":
+		return "mipsel", true
+	case "mips64le":
+		return "mips64el", true
+	}
+	return "", false
+}
@@ -0,0 +1,212 @@
+package buildworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PlatformProbe records which platforms the target could
+// be cross-compiled for with one toolchain.
+type PlatformProbe struct {
+	Time      time.Time     `json:"time"`
+	GoVersion string        `json:"go_version"`
+	Package   string        `json:"package"`
+	Commit    string        `json:"commit"`
+	Results   []ProbeResult `json:"results"`
+}
+
+// ProbeResult is the outcome of cross-compiling for one platform.
+type ProbeResult struct {
+	Platform Platform `json:"platform"`
+	OK       bool     `json:"ok"`
+	Error    string   `json:"error,omitempty"` // excerpt of the compiler's output
+}
+
+// Supported returns the platforms that were built successfully.
+func (pp *PlatformProbe) Supported() []Platform {
+	var platforms []Platform
+	for _, r := range pp.Results {
+		if r.OK {
+			platforms = append(platforms, r.Platform)
+		}
+	}
+	return platforms
+}
+
+// failed returns true if building for p was
+// attempted and failed.
+func (pp *PlatformProbe) failed(p Platform) bool {
+	for _, r := range pp.Results {
+		if r.Platform.OS == p.OS && r.Platform.Arch == p.Arch && r.Platform.ARM == p.ARM {
+			return !r.OK
+		}
+	}
+	return false
+}
+
+// ProbePlatforms cross-compiles the target's main package
+// for every platform that `go tool dist list` reports (with
+// variants expanded according to Matrix), and records which
+// ones succeed. Build the environment with no plugins and
+// the version of the target to probe, usually "master".
+func (be BuildEnv) ProbePlatforms() (*PlatformProbe, error) {
+	rlock(be.masterGopath)
+	defer runlock(be.masterGopath)
+
+	distList := be.newCommand("go", "tool", "dist", "list", "-json")
+	distList.Stdout = nil // output is needed here, not in the log
+	platforms, err := allPlatforms(distList)
+	if err != nil {
+		return nil, fmt.Errorf("listing platforms: %v", err)
+	}
+	goVersion, err := be.GoVersion()
+	if err != nil {
+		return nil, fmt.Errorf("getting Go version: %v", err)
+	}
+	commit, err := gitHead(be.TemporaryPath(be.target.Package))
+	if err != nil {
+		return nil, fmt.Errorf("getting commit of %s: %v", be.target.Package, err)
+	}
+
+	probe := &PlatformProbe{
+		Time:      time.Now().UTC(),
+		GoVersion: goVersion,
+		Package:   be.target.Package,
+		Commit:    commit,
+	}
+	start := time.Now()
+	for _, plat := range platforms {
+		be.log.Info("probing", "phase", "probe", "platform", plat.String())
+		var output bytes.Buffer
+		cmd := be.newBuildCommand(plat, "-o", os.DevNull)
+		cmd.Dir = filepath.Join(be.TemporaryPath(be.target.Package), filepath.FromSlash(be.target.MainDir))
+		cmd.Stdout = io.MultiWriter(be.cmdOutput, &output)
+		cmd.Stderr = cmd.Stdout
+		result := ProbeResult{Platform: plat, OK: true}
+		err := be.runCommand(cmd)
+		if err != nil {
+			result.OK = false
+			result.Error = excerpt(output.String(), err)
+		}
+		probe.Results = append(probe.Results, result)
+	}
+	be.phaseDone("probe", start)
+
+	return probe, nil
+}
+
+// excerpt returns the first lines of a command's output,
+// or the error if there was no output.
+func excerpt(output string, err error) string {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return err.Error()
+	}
+	lines := strings.Split(output, "\n")
+	if len(lines) > probeExcerptLines {
+		lines = append(lines[:probeExcerptLines], "...")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PlatformProbes are the latest probes of each
+// toolchain, keyed by its Go version (like "go1.21.5").
+type PlatformProbes map[string]*PlatformProbe
+
+// Save writes pps to the file at path as JSON.
+func (pps PlatformProbes) Save(path string) error {
+	contents, err := json.MarshalIndent(pps, "", "\t")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so the
+	// file is never partially written
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, contents, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadPlatformProbes reads probes saved to path. A file
+// with a single probe, as saved by earlier versions, is
+// read as the probe of the toolchain it records.
+func LoadPlatformProbes(path string) (PlatformProbes, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(contents, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if _, ok := fields["results"]; ok {
+		pp := new(PlatformProbe)
+		err = json.Unmarshal(contents, pp)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return PlatformProbes{pp.GoVersion: pp}, nil
+	}
+	pps := make(PlatformProbes)
+	err = json.Unmarshal(contents, &pps)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for version, pp := range pps {
+		if pp == nil || pp.GoVersion != version {
+			return nil, fmt.Errorf("%s: probe of %s is missing or has the wrong Go version", path, version)
+		}
+	}
+	return pps, nil
+}
+
+// SetPlatformProbes makes SupportedPlatforms skip the
+// platforms that failed in the probe of the toolchain
+// it lists platforms with. Toolchains without a probe
+// in pps skip no platforms because of probing.
+func SetPlatformProbes(pps PlatformProbes) {
+	probeMu.Lock()
+	platformProbes = pps
+	probeMu.Unlock()
+}
+
+// CurrentPlatformProbes returns a copy of the
+// probes set with SetPlatformProbes.
+func CurrentPlatformProbes() PlatformProbes {
+	probeMu.RLock()
+	defer probeMu.RUnlock()
+	pps := make(PlatformProbes, len(platformProbes))
+	for version, pp := range platformProbes {
+		pps[version] = pp
+	}
+	return pps
+}
+
+// CurrentPlatformProbe returns the probe in effect for the
+// toolchain of the given Go version (like "go1.21.5"), or
+// nil if there is none.
+func CurrentPlatformProbe(goVersion string) *PlatformProbe {
+	probeMu.RLock()
+	defer probeMu.RUnlock()
+	return platformProbes[goVersion]
+}
+
+var (
+	platformProbes PlatformProbes
+	probeMu        sync.RWMutex
+)
+
+// probeExcerptLines is how many lines of compiler
+// output are kept for each failed platform.
+const probeExcerptLines = 20
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package buildworker
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// newProcessGroup makes cmd start in a process group
+// of its own, so that killProcessGroup can kill the
+// processes that it starts along with it.
+func newProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills the process group
+// of cmd, which must have been started.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package buildworker
+
+import "os/exec"
+
+// newProcessGroup does nothing on Windows, where
+// processes that cmd starts are not killed with it.
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process of
+// cmd, which must have been started.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
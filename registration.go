@@ -0,0 +1,179 @@
+package buildworker
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/checker"
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+// Registration is something that a plugin
+// registers with Caddy when it is imported.
+type Registration struct {
+	Kind       string `json:"kind"`                  // plugin, server type, directive, caddyfile loader, event hook, or dns provider
+	Name       string `json:"name"`                  // as registered; empty if it is not a constant
+	ServerType string `json:"server_type,omitempty"` // of plugins, if any
+	Package    string `json:"package"`               // that registers it
+	Position   string `json:"position"`              // file:line:column, relative to the repository
+
+	pos token.Position
+}
+
+// registerFuncs are the functions that register things
+// with Caddy, by import path and name, and the kind
+// of what they register.
+var registerFuncs = map[string]string{
+	CaddyPackage + ".RegisterPlugin":               "plugin",
+	CaddyPackage + ".RegisterServerType":           "server type",
+	CaddyPackage + ".RegisterCaddyfileLoader":      "caddyfile loader",
+	CaddyPackage + ".RegisterEventHook":            "event hook",
+	CaddyPackage + "/caddytls.RegisterDNSProvider": "dns provider",
+
+	CaddyPackage + "/caddyhttp/httpserver.RegisterDevDirective": "directive",
+}
+
+// RegistrationAnalyzer finds what packages register with
+// Caddy. Its result is a []Registration; it reports nothing.
+var RegistrationAnalyzer = &analysis.Analyzer{
+	Name:       "registration",
+	Doc:        "find the plugins and server types that packages register with Caddy",
+	Run:        runRegistration,
+	ResultType: reflect.TypeOf([]Registration(nil)),
+}
+
+func runRegistration(pass *analysis.Pass) (interface{}, error) {
+	// constant string values of expressions, if they are
+	stringValue := func(expr ast.Expr) string {
+		tv, ok := pass.TypesInfo.Types[expr]
+		if !ok || tv.Value == nil || tv.Value.Kind() != constant.String {
+			return ""
+		}
+		return constant.StringVal(tv.Value)
+	}
+
+	var regs []Registration
+	for _, file := range pass.Files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			callee, ok := typeutil.Callee(pass.TypesInfo, call).(*types.Func)
+			if !ok {
+				return true
+			}
+			kind, ok := registerFuncs[funcKey(callee)]
+			if !ok {
+				return true
+			}
+			reg := Registration{
+				Kind:    kind,
+				Name:    stringValue(call.Args[0]),
+				Package: pass.Pkg.Path(),
+				pos:     pass.Fset.Position(call.Pos()),
+			}
+			if kind == "plugin" && len(call.Args) > 1 {
+				reg.ServerType = fieldStringValue(call.Args[1], "ServerType", stringValue)
+			}
+			regs = append(regs, reg)
+			return true
+		})
+	}
+	return regs, nil
+}
+
+// fieldStringValue returns the value of the field named
+// field in expr, if expr is a composite literal, according
+// to stringValue.
+func fieldStringValue(expr ast.Expr, field string, stringValue func(ast.Expr) string) string {
+	lit, ok := ast.Unparen(expr).(*ast.CompositeLit)
+	if !ok {
+		return ""
+	}
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		if key, ok := kv.Key.(*ast.Ident); ok && key.Name == field {
+			return stringValue(kv.Value)
+		}
+	}
+	return ""
+}
+
+// registrations returns what the package pkg, loaded as roots
+// (see loadPackages), registers with Caddy, including through
+// the packages of its repository that it imports, sorted by
+// position.
+func (be BuildEnv) registrations(pkg string, roots []*packages.Package) ([]Registration, error) {
+	dir := be.TemporaryPath(pkg)
+	repoDir, repo, ok := be.repoRoot(dir)
+	if !ok {
+		repoDir, repo = dir, pkg
+	}
+
+	// registrations may be in any of the packages of the
+	// repository that the package imports, but not in
+	// those of other repositories that it vendors
+	var pkgs []*packages.Package
+	packages.Visit(roots, nil, func(p *packages.Package) {
+		if (p.PkgPath == repo || strings.HasPrefix(p.PkgPath, repo+"/")) && !strings.Contains(p.PkgPath, "/vendor/") {
+			pkgs = append(pkgs, p)
+		}
+	})
+	graph, err := checker.Analyze([]*analysis.Analyzer{RegistrationAnalyzer}, pkgs, nil)
+	if err != nil {
+		return nil, err
+	}
+	var regs []Registration
+	for _, act := range graph.Roots {
+		if act.Err != nil {
+			return nil, fmt.Errorf("%s: %v", act.Analyzer.Name, act.Err)
+		}
+		for _, reg := range act.Result.([]Registration) {
+			if rel, err := filepath.Rel(repoDir, reg.pos.Filename); err == nil {
+				reg.pos.Filename = filepath.ToSlash(rel)
+			}
+			reg.Position = reg.pos.String()
+			regs = append(regs, reg)
+		}
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		a, b := regs[i].pos, regs[j].pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+	return regs, nil
+}
+
+// checkRegistration checks that the plugin pkg registers
+// something with Caddy, such as a plugin or server type,
+// and records what it registers in the report.
+func (be BuildEnv) checkRegistration(pkg string) error {
+	roots, err := be.loadPackages(be.TemporaryPath(pkg), ".")
+	if err != nil {
+		return err
+	}
+	regs, err := be.registrations(pkg, roots)
+	if err != nil {
+		return err
+	}
+	be.Report.addRegistrations(regs)
+	if len(regs) == 0 {
+		return fmt.Errorf("%s registers no plugins or server types with %s", pkg, be.target.Name)
+	}
+	return nil
+}
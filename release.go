@@ -0,0 +1,372 @@
+package buildworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// ReleaseManifest describes a release of the target and
+// records the progress of making it, so that an interrupted
+// release can be resumed. It is kept in the release folder
+// as ReleaseManifestFile.
+type ReleaseManifest struct {
+	Version      string          `json:"version"` // the tag
+	Package      string          `json:"package"` // of the target
+	Commit       string          `json:"commit"`  // the tag resolves to
+	GoVersion    string          `json:"go_version"`
+	Started      time.Time       `json:"started"`
+	Finished     *time.Time      `json:"finished,omitempty"` // nil until the release is complete
+	ChecksPassed bool            `json:"checks_passed"`
+	Builds       []PlatformBuild `json:"builds"` // sorted by platform
+}
+
+// Release makes a release of the target's version that be was
+// opened with, which must be a tag, into the folder dir: it runs
+// RunCaddyChecks, builds every supported platform, signs each
+// archive, and writes the checksums of the archives and their
+// SBOMs and the release manifest, both signed. The build
+// environment must have no plugins, and Signer must be set.
+//
+// Progress is saved to the manifest in dir as the release is
+// made. If dir has the manifest of an unfinished release of the
+// same commit and Go version, the release is resumed: checks
+// that passed are not run again, and platforms whose archives
+// are intact are not built again. Platforms that failed are
+// built again. If any platform fails to build, an error is
+// returned after the others are built, and the release can
+// be resumed once the problem is fixed. If dir has a finished
+// release, its files and signatures are verified, and it is
+// returned as is.
+//
+// Errors that are due to the release rather than to the worker,
+// such as checks failing, are of type *ReleaseFailure.
+func (be BuildEnv) Release(dir string) (*ReleaseManifest, error) {
+	if len(be.pkgs) != 1 {
+		return nil, &ReleaseFailure{fmt.Errorf("releases cannot have plugins")}
+	}
+	if Signer == nil {
+		return nil, fmt.Errorf("no signing key loaded")
+	}
+	version := be.pkgs[be.target.Package]
+	repoPath := be.TemporaryPath(be.target.Package)
+	cmd := be.newCommand("git", "rev-parse", "--verify", "--quiet", "refs/tags/"+version)
+	cmd.Dir = repoPath
+	err := be.runCommand(cmd)
+	if err != nil {
+		return nil, &ReleaseFailure{fmt.Errorf("%s is not a tag of %s", version, be.target.Package)}
+	}
+	commit, err := gitHead(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("getting commit of %s: %v", be.target.Package, err)
+	}
+	goVersion, err := be.GoVersion()
+	if err != nil {
+		return nil, fmt.Errorf("getting Go version: %v", err)
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	manifestPath := filepath.Join(dir, ReleaseManifestFile)
+	rm, err := loadReleaseManifest(manifestPath)
+	if os.IsNotExist(err) {
+		rm = &ReleaseManifest{
+			Version:   version,
+			Package:   be.target.Package,
+			Commit:    commit,
+			GoVersion: goVersion,
+			Started:   time.Now().UTC(),
+		}
+	} else if err != nil {
+		return nil, err
+	} else if rm.Package != be.target.Package || rm.Commit != commit || rm.GoVersion != goVersion {
+		return nil, &ReleaseFailure{fmt.Errorf("%s has a release of %s at %s built with %s; use another folder",
+			dir, rm.Package, rm.Commit, rm.GoVersion)}
+	} else if rm.Finished != nil {
+		err = rm.verify(dir)
+		if err != nil {
+			return rm, fmt.Errorf("verifying finished release in %s: %v", dir, err)
+		}
+		be.log.Info("release already finished", "phase", "release", "version", version)
+		return rm, nil
+	} else {
+		be.log.Info("resuming release", "phase", "release", "version", version,
+			"started", rm.Started, "built", len(rm.built(dir)))
+	}
+	err = rm.save(manifestPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if !rm.ChecksPassed {
+		start := time.Now()
+		err = be.RunCaddyChecks()
+		if err != nil {
+			return rm, &ReleaseFailure{fmt.Errorf("checks failed: %v", err)}
+		}
+		be.phaseDone("check", start)
+		rm.ChecksPassed = true
+		err = rm.save(manifestPath, false)
+		if err != nil {
+			return rm, err
+		}
+	}
+
+	platforms, err := supportedPlatforms(UnsupportedPlatforms, be.goroot)
+	if err != nil {
+		return rm, fmt.Errorf("getting supported platforms: %v", err)
+	}
+	builds := make(map[string]PlatformBuild)
+	for _, b := range rm.built(dir) {
+		builds[b.Platform.String()] = b
+	}
+	rm.Builds = sortedBuilds(builds) // forget builds that are to be redone
+	var toBuild []Platform
+	for _, plat := range platforms {
+		if _, ok := builds[plat.String()]; !ok {
+			toBuild = append(toBuild, plat)
+		}
+	}
+	be.log.Info("building release", "phase", "release", "version", version,
+		"platforms", len(platforms), "already_built", len(platforms)-len(toBuild))
+
+	// record each platform as soon as it is built and
+	// signed so an interruption loses as little as possible
+	var saveErr error
+	var mu sync.Mutex
+	record := func(b PlatformBuild) {
+		mu.Lock()
+		defer mu.Unlock()
+		builds[b.Platform.String()] = b
+		rm.Builds = sortedBuilds(builds)
+		err := rm.save(manifestPath, false)
+		if err != nil && saveErr == nil {
+			saveErr = err
+		}
+	}
+	err = be.plugIn()
+	if err != nil {
+		return rm, err
+	}
+	var signErr error
+	be.buildPlatforms(toBuild, dir, func(b PlatformBuild) {
+		if b.Error == "" {
+			err := signFile(filepath.Join(dir, b.Archive))
+			if err != nil {
+				b.Error = fmt.Sprintf("signing: %v", err)
+				if signErr == nil {
+					signErr = fmt.Errorf("signing %s: %v", b.Archive, err)
+				}
+			}
+		}
+		record(b)
+	})
+	if saveErr != nil {
+		return rm, fmt.Errorf("saving release manifest: %v", saveErr)
+	}
+	if signErr != nil {
+		return rm, signErr
+	}
+
+	var failed []string
+	for _, b := range rm.Builds {
+		if b.Error != "" {
+			failed = append(failed, b.Platform.String())
+		}
+	}
+	if len(failed) > 0 {
+		return rm, &ReleaseFailure{fmt.Errorf("%d platforms failed to build: %s", len(failed), strings.Join(failed, ", "))}
+	}
+
+	checksumsPath := filepath.Join(dir, ReleaseChecksumsFile)
+	err = ioutil.WriteFile(checksumsPath, checksums(rm.Builds), 0644)
+	if err != nil {
+		return rm, fmt.Errorf("writing checksums: %v", err)
+	}
+	err = signFile(checksumsPath)
+	if err != nil {
+		return rm, fmt.Errorf("signing checksums: %v", err)
+	}
+
+	finished := time.Now().UTC()
+	rm.Finished = &finished
+	err = rm.save(manifestPath, true)
+	if err != nil {
+		return rm, err
+	}
+	be.log.Info("release finished", "phase", "release", "version", version, "platforms", len(rm.Builds))
+	return rm, nil
+}
+
+// built returns the builds of rm whose archives, SBOMs, images,
+// and signatures are in dir and match their checksums.
+func (rm *ReleaseManifest) built(dir string) []PlatformBuild {
+	var builds []PlatformBuild
+	for _, b := range rm.Builds {
+		if b.Error != "" {
+			continue
+		}
+		archivePath := filepath.Join(dir, b.Archive)
+		sum, err := fileSHA256(archivePath)
+		if err != nil || sum != b.SHA256 {
+			continue
+		}
+		if _, err := os.Stat(archivePath + ".asc"); err != nil {
+			continue
+		}
+		if b.SBOM != "" {
+			sum, err := fileSHA256(filepath.Join(dir, b.SBOM))
+			if err != nil || sum != b.SBOMSHA256 {
+				continue
+			}
+		}
+		if b.Image != "" {
+			sum, err := fileSHA256(filepath.Join(dir, b.Image))
+			if err != nil || sum != b.ImageSHA256 {
+				continue
+			}
+		}
+		builds = append(builds, b)
+	}
+	return builds
+}
+
+// verify returns an error unless the files of the finished
+// release rm are all in dir and match their checksums, and the
+// checksums and the manifest in dir have valid signatures.
+func (rm *ReleaseManifest) verify(dir string) error {
+	if built := rm.built(dir); len(built) != len(rm.Builds) {
+		return fmt.Errorf("%d of %d builds are missing or do not match their checksums",
+			len(rm.Builds)-len(built), len(rm.Builds))
+	}
+	checksumsPath := filepath.Join(dir, ReleaseChecksumsFile)
+	contents, err := ioutil.ReadFile(checksumsPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(contents, checksums(rm.Builds)) {
+		return fmt.Errorf("%s does not match the manifest", ReleaseChecksumsFile)
+	}
+	for _, path := range []string{checksumsPath, filepath.Join(dir, ReleaseManifestFile)} {
+		err := verifyFile(path)
+		if err != nil {
+			return fmt.Errorf("verifying signature of %s: %v", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// save writes rm to the file at path as JSON, and, if signed
+// is true, signs it like signFile. The signature is written
+// before the manifest is, so that a signed manifest never
+// lacks its signature.
+func (rm *ReleaseManifest) save(path string, signed bool) error {
+	contents, err := json.MarshalIndent(rm, "", "\t")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so the
+	// file is never partially written
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, contents, 0644)
+	if err != nil {
+		return err
+	}
+	if signed {
+		signature, err := sign(bytes.NewReader(contents))
+		if err != nil {
+			return fmt.Errorf("signing release manifest: %v", err)
+		}
+		err = ioutil.WriteFile(path+".asc", signature.Bytes(), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadReleaseManifest reads the release manifest at path.
+func loadReleaseManifest(path string) (*ReleaseManifest, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rm := new(ReleaseManifest)
+	err = json.Unmarshal(contents, rm)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rm, nil
+}
+
+// sortedBuilds returns the builds in m sorted by platform.
+func sortedBuilds(m map[string]PlatformBuild) []PlatformBuild {
+	builds := make([]PlatformBuild, 0, len(m))
+	for _, b := range m {
+		builds = append(builds, b)
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].Platform.String() < builds[j].Platform.String()
+	})
+	return builds
+}
+
+// signFile signs the file at path and writes the
+// signature next to it, with ".asc" appended.
+func signFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	signature, err := Sign(f)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".asc", signature.Bytes(), 0644)
+}
+
+// verifyFile checks the signature of the file at path,
+// which signFile made, with the public key of Signer.
+func verifyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	signature, err := os.Open(path + ".asc")
+	if err != nil {
+		return err
+	}
+	defer signature.Close()
+	_, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{Signer}, f, signature)
+	return err
+}
+
+// ReleaseFailure is an error making a release that is due
+// to the release, such as a build failing, rather than to
+// the worker, such as a file that could not be written.
+type ReleaseFailure struct {
+	Err error
+}
+
+func (rf *ReleaseFailure) Error() string { return rf.Err.Error() }
+
+func (rf *ReleaseFailure) Unwrap() error { return rf.Err }
+
+// Files in a release folder.
+const (
+	ReleaseManifestFile  = "release.json"
+	ReleaseChecksumsFile = "SHA256SUMS"
+)
@@ -0,0 +1,96 @@
+package buildworker
+
+import (
+	"sync"
+	"time"
+)
+
+// CheckReport is a structured report of the checks
+// run in a build environment and their outcomes.
+type CheckReport struct {
+	mu       sync.Mutex
+	Checks   []CheckResult `json:"checks"`
+	Reverted bool          `json:"reverted,omitempty"` // whether the master GOPATH was reverted
+
+	// Licenses are the licenses detected in the repositories
+	// of checked plugins and their dependencies, by import
+	// path, as SPDX license expressions.
+	Licenses map[string]string `json:"licenses,omitempty"`
+
+	// Vulnerabilities are the known vulnerabilities that
+	// affect checked packages and their dependencies.
+	Vulnerabilities []Vulnerability `json:"vulnerabilities,omitempty"`
+
+	// Findings are the findings of the static analysis
+	// of checked plugins (see Analyzers).
+	Findings []Finding `json:"findings,omitempty"`
+
+	// Registrations are what checked plugins register
+	// with Caddy, such as plugins and server types.
+	Registrations []Registration `json:"registrations,omitempty"`
+}
+
+// CheckResult is the outcome of a single check.
+type CheckResult struct {
+	Name            string  `json:"name"` // vet, test, plugin, build, ...
+	Package         string  `json:"package"`
+	Platform        string  `json:"platform,omitempty"`
+	Passed          bool    `json:"passed"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// add records the result of a check that began at start.
+func (r *CheckReport) add(result CheckResult, start time.Time, err error) {
+	result.DurationSeconds = time.Since(start).Seconds()
+	result.Passed = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	r.mu.Lock()
+	r.Checks = append(r.Checks, result)
+	r.mu.Unlock()
+}
+
+// addLicenses records the licenses of deps.
+func (r *CheckReport) addLicenses(deps []Dependency) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Licenses == nil {
+		r.Licenses = make(map[string]string)
+	}
+	for _, dep := range deps {
+		r.Licenses[dep.Repo] = dep.License
+	}
+}
+
+// addVulnerabilities records vulns.
+func (r *CheckReport) addVulnerabilities(vulns []Vulnerability) {
+	r.mu.Lock()
+	r.Vulnerabilities = append(r.Vulnerabilities, vulns...)
+	r.mu.Unlock()
+}
+
+// addFindings records findings.
+func (r *CheckReport) addFindings(findings []Finding) {
+	r.mu.Lock()
+	r.Findings = append(r.Findings, findings...)
+	r.mu.Unlock()
+}
+
+// addRegistrations records regs.
+func (r *CheckReport) addRegistrations(regs []Registration) {
+	r.mu.Lock()
+	r.Registrations = append(r.Registrations, regs...)
+	r.mu.Unlock()
+}
+
+// check runs fn as the check named name on pkg (and
+// platform, if relevant), and records its outcome in
+// the build environment's report.
+func (be BuildEnv) check(name, pkg, platform string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	be.Report.add(CheckResult{Name: name, Package: pkg, Platform: platform}, start, err)
+	return err
+}
@@ -0,0 +1,63 @@
+package buildworker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SignRequest signs req with key so that the build worker
+// can verify that the request is authentic and has not been
+// replayed. The signature is an HMAC-SHA256 over the method,
+// path, a timestamp, a random nonce, and the body, all of
+// which are set in headers. The body of req is read fully
+// and replaced, so this should be called right before the
+// request is sent (and again if the request is retried).
+func SignRequest(req *http.Request, key []byte) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return fmt.Errorf("reading body: %v", err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	nonceBytes := make([]byte, 16)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		return fmt.Errorf("generating nonce: %v", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, RequestSignature(key, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	return nil
+}
+
+// RequestSignature computes the hex-encoded signature
+// of a request with the given attributes using key.
+func RequestSignature(key []byte, method, path, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", method, path, timestamp, nonce, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Headers that carry request signatures.
+const (
+	SignatureHeader = "X-Buildworker-Signature"
+	TimestampHeader = "X-Buildworker-Timestamp"
+	NonceHeader     = "X-Buildworker-Nonce"
+)
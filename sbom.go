@@ -0,0 +1,312 @@
+package buildworker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dependency is a repository with Go packages
+// that are compiled into a build.
+type Dependency struct {
+	Repo     string   `json:"repo"`             // import path of the repository's root
+	URL      string   `json:"url,omitempty"`    // of the repository's origin
+	Commit   string   `json:"commit,omitempty"` // checked out
+	License  string   `json:"license"`          // SPDX license expression, or NOASSERTION
+	Packages []string `json:"packages"`         // import paths
+
+	dir string // of the repository, in either GOPATH
+}
+
+// Dependencies returns the repositories of the packages that
+// building the target for plat compiles, including the target
+// itself and its plugins but not the standard library, sorted
+// by import path. The plugins must already be plugged in.
+// Vendored packages belong to the repository that vendors them.
+func (be BuildEnv) Dependencies(plat Platform) ([]Dependency, error) {
+	dir := filepath.Join(be.TemporaryPath(be.target.Package), filepath.FromSlash(be.target.MainDir))
+	return be.dependencies(plat, dir, ".")
+}
+
+// dependencies is like Dependencies, but for the packages
+// matching pattern in the folder dir, such as "./...".
+func (be BuildEnv) dependencies(plat Platform, dir, pattern string) ([]Dependency, error) {
+	cmd := be.newGoCommand(plat, "list", "-deps", "-f", "{{if not .Standard}}{{.ImportPath}}\t{{.Dir}}{{end}}", pattern)
+	cmd.Dir = dir
+	var out bytes.Buffer
+	cmd.Stdout = &out // output is needed here, not in the log
+	err := be.runCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("listing dependencies: %v", err)
+	}
+
+	repos := make(map[string]*Dependency)
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		pkg, dir := fields[0], fields[1]
+		repoDir, repo, ok := be.repoRoot(dir)
+		if !ok {
+			// not in a repository, so nothing
+			// can be said about it but its name
+			repoDir, repo = dir, pkg
+		}
+		dep, ok := repos[repo]
+		if !ok {
+			dep = &Dependency{Repo: repo, dir: repoDir, License: detectLicense(repoDir)}
+			dep.Commit, _ = gitHead(repoDir)
+			dep.URL, _ = gitRemoteURL(repoDir)
+			repos[repo] = dep
+		}
+		dep.Packages = append(dep.Packages, pkg)
+	}
+
+	deps := make([]Dependency, 0, len(repos))
+	for _, dep := range repos {
+		sort.Strings(dep.Packages)
+		deps = append(deps, *dep)
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Repo < deps[j].Repo })
+	return deps, nil
+}
+
+// dependenciesOf is like dependencies, but returns the
+// repositories of the packages compiled for any of
+// platforms, each with the packages of all of them.
+func (be BuildEnv) dependenciesOf(platforms []Platform, dir, pattern string) ([]Dependency, error) {
+	repos := make(map[string]*Dependency)
+	for _, plat := range platforms {
+		deps, err := be.dependencies(plat, dir, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", plat, err)
+		}
+		for _, dep := range deps {
+			union, ok := repos[dep.Repo]
+			if !ok {
+				dep := dep
+				repos[dep.Repo] = &dep
+				continue
+			}
+			for _, pkg := range dep.Packages {
+				if !containsString(union.Packages, pkg) {
+					union.Packages = append(union.Packages, pkg)
+				}
+			}
+		}
+	}
+
+	deps := make([]Dependency, 0, len(repos))
+	for _, dep := range repos {
+		sort.Strings(dep.Packages)
+		deps = append(deps, *dep)
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Repo < deps[j].Repo })
+	return deps, nil
+}
+
+// repoRoot returns the top-level folder of the repository
+// that the folder dir is in and the import path of that
+// folder, or false if dir is not in a repository in the
+// temporary or master GOPATH.
+func (be BuildEnv) repoRoot(dir string) (string, string, bool) {
+	for _, gopath := range []string{be.tmpGopath, be.masterGopath} {
+		src := filepath.Join(gopath, "src") + string(filepath.Separator)
+		for fp := dir; strings.HasPrefix(fp, src); fp = filepath.Dir(fp) {
+			if dirExists(filepath.Join(fp, ".git")) {
+				return fp, filepath.ToSlash(strings.TrimPrefix(fp, src)), true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// gitRemoteURL returns the URL of the origin
+// of the repository at dir.
+func gitRemoteURL(dir string) (string, error) {
+	cmd := exec.Command("git", "config", "--get", "remote.origin.url")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// spdxDocument is an SPDX 2.3 document, in JSON.
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string            `json:"name"`
+	SPDXID                string            `json:"SPDXID"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	LicenseConcluded      string            `json:"licenseConcluded"`
+	LicenseDeclared       string            `json:"licenseDeclared"`
+	CopyrightText         string            `json:"copyrightText"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+	Comment               string            `json:"comment,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// SBOM returns a software bill of materials, named name,
+// of the build of the target for plat: an SPDX 2.3 document
+// in JSON with a package for each of the Dependencies, which
+// the target depends on. The plugins must already be plugged
+// in.
+func (be BuildEnv) SBOM(name string, plat Platform) ([]byte, error) {
+	deps, err := be.Dependencies(plat)
+	if err != nil {
+		return nil, err
+	}
+	return be.sbom(name, deps)
+}
+
+// sbom returns the SBOM named name of a build of the
+// target with deps, the Dependencies of the build.
+func (be BuildEnv) sbom(name string, deps []Dependency) ([]byte, error) {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/%s-%x", name, nonce),
+		CreationInfo: spdxCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: buildworker"},
+		},
+	}
+	targetID := spdxID(be.target.Package)
+	doc.Relationships = append(doc.Relationships, spdxRelationship{
+		SPDXElementID:      doc.SPDXID,
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: targetID,
+	})
+	for _, dep := range deps {
+		pkg := spdxPackage{
+			Name:                  dep.Repo,
+			SPDXID:                spdxID(dep.Repo),
+			VersionInfo:           dep.Commit,
+			DownloadLocation:      "NOASSERTION",
+			LicenseConcluded:      dep.License,
+			LicenseDeclared:       dep.License,
+			CopyrightText:         "NOASSERTION",
+			PrimaryPackagePurpose: "LIBRARY",
+			Comment:               "Go packages: " + strings.Join(dep.Packages, ", "),
+		}
+		if dep.Commit != "" {
+			if strings.HasPrefix(dep.URL, "https://") || strings.HasPrefix(dep.URL, "http://") {
+				pkg.DownloadLocation = "git+" + dep.URL + "@" + dep.Commit
+			}
+			pkg.ExternalRefs = []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  "pkg:golang/" + dep.Repo + "@" + dep.Commit,
+			}}
+		}
+		if pkg.SPDXID == targetID {
+			pkg.PrimaryPackagePurpose = "APPLICATION"
+		} else {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				SPDXElementID:      targetID,
+				RelationshipType:   "DEPENDS_ON",
+				RelatedSPDXElement: pkg.SPDXID,
+			})
+		}
+		doc.Packages = append(doc.Packages, pkg)
+	}
+	return json.MarshalIndent(doc, "", "\t")
+}
+
+// spdxIDChars are the characters that
+// SPDX identifiers cannot have.
+var spdxIDChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// spdxID returns the SPDX identifier of the
+// package of the repository at import path repo.
+// Replacing characters can make the paths of two
+// repositories the same, so a hash of repo is added.
+func spdxID(repo string) string {
+	sum := sha256.Sum256([]byte(repo))
+	return "SPDXRef-Package-" + spdxIDChars.ReplaceAllString(repo, "-") +
+		"-" + hex.EncodeToString(sum[:4])
+}
+
+// writeSBOM writes the SBOM named name of a build
+// with deps to the file at path.
+func (be BuildEnv) writeSBOM(name string, deps []Dependency, path string) error {
+	contents, err := be.sbom(name, deps)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, contents, 0644)
+}
+
+// SBOMPath returns the path of the SBOM of the
+// archive at archivePath, which Build writes
+// next to the archive.
+func SBOMPath(archivePath string) string {
+	return archivePath + SBOMExt
+}
+
+// sbomOf returns the file name and the hex-encoded SHA-256
+// checksum of the SBOM of the archive at archivePath, or ""
+// if it has none.
+func sbomOf(archivePath string) (string, string, error) {
+	path := SBOMPath(archivePath)
+	sum, err := fileSHA256(path)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Base(path), sum, nil
+}
+
+// SBOMExt is the file extension of SBOMs.
+const SBOMExt = ".spdx.json"
@@ -0,0 +1,156 @@
+package buildworker
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SmokeTest enables smoke tests of builds: before a binary
+// is archived, it is run with the target's VersionFlag and
+// PluginsFlag, and the build fails unless it reports the
+// version it was built at and lists every plugin. Only
+// binaries of the host platform, or of platforms that have
+// an emulator in the platform matrix, are smoke tested.
+var SmokeTest bool
+
+// smokeTestTimeout is how long a binary
+// may run for in a smoke test.
+const smokeTestTimeout = time.Minute
+
+// smokeTest runs the binary at path, which was built for plat,
+// with the target's VersionFlag and PluginsFlag, and returns an
+// error if its output is not as expected. It does nothing if
+// binaries of plat cannot be run here.
+func (be BuildEnv) smokeTest(plat Platform, path string) error {
+	var command []string
+	if plat.OS == runtime.GOOS && plat.Arch == runtime.GOARCH {
+		command = []string{path}
+	} else if emulator := Matrix.Settings(plat).Emulator; len(emulator) > 0 {
+		command = append(append(command, emulator...), path)
+	} else {
+		be.log.Info("not smoke testing", "platform", plat.String(), "reason", "no emulator")
+		return nil
+	}
+
+	if be.target.VersionFlag != "" && be.target.LdFlagsPackage != "" {
+		out, err := be.runBinary(command, be.target.VersionFlag)
+		if err != nil {
+			return err
+		}
+		version, err := expectedVersion(be.TemporaryPath(be.target.Package))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(out, version) && !strings.Contains(out, strings.TrimPrefix(version, "v")) {
+			return fmt.Errorf("%s %s reported version '%s', not %s",
+				be.target.Name, be.target.VersionFlag, strings.TrimSpace(out), version)
+		}
+	}
+
+	if be.target.PluginsFlag != "" && be.target.Package == CaddyPackage && len(be.pkgs) > 1 {
+		out, err := be.runBinary(command, be.target.PluginsFlag)
+		if err != nil {
+			return err
+		}
+		listed := make(map[string]bool)
+		for _, line := range strings.Split(out, "\n") {
+			listed[strings.TrimSpace(line)] = true
+		}
+		var missing []string
+		for pkg := range be.pkgs {
+			if pkg == be.target.Package {
+				continue
+			}
+			names, err := be.pluginNames(pkg)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				if !listed[name] {
+					missing = append(missing, fmt.Sprintf("%s (of %s)", name, pkg))
+				}
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return fmt.Errorf("%s %s does not list %s",
+				be.target.Name, be.target.PluginsFlag, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+// runBinary runs command with the argument arg,
+// and returns its output (stdout and stderr).
+func (be BuildEnv) runBinary(command []string, arg string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), smokeTestTimeout)
+	defer cancel()
+	args := append(append([]string{}, command[1:]...), arg)
+	cmd := exec.CommandContext(ctx, command[0], args...)
+	cmd.Env = []string{"HOME=" + be.tmpGopath} // so it does not touch ours
+	be.log.Info("smoke test", "command", command[0]+" "+strings.Join(args, " "))
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return string(out), fmt.Errorf("%s %s: timed out after %v", be.target.Name, arg, smokeTestTimeout)
+	}
+	if err != nil {
+		return string(out), fmt.Errorf("%s %s: %v: %s", be.target.Name, arg, err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// expectedVersion returns the version that a binary of the
+// program in repoPath reports, according to the variables
+// set at link time: its tag, or else its commit.
+func expectedVersion(repoPath string) (string, error) {
+	vars, err := ldFlagVars(repoPath)
+	if err != nil {
+		return "", err
+	}
+	values := make(map[string]string)
+	for _, v := range vars {
+		values[v.name] = v.value
+	}
+	if values["gitTag"] != "" {
+		return values["gitTag"], nil
+	}
+	return values["gitCommit"], nil
+}
+
+// pluginNames returns the names that Caddy lists the
+// plugin pkg under when it is run with -plugins: the
+// names it registers, qualified by server type.
+func (be BuildEnv) pluginNames(pkg string) ([]string, error) {
+	roots, err := be.loadPackages(be.TemporaryPath(pkg), ".")
+	if err != nil {
+		return nil, err
+	}
+	regs, err := be.registrations(pkg, roots)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, reg := range regs {
+		if reg.Name == "" {
+			continue // not known without running it
+		}
+		switch reg.Kind {
+		case "plugin":
+			if reg.ServerType != "" {
+				names = append(names, reg.ServerType+"."+reg.Name)
+			} else {
+				names = append(names, reg.Name)
+			}
+		case "dns provider":
+			names = append(names, "tls.dns."+reg.Name)
+		case "server type", "caddyfile loader", "event hook":
+			names = append(names, reg.Name)
+		}
+	}
+	return names, nil
+}
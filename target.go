@@ -0,0 +1,158 @@
+package buildworker
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// Target describes a program that build environments
+// build and deploy: a core package, into which plugins
+// are plugged in by importing them for their side effects.
+// File paths are relative to the core package's folder
+// and use forward slashes.
+type Target struct {
+	// Name is the name of the program and its binary.
+	Name string `json:"name"`
+
+	// Package is the import path of the core package,
+	// which is the root of its repository.
+	Package string `json:"package"`
+
+	// MainDir is the folder of the main package.
+	MainDir string `json:"main_dir"`
+
+	// PluginFile is the Go file to which imports
+	// of plugins are added.
+	PluginFile string `json:"plugin_file"`
+
+	// LdFlagsPackage, if set, is the package in which the
+	// variables buildDate, gitTag, gitNearestTag, gitCommit,
+	// gitShortStat, and gitFilesModified are set at link time.
+	LdFlagsPackage string `json:"ldflags_package,omitempty"`
+
+	// VersionFlag and PluginsFlag, if set, are the flags
+	// with which the binary prints its version and the
+	// plugins it has, for smoke tests; see SmokeTest.
+	VersionFlag string `json:"version_flag,omitempty"`
+	PluginsFlag string `json:"plugins_flag,omitempty"`
+
+	// DistFiles are the files and folders that are
+	// put in archives along with the binary.
+	DistFiles []string `json:"dist_files,omitempty"`
+
+	// ServiceFiles maps files among the DistFiles (or in
+	// folders among them) to the absolute paths where Linux
+	// packages install them, such as service definitions.
+	// Packages install the other dist files as documentation.
+	ServiceFiles map[string]string `json:"service_files,omitempty"`
+
+	// Description, Maintainer, and Homepage describe the
+	// program in Linux packages. The first line of the
+	// description is its summary.
+	Description string `json:"description,omitempty"`
+	Maintainer  string `json:"maintainer,omitempty"`
+	Homepage    string `json:"homepage,omitempty"`
+
+	// ArchiveName is the template (text/template) of the
+	// names of archives, without extension; it is executed
+	// with an ArchiveNameData.
+	ArchiveName string `json:"archive_name"`
+}
+
+// ArchiveNameData is what a Target's ArchiveName
+// template is executed with.
+type ArchiveNameData struct {
+	Name    string
+	Version string // version of the core package; commits are shortened
+	OS      string
+	Arch    string
+	ARM     string
+	Custom  bool // true if plugins are plugged in
+}
+
+// Validate returns an error if t is incomplete
+// or any of its paths or its template is invalid.
+func (t Target) Validate() error {
+	if t.Name == "" || t.Package == "" || t.MainDir == "" || t.PluginFile == "" || t.ArchiveName == "" {
+		return fmt.Errorf("target must have a name, package, main_dir, plugin_file, and archive_name")
+	}
+	if strings.ContainsAny(t.Name, `/\`) {
+		return fmt.Errorf("target name must not contain slashes: %s", t.Name)
+	}
+	for _, p := range append([]string{t.MainDir, t.PluginFile}, t.DistFiles...) {
+		if path.IsAbs(p) || p != path.Clean(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("target path must be relative to the core package: %s", p)
+		}
+	}
+	for src, dest := range t.ServiceFiles {
+		if path.IsAbs(src) || src != path.Clean(src) || src == ".." || strings.HasPrefix(src, "../") {
+			return fmt.Errorf("target path must be relative to the core package: %s", src)
+		}
+		if !path.IsAbs(dest) || dest != path.Clean(dest) {
+			return fmt.Errorf("service file must be installed at a clean absolute path: %s", dest)
+		}
+	}
+	for _, flag := range []string{t.VersionFlag, t.PluginsFlag} {
+		if flag != "" && !strings.HasPrefix(flag, "-") {
+			return fmt.Errorf("target flag must begin with a hyphen: %s", flag)
+		}
+	}
+	if !strings.HasSuffix(t.PluginFile, ".go") {
+		return fmt.Errorf("plugin file must be a Go file: %s", t.PluginFile)
+	}
+	_, err := t.archiveName(ArchiveNameData{Name: t.Name, Version: "v1.0.0", OS: "linux", Arch: "amd64"})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// archiveName returns the name of an archive
+// (without extension) described by data.
+func (t Target) archiveName(data ArchiveNameData) (string, error) {
+	tpl, err := template.New("archive_name").Parse(t.ArchiveName)
+	if err != nil {
+		return "", fmt.Errorf("parsing archive name template: %v", err)
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("executing archive name template: %v", err)
+	}
+	name := buf.String()
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid archive name: '%s'", name)
+	}
+	return name, nil
+}
+
+// Caddy is the target that builds Caddy.
+var Caddy = Target{
+	Name:           "caddy",
+	Package:        CaddyPackage,
+	MainDir:        "caddy",
+	PluginFile:     "caddy/caddymain/run.go",
+	LdFlagsPackage: CaddyPackage + "/caddy/caddymain",
+	VersionFlag:    "-version",
+	PluginsFlag:    "-plugins",
+	DistFiles: []string{
+		"dist/README.txt",
+		"dist/LICENSES.txt",
+		"dist/CHANGES.txt",
+		"dist/init",
+	},
+	ServiceFiles: map[string]string{
+		"dist/init/linux-systemd/caddy.service": "/lib/systemd/system/caddy.service",
+	},
+	Description: "Fast, cross-platform HTTP/2 web server with automatic HTTPS",
+	Maintainer:  "The Caddy Authors",
+	Homepage:    "https://caddyserver.com",
+	ArchiveName: `{{.Name}}_{{.Version}}_{{.OS}}_{{.Arch}}{{if eq .Arch "arm"}}{{.ARM}}{{end}}{{if .Custom}}_custom{{end}}`,
+}
+
+// DefaultTarget is the target of build
+// environments that are opened without one.
+var DefaultTarget = Caddy
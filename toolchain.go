@@ -0,0 +1,142 @@
+package buildworker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Toolchains maps the versions of the Go toolchains that
+// can be selected for builds (e.g. "go1.21.5") to their
+// GOROOT. Build environments that do not select a version
+// use the go command on the PATH. Set it (for example with
+// RegisterToolchain) before opening build environments.
+var Toolchains = make(map[string]string)
+
+// RegisterToolchain adds the Go toolchain at goroot
+// to Toolchains and returns its version.
+func RegisterToolchain(goroot string) (string, error) {
+	goroot, err := filepath.Abs(goroot)
+	if err != nil {
+		return "", err
+	}
+	version, err := goVersion(toolchainCommand(goroot, "version"))
+	if err != nil {
+		return "", fmt.Errorf("toolchain in %s: %v", goroot, err)
+	}
+	if other, ok := Toolchains[version]; ok && other != goroot {
+		return "", fmt.Errorf("toolchain in %s: %s is already in %s", goroot, version, other)
+	}
+	Toolchains[version] = goroot
+	return version, nil
+}
+
+// ToolchainVersion returns the version of the toolchain
+// selected by version (see LookupToolchain) as reported by
+// its go command, like "go1.21.5". Unlike version, it is
+// never empty, so it identifies the toolchain on the PATH.
+func ToolchainVersion(version string) (string, error) {
+	goroot, err := LookupToolchain(version)
+	if err != nil {
+		return "", err
+	}
+	return goVersion(toolchainCommand(goroot, "version"))
+}
+
+// InstalledToolchains returns the versions
+// in Toolchains, sorted.
+func InstalledToolchains() []string {
+	versions := make([]string, 0, len(Toolchains))
+	for version := range Toolchains {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// LookupToolchain returns the GOROOT of the given version
+// of Go, which may be given with or without the "go" prefix.
+// An empty version selects the go command on the PATH,
+// which has an empty GOROOT.
+func LookupToolchain(version string) (string, error) {
+	if version == "" {
+		return "", nil
+	}
+	goroot, ok := Toolchains[normalizeGoVersion(version)]
+	if !ok {
+		return "", fmt.Errorf("Go toolchain %s is not installed; installed: %s",
+			version, strings.Join(InstalledToolchains(), ", "))
+	}
+	return goroot, nil
+}
+
+// GoVersion returns the version of the Go
+// toolchain that be builds with.
+func (be BuildEnv) GoVersion() (string, error) {
+	cmd := be.newCommand("go", "version")
+	cmd.Stdout = nil // output is needed here, not in the log
+	return goVersion(cmd)
+}
+
+// goVersion runs cmd, which must be `go version`, and
+// returns the version from its output, like "go1.21.5".
+func goVersion(cmd *exec.Cmd) (string, error) {
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	// go version go1.21.5 linux/amd64
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 || !strings.HasPrefix(fields[2], "go") {
+		return "", fmt.Errorf("unexpected output of go version: %s", out)
+	}
+	return fields[2], nil
+}
+
+// normalizeGoVersion adds the "go" prefix
+// to version if it doesn't have it.
+func normalizeGoVersion(version string) string {
+	if strings.HasPrefix(version, "go") {
+		return version
+	}
+	return "go" + version
+}
+
+// goBinary returns the path to the go
+// command of the toolchain at goroot.
+func goBinary(goroot string) string {
+	name := "go"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return filepath.Join(goroot, "bin", name)
+}
+
+// toolchainCommand prepares the go command of the toolchain
+// at goroot (the one on the PATH if empty) with the given
+// arguments, in the environment of this process.
+func toolchainCommand(goroot string, args ...string) *exec.Cmd {
+	command := "go"
+	if goroot != "" {
+		command = goBinary(goroot)
+	}
+	cmd := exec.Command(command, args...)
+	cmd.Env = append(os.Environ(), toolchainEnv(goroot)...)
+	return cmd
+}
+
+// toolchainEnv returns the environment variables that
+// select the toolchain at goroot, if not empty.
+func toolchainEnv(goroot string) []string {
+	if goroot == "" {
+		return []string{"PATH=" + os.Getenv("PATH")}
+	}
+	return []string{
+		"GOROOT=" + goroot,
+		"PATH=" + filepath.Join(goroot, "bin") + string(os.PathListSeparator) + os.Getenv("PATH"),
+	}
+}
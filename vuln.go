@@ -0,0 +1,432 @@
+package buildworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// AdvisoryDB is the folder of the advisory database that
+// dependencies are checked against for vulnerabilities: OSV
+// entries of the Go ecosystem as JSON files (in any subfolder),
+// such as those of https://osv.dev. The database is not synced
+// by the build worker. If empty, nothing is checked.
+var AdvisoryDB string
+
+// VulnerabilityPolicy is what checks do when dependencies
+// are affected by vulnerabilities: "fail" fails the check,
+// and "warn" only reports them.
+var VulnerabilityPolicy = "fail"
+
+// Vulnerability is an advisory that affects a dependency.
+type Vulnerability struct {
+	ID       string   `json:"id"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Summary  string   `json:"summary,omitempty"`
+	Repo     string   `json:"repo"`               // of the affected dependency
+	Version  string   `json:"version"`            // of the dependency, as a Go module version
+	Fixed    string   `json:"fixed,omitempty"`    // the first version that is not affected, if known
+	Packages []string `json:"packages,omitempty"` // affected packages, if the advisory lists any
+}
+
+// VulnReport is the outcome of checking
+// dependencies for vulnerabilities.
+type VulnReport struct {
+	// Platforms are those whose builds were checked;
+	// Dependencies are of a build for any of them.
+	Platforms       []Platform      `json:"platforms"`
+	Dependencies    []Dependency    `json:"dependencies"`
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+}
+
+// osvEntry is an entry of an OSV database; see
+// https://ossf.github.io/osv-schema/.
+type osvEntry struct {
+	ID        string        `json:"id"`
+	Aliases   []string      `json:"aliases"`
+	Summary   string        `json:"summary"`
+	Withdrawn string        `json:"withdrawn"`
+	Affected  []osvAffected `json:"affected"`
+}
+
+type osvAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"` // module path
+	} `json:"package"`
+	Ranges            []osvRange `json:"ranges"`
+	Versions          []string   `json:"versions"`
+	EcosystemSpecific struct {
+		Imports []struct {
+			Path string `json:"path"`
+		} `json:"imports"`
+	} `json:"ecosystem_specific"`
+}
+
+type osvRange struct {
+	Type   string     `json:"type"` // SEMVER, GIT, or ECOSYSTEM
+	Events []osvEvent `json:"events"`
+}
+
+type osvEvent struct {
+	Introduced   string `json:"introduced,omitempty"`
+	Fixed        string `json:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty"`
+	Limit        string `json:"limit,omitempty"`
+}
+
+// CheckVulnerabilities plugs in the plugins and checks the
+// dependencies of the builds of the target for the host and
+// every supported platform against AdvisoryDB, since which
+// packages are compiled depends on the platform.
+func (be BuildEnv) CheckVulnerabilities() (*VulnReport, error) {
+	if AdvisoryDB == "" {
+		return nil, fmt.Errorf("no advisory database configured")
+	}
+	err := be.plugIn()
+	if err != nil {
+		return nil, err
+	}
+	platforms, err := supportedPlatforms(UnsupportedPlatforms, be.goroot)
+	if err != nil {
+		return nil, fmt.Errorf("getting supported platforms: %v", err)
+	}
+	platforms = withHostPlatform(platforms)
+	dir := filepath.Join(be.TemporaryPath(be.target.Package), filepath.FromSlash(be.target.MainDir))
+	deps, err := be.dependenciesOf(platforms, dir, ".")
+	if err != nil {
+		return nil, err
+	}
+	vulns, err := findVulnerabilities(deps)
+	if err != nil {
+		return nil, err
+	}
+	return &VulnReport{Platforms: platforms, Dependencies: deps, Vulnerabilities: vulns}, nil
+}
+
+// checkVulnerabilities checks the package pkg and the repositories
+// of the packages it imports, when built for the host or any of
+// platforms, against AdvisoryDB and records the vulnerabilities
+// that affect them in the report. It returns an error if there
+// are any, unless VulnerabilityPolicy is "warn".
+func (be BuildEnv) checkVulnerabilities(pkg string, platforms []Platform) error {
+	deps, err := be.dependenciesOf(withHostPlatform(platforms), be.TemporaryPath(pkg), "./...")
+	if err != nil {
+		return err
+	}
+	vulns, err := findVulnerabilities(deps)
+	if err != nil {
+		return err
+	}
+	be.Report.addVulnerabilities(vulns)
+	if len(vulns) == 0 {
+		return nil
+	}
+	var found []string
+	for _, v := range vulns {
+		found = append(found, fmt.Sprintf("%s in %s@%s", v.ID, v.Repo, v.Version))
+	}
+	if VulnerabilityPolicy == "warn" {
+		be.log.Warn("vulnerable dependencies", "phase", "check", "package", pkg, "vulnerabilities", found)
+		return nil
+	}
+	return fmt.Errorf("vulnerable dependencies: %s", strings.Join(found, "; "))
+}
+
+// withHostPlatform returns platforms with the host
+// platform first, and without duplicates.
+func withHostPlatform(platforms []Platform) []Platform {
+	host := Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}
+	return uniquePlatforms(append([]Platform{host}, platforms...))
+}
+
+// findVulnerabilities returns the vulnerabilities in
+// AdvisoryDB that affect deps.
+func findVulnerabilities(deps []Dependency) ([]Vulnerability, error) {
+	advisories, err := loadAdvisories(AdvisoryDB)
+	if err != nil {
+		return nil, fmt.Errorf("loading advisory database: %v", err)
+	}
+	vulns := []Vulnerability{}
+	for _, dep := range deps {
+		if dep.Commit == "" {
+			continue // not in a repository, so its version is unknown
+		}
+		var version string // determined only if needed
+		for module, entries := range advisories {
+			if !modulePathMatches(module, dep) {
+				continue
+			}
+			if version == "" {
+				version, err = moduleVersion(dep.dir)
+				if err != nil {
+					return nil, fmt.Errorf("getting version of %s: %v", dep.Repo, err)
+				}
+			}
+			if !moduleMajorMatches(module, dep.Repo, version) {
+				continue
+			}
+			for _, entry := range entries {
+				for _, affected := range entry.Affected {
+					if affected.Package.Name != module {
+						continue
+					}
+					vuln, ok := affects(affected, dep, version)
+					if !ok {
+						continue
+					}
+					vuln.ID, vuln.Aliases, vuln.Summary = entry.ID, entry.Aliases, entry.Summary
+					vulns = append(vulns, vuln)
+				}
+			}
+		}
+	}
+	sort.Slice(vulns, func(i, j int) bool {
+		if vulns[i].Repo != vulns[j].Repo {
+			return vulns[i].Repo < vulns[j].Repo
+		}
+		return vulns[i].ID < vulns[j].ID
+	})
+	return vulns, nil
+}
+
+// affects returns the vulnerability of affected in dep,
+// which is at version, if it is affected.
+func affects(affected osvAffected, dep Dependency, version string) (Vulnerability, bool) {
+	vuln := Vulnerability{Repo: dep.Repo, Version: version}
+
+	// only the packages that are compiled matter
+	if imports := affected.EcosystemSpecific.Imports; len(imports) > 0 {
+		for _, imp := range imports {
+			for _, pkg := range dep.Packages {
+				if pkg == imp.Path {
+					vuln.Packages = append(vuln.Packages, pkg)
+				}
+			}
+		}
+		if len(vuln.Packages) == 0 {
+			return vuln, false
+		}
+	}
+
+	for _, v := range affected.Versions {
+		if "v"+strings.TrimPrefix(v, "v") == version {
+			return vuln, true
+		}
+	}
+	for _, r := range affected.Ranges {
+		var vulnerable bool
+		switch r.Type {
+		case "SEMVER":
+			vulnerable, vuln.Fixed = semverAffected(version, r.Events)
+		case "GIT":
+			vulnerable = gitAffected(dep.dir, r.Events)
+		}
+		if vulnerable {
+			return vuln, true
+		}
+	}
+	return vuln, false
+}
+
+// semverAffected returns whether version is in the
+// range with events, and the version that fixes it.
+func semverAffected(version string, events []osvEvent) (bool, string) {
+	canonical := func(v string) string {
+		if v == "0" {
+			return "v0.0.0-0" // before anything else
+		}
+		return "v" + strings.TrimPrefix(v, "v")
+	}
+	eventVersion := func(e osvEvent) string {
+		return canonical(e.Introduced + e.Fixed + e.LastAffected + e.Limit)
+	}
+	events = append([]osvEvent(nil), events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return semver.Compare(eventVersion(events[i]), eventVersion(events[j])) < 0
+	})
+
+	var affected bool
+	for _, e := range events {
+		switch {
+		case e.Introduced != "":
+			if semver.Compare(version, canonical(e.Introduced)) >= 0 {
+				affected = true
+			}
+		case e.Fixed != "":
+			if semver.Compare(version, canonical(e.Fixed)) >= 0 {
+				affected = false
+			} else if affected {
+				return true, canonical(e.Fixed)
+			}
+		case e.LastAffected != "":
+			if semver.Compare(version, canonical(e.LastAffected)) > 0 {
+				affected = false
+			}
+		case e.Limit != "":
+			if semver.Compare(version, canonical(e.Limit)) >= 0 {
+				affected = false
+			}
+		}
+	}
+	return affected, ""
+}
+
+// gitAffected returns whether the commit checked out in
+// the repository at dir is in the range with events:
+// after a commit that introduced the vulnerability, and
+// not after a commit that fixed it.
+func gitAffected(dir string, events []osvEvent) bool {
+	var introduced, fixed bool
+	for _, e := range events {
+		switch {
+		case e.Introduced == "0":
+			introduced = true
+		case e.Introduced != "":
+			introduced = introduced || gitIsAncestor(dir, e.Introduced)
+		case e.Fixed != "":
+			fixed = fixed || gitIsAncestor(dir, e.Fixed)
+		}
+	}
+	return introduced && !fixed
+}
+
+// gitIsAncestor returns whether commit is
+// HEAD or an ancestor of it in the repository
+// at dir.
+func gitIsAncestor(dir, commit string) bool {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", commit, "HEAD")
+	cmd.Dir = dir
+	return cmd.Run() == nil
+}
+
+// majorSuffix matches the major version
+// suffix of module paths, like "/v2".
+var majorSuffix = regexp.MustCompile(`/v[2-9][0-9]*$`)
+
+// modulePathMatches returns whether the module path module
+// could be of the repository of dep: it is the repository,
+// the repository with a major version suffix, or a module
+// nested in it that has packages of dep.
+func modulePathMatches(module string, dep Dependency) bool {
+	if module == dep.Repo || majorSuffix.ReplaceAllString(module, "") == dep.Repo {
+		return true
+	}
+	if !strings.HasPrefix(module, dep.Repo+"/") {
+		return false
+	}
+	for _, pkg := range dep.Packages {
+		if pkg == module || strings.HasPrefix(pkg, module+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleMajorMatches returns whether the major version
+// suffix of module, if it is repo with one, is that of
+// version, which repo is at.
+func moduleMajorMatches(module, repo, version string) bool {
+	suffix := strings.TrimPrefix(module, repo)
+	if majorSuffix.MatchString(suffix) && strings.Count(suffix, "/") == 1 {
+		return "/"+semver.Major(version) == suffix
+	}
+	return true
+}
+
+// moduleVersion returns the version of the commit checked out
+// in the repository at dir as a Go module would have it: its
+// semantic version tag, or else a pseudo-version based on the
+// nearest such tag.
+func moduleVersion(dir string) (string, error) {
+	run := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+
+	tag, err := run("describe", "--tags", "--exact-match", "--match", "v[0-9]*", "HEAD")
+	if err == nil && semver.IsValid(tag) && semver.Build(tag) == "" {
+		return semver.Canonical(tag), nil
+	}
+
+	info, err := run("show", "-s", "--format=%ct %H", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(info)
+	if len(fields) != 2 || len(fields[1]) < 12 {
+		return "", fmt.Errorf("unexpected output of git show: %s", info)
+	}
+	var unix int64
+	_, err = fmt.Sscan(fields[0], &unix)
+	if err != nil {
+		return "", fmt.Errorf("parsing commit time: %v", err)
+	}
+	suffix := time.Unix(unix, 0).UTC().Format("20060102150405") + "-" + fields[1][:12]
+
+	// the pseudo-version sorts after the nearest tag, if any
+	base, err := run("describe", "--tags", "--abbrev=0", "--match", "v[0-9]*", "HEAD")
+	if err != nil || !semver.IsValid(base) {
+		return "v0.0.0-" + suffix, nil
+	}
+	base = semver.Canonical(base)
+	if semver.Prerelease(base) != "" {
+		return base + ".0." + suffix, nil
+	}
+	var major, minor, patch int
+	_, err = fmt.Sscanf(base, "v%d.%d.%d", &major, &minor, &patch)
+	if err != nil {
+		return "v0.0.0-" + suffix, nil
+	}
+	return fmt.Sprintf("v%d.%d.%d-0.%s", major, minor, patch+1, suffix), nil
+}
+
+// loadAdvisories reads the OSV entries of the Go ecosystem
+// in the folder dir, keyed by the module paths they affect.
+// Withdrawn entries are skipped.
+func loadAdvisories(dir string) (map[string][]osvEntry, error) {
+	advisories := make(map[string][]osvEntry)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var entry osvEntry
+		err = json.Unmarshal(contents, &entry)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if entry.ID == "" || entry.Withdrawn != "" {
+			return nil
+		}
+		seen := make(map[string]bool)
+		for _, affected := range entry.Affected {
+			name := affected.Package.Name
+			if affected.Package.Ecosystem != "Go" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			advisories[name] = append(advisories[name], entry)
+		}
+		return nil
+	})
+	return advisories, err
+}
@@ -0,0 +1,117 @@
+package buildworker
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestSemverAffected(t *testing.T) {
+	// GO-2023-1571, of the standard library
+	stdlib := []osvEvent{
+		{Introduced: "0"}, {Fixed: "1.19.6"},
+		{Introduced: "1.20.0-0"}, {Fixed: "1.20.1"},
+	}
+	// GO-2022-0969, of golang.org/x/net
+	xnet := []osvEvent{
+		{Introduced: "0"}, {Fixed: "0.0.0-20220906165146-f3363e06e74c"},
+	}
+	// events in any order, as some databases have them
+	unsorted := []osvEvent{
+		{Fixed: "2.3.1"}, {Introduced: "2.0.0"},
+		{Fixed: "1.4.0"}, {Introduced: "1.2.0"},
+	}
+	lastAffected := []osvEvent{{Introduced: "1.0.0"}, {LastAffected: "1.2.5"}}
+	limit := []osvEvent{{Introduced: "0"}, {Limit: "2.0.0"}}
+
+	for i, test := range []struct {
+		version     string
+		events      []osvEvent
+		expect      bool
+		expectFixed string
+	}{
+		{"v1.19.5", stdlib, true, "v1.19.6"},
+		{"v1.0.0", stdlib, true, "v1.19.6"},
+		{"v1.19.6", stdlib, false, ""},
+		{"v1.19.13", stdlib, false, ""},
+		{"v1.20.0-rc.1", stdlib, true, "v1.20.1"},
+		{"v1.20.0", stdlib, true, "v1.20.1"},
+		{"v1.20.1", stdlib, false, ""},
+		{"v1.21.0", stdlib, false, ""},
+		{"v0.0.0-20220822230855-b0a4917ee28c", xnet, true, "v0.0.0-20220906165146-f3363e06e74c"},
+		{"v0.0.0-20220906165146-f3363e06e74c", xnet, false, ""},
+		{"v0.1.0", xnet, false, ""},
+		{"v1.1.0", unsorted, false, ""},
+		{"v1.3.0", unsorted, true, "v1.4.0"},
+		{"v1.5.0", unsorted, false, ""},
+		{"v2.3.0", unsorted, true, "v2.3.1"},
+		{"v2.4.0", unsorted, false, ""},
+		{"v0.9.0", lastAffected, false, ""},
+		{"v1.2.5", lastAffected, true, ""},
+		{"v1.2.6", lastAffected, false, ""},
+		{"v1.9.9", limit, true, ""},
+		{"v2.0.0", limit, false, ""},
+	} {
+		actual, fixed := semverAffected(test.version, test.events)
+		if actual != test.expect || fixed != test.expectFixed {
+			t.Errorf("Test %d (%s): expected (%v, '%s'), got (%v, '%s')",
+				i, test.version, test.expect, test.expectFixed, actual, fixed)
+		}
+	}
+}
+
+func TestModuleVersion(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_DATE", "2023-01-02T03:04:05Z")
+
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit := func() string {
+		t.Helper()
+		git("commit", "-q", "--allow-empty", "-m", "commit")
+		return git("rev-parse", "HEAD")[:12]
+	}
+	git("init", "-q")
+
+	for i, test := range []struct {
+		tag    string // of a new commit, if any
+		expect string // with %s for the short hash of the commit
+	}{
+		{"", "v0.0.0-20230102030405-%s"},
+		{"not-a-version", "v0.0.0-20230102030405-%s"},
+		{"v1.2", "v1.2.0"},
+		{"", "v1.2.1-0.20230102030405-%s"},
+		{"v1.2.3", "v1.2.3"},
+		{"", "v1.2.4-0.20230102030405-%s"},
+		{"v1.3.0-beta.1", "v1.3.0-beta.1"},
+		{"", "v1.3.0-beta.1.0.20230102030405-%s"},
+	} {
+		hash := commit()
+		if test.tag != "" {
+			git("tag", test.tag)
+		}
+		expect := strings.Replace(test.expect, "%s", hash, 1)
+		actual, err := moduleVersion(dir)
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if actual != expect {
+			t.Errorf("Test %d: expected %s, got %s", i, expect, actual)
+		}
+	}
+}